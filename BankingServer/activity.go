@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// What an account owner sees happening on their account, in real time
+type ActivityEvent struct {
+	// The outbox event ID, which is what clients resume from
+	ID           int64     `json:"id"`
+	AccountID    int       `json:"accountId"`
+	Type         string    `json:"type"`
+	Amount       int64     `json:"amount"`
+	Balance      int64     `json:"balance"`
+	Counterparty int       `json:"counterparty,omitempty"`
+	OccurredAt   time.Time `json:"occurredAt"`
+}
+
+const (
+	ActivityTransferSent     = "transfer.sent"
+	ActivityTransferReceived = "transfer.received"
+	ActivityDepositReceived  = "deposit.received"
+)
+
+const (
+	activityHistorySize = 100
+	activityBufferSize  = 64
+	// How long an account's history outlives its last subscriber, long enough for a
+	// dropped connection to come back and resume
+	activityHistoryTTL    = 10 * time.Minute
+	activitySweepInterval = time.Minute
+)
+
+type ActivitySubscription struct {
+	accountID int
+	// Closed by the hub when the subscriber falls too far behind
+	events chan *ActivityEvent
+	// Whatever the subscriber missed since the ID it resumed from
+	replay []*ActivityEvent
+	// Set when the missed events are no longer all in the history, so the client
+	// has to refetch the account instead of trusting the replay
+	resync bool
+}
+
+type subscribeRequest struct {
+	accountID   int
+	lastEventID int64
+	reply       chan *ActivitySubscription
+}
+
+type accountHistory struct {
+	events []*ActivityEvent
+	// The highest event ID we've had to forget
+	evicted int64
+	// Last published to, or last left by a subscriber
+	touched time.Time
+}
+
+// ActivityHub is the Server pattern from the basics all over again: a single loop owns the
+// subscribers and the history, and everyone else talks to it through channels, so no locks.
+// Publishing never waits on a subscriber; one that can't keep up is dropped, and it can
+// come back with Last-Event-ID.
+type ActivityHub struct {
+	subscribech   chan subscribeRequest
+	unsubscribech chan *ActivitySubscription
+	publishch     chan *ActivityEvent
+	quitch        chan struct{}
+
+	subs    map[int]map[*ActivitySubscription]struct{}
+	history map[int]*accountHistory
+	// The history only goes back to the hub's first event, it's all in memory.
+	// An account without one may have had events before that, or in a history
+	// swept since, forgotten being the highest event ID swept
+	firstEventID int64
+	forgotten    int64
+	// The highest event ID published so far. The outbox delivers at least once,
+	// so the same event can come again, and after later ones
+	lastEventID int64
+}
+
+func NewActivityHub() *ActivityHub {
+	return &ActivityHub{
+		subscribech:   make(chan subscribeRequest),
+		unsubscribech: make(chan *ActivitySubscription),
+		publishch:     make(chan *ActivityEvent),
+		quitch:        make(chan struct{}),
+		subs:          make(map[int]map[*ActivitySubscription]struct{}),
+		history:       make(map[int]*accountHistory),
+	}
+}
+
+func (h *ActivityHub) Start() {
+	go h.loop()
+}
+
+func (h *ActivityHub) Stop() {
+	close(h.quitch)
+}
+
+func (h *ActivityHub) loop() {
+	ticker := time.NewTicker(activitySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req := <-h.subscribech:
+			req.reply <- h.subscribe(req.accountID, req.lastEventID)
+		case sub := <-h.unsubscribech:
+			h.drop(sub)
+		case ev := <-h.publishch:
+			h.broadcast(ev)
+		case now := <-ticker.C:
+			h.sweep(now)
+		case <-h.quitch:
+			for _, subs := range h.subs {
+				for sub := range subs {
+					close(sub.events)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Subscribe starts listening to an account. A lastEventID of 0 means no replay
+func (h *ActivityHub) Subscribe(accountID int, lastEventID int64) *ActivitySubscription {
+	reply := make(chan *ActivitySubscription, 1)
+	select {
+	case h.subscribech <- subscribeRequest{accountID, lastEventID, reply}:
+		return <-reply
+	case <-h.quitch:
+		sub := &ActivitySubscription{accountID: accountID, events: make(chan *ActivityEvent)}
+		close(sub.events)
+		return sub
+	}
+}
+
+func (h *ActivityHub) Unsubscribe(sub *ActivitySubscription) {
+	select {
+	case h.unsubscribech <- sub:
+	case <-h.quitch:
+	}
+}
+
+func (sub *ActivitySubscription) Events() <-chan *ActivityEvent {
+	return sub.events
+}
+
+func (h *ActivityHub) subscribe(accountID int, lastEventID int64) *ActivitySubscription {
+	sub := &ActivitySubscription{
+		accountID: accountID,
+		events:    make(chan *ActivityEvent, activityBufferSize),
+	}
+
+	// Registering and computing the replay happen in the same loop iteration,
+	// so nothing can slip in between the two
+	if hist, ok := h.history[accountID]; ok && lastEventID > 0 {
+		sub.resync = lastEventID < hist.evicted || lastEventID < h.firstEventID-1
+		for _, ev := range hist.events {
+			if ev.ID > lastEventID {
+				sub.replay = append(sub.replay, ev)
+			}
+		}
+	} else if lastEventID > 0 {
+		// No history to go by: nothing happened, or we don't know about it
+		sub.resync = h.firstEventID == 0 || lastEventID < h.firstEventID-1 || lastEventID < h.forgotten
+	}
+
+	if h.subs[accountID] == nil {
+		h.subs[accountID] = make(map[*ActivitySubscription]struct{})
+	}
+	h.subs[accountID][sub] = struct{}{}
+
+	return sub
+}
+
+func (h *ActivityHub) drop(sub *ActivitySubscription) {
+	subs, ok := h.subs[sub.accountID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		// Already dropped for being too slow
+		return
+	}
+
+	delete(subs, sub)
+	close(sub.events)
+	if len(subs) == 0 {
+		delete(h.subs, sub.accountID)
+		if hist, ok := h.history[sub.accountID]; ok {
+			hist.touched = time.Now()
+		}
+	}
+}
+
+// sweep forgets the history of accounts nobody has listened to for a while, or
+// there'd be one for every account that ever had a transfer
+func (h *ActivityHub) sweep(now time.Time) {
+	for accountID, hist := range h.history {
+		if len(h.subs[accountID]) > 0 || now.Sub(hist.touched) < activityHistoryTTL {
+			continue
+		}
+		if last := hist.events[len(hist.events)-1].ID; last > h.forgotten {
+			h.forgotten = last
+		}
+		delete(h.history, accountID)
+	}
+}
+
+func (h *ActivityHub) broadcast(ev *ActivityEvent) {
+	hist, ok := h.history[ev.AccountID]
+	if h.seen(ev, hist) {
+		return
+	}
+	if h.firstEventID == 0 {
+		h.firstEventID = ev.ID
+	}
+	h.lastEventID = ev.ID
+	if !ok {
+		hist = new(accountHistory)
+		h.history[ev.AccountID] = hist
+	}
+	hist.touched = time.Now()
+	hist.events = append(hist.events, ev)
+	if len(hist.events) > activityHistorySize {
+		hist.evicted = hist.events[0].ID
+		hist.events = hist.events[1:]
+	}
+
+	for sub := range h.subs[ev.AccountID] {
+		select {
+		case sub.events <- ev:
+		default:
+			h.drop(sub)
+		}
+	}
+}
+
+// seen tells an event that was already broadcast, or that came after later ones
+// and would be out of order if it went out now. A transfer is two events with
+// the same ID, one per account, so an ID equal to the last one is only seen when
+// the account already has it
+func (h *ActivityHub) seen(ev *ActivityEvent, hist *accountHistory) bool {
+	if ev.ID < h.lastEventID || ev.ID <= h.forgotten {
+		return true
+	}
+	return hist != nil && hist.events[len(hist.events)-1].ID >= ev.ID
+}
+
+// Publish makes the hub one more consumer of the outbox
+func (h *ActivityHub) Publish(ctx context.Context, ev *Event) error {
+	activity, err := activityFromEvent(ev)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range activity {
+		select {
+		case h.publishch <- a:
+		case <-h.quitch:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func activityFromEvent(ev *Event) ([]*ActivityEvent, error) {
+	switch ev.Type {
+	case EventTransferCompleted:
+		transfer := new(TransferCompletedPayload)
+		if err := json.Unmarshal(ev.Payload, transfer); err != nil {
+			return nil, err
+		}
+		return []*ActivityEvent{
+			{
+				ID:           ev.ID,
+				AccountID:    transfer.FromAccount,
+				Type:         ActivityTransferSent,
+				Amount:       -transfer.Amount,
+				Balance:      transfer.FromBalance,
+				Counterparty: transfer.ToAccount,
+				OccurredAt:   ev.CreatedAt,
+			},
+			{
+				ID:           ev.ID,
+				AccountID:    transfer.ToAccount,
+				Type:         ActivityTransferReceived,
+				Amount:       transfer.Amount,
+				Balance:      transfer.ToBalance,
+				Counterparty: transfer.FromAccount,
+				OccurredAt:   ev.CreatedAt,
+			},
+		}, nil
+	case EventDepositCompleted:
+		deposit := new(DepositCompletedPayload)
+		if err := json.Unmarshal(ev.Payload, deposit); err != nil {
+			return nil, err
+		}
+		return []*ActivityEvent{{
+			ID:         ev.ID,
+			AccountID:  deposit.AccountID,
+			Type:       ActivityDepositReceived,
+			Amount:     deposit.Amount,
+			Balance:    deposit.Balance,
+			OccurredAt: ev.CreatedAt,
+		}}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func transferEvent(id int64, from, to int, amount int64) *Event {
+	payload, _ := json.Marshal(TransferCompletedPayload{FromAccount: from, ToAccount: to, Amount: amount})
+	return &Event{ID: id, Type: EventTransferCompleted, AggregateID: from, Payload: payload}
+}
+
+func TestActivityHubDeliversToBothSides(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+
+	sender := hub.Subscribe(1, 0)
+	receiver := hub.Subscribe(2, 0)
+	hub.Publish(context.Background(), transferEvent(1, 1, 2, 30))
+
+	sent := <-sender.Events()
+	received := <-receiver.Events()
+	if sent.Type != ActivityTransferSent || sent.Amount != -30 || sent.Counterparty != 2 {
+		t.Fatalf("sender got %+v", sent)
+	}
+	if received.Type != ActivityTransferReceived || received.Amount != 30 || received.Counterparty != 1 {
+		t.Fatalf("receiver got %+v", received)
+	}
+}
+
+// The relay retries an event when another publisher failed it, the hub has
+// already had it by then
+func TestActivityHubDropsRepublishedEvents(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+
+	sender := hub.Subscribe(1, 0)
+	receiver := hub.Subscribe(2, 0)
+	first := transferEvent(2, 1, 2, 30)
+	hub.Publish(context.Background(), first)
+	hub.Publish(context.Background(), first)
+	hub.Publish(context.Background(), transferEvent(3, 1, 2, 5))
+	hub.Publish(context.Background(), first)
+
+	for _, sub := range []*ActivitySubscription{sender, receiver} {
+		for _, want := range []int64{2, 3} {
+			if ev := <-sub.Events(); ev.ID != want {
+				t.Fatalf("expected event %d, got %+v", want, ev)
+			}
+		}
+		select {
+		case ev := <-sub.Events():
+			t.Fatalf("expected each event once, got %+v again", ev)
+		default:
+		}
+	}
+
+	// The history has each once, in order
+	for _, accountID := range []int{1, 2} {
+		sub := hub.Subscribe(accountID, 1)
+		if len(sub.replay) != 2 || sub.replay[0].ID != 2 || sub.replay[1].ID != 3 {
+			t.Fatalf("unexpected replay %+v", sub.replay)
+		}
+	}
+}
+
+func TestActivityHubReplaysFromLastEventID(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+
+	for i := int64(1); i <= 3; i++ {
+		hub.Publish(context.Background(), transferEvent(i, 1, 2, i))
+	}
+
+	sub := hub.Subscribe(2, 1)
+	if len(sub.replay) != 2 || sub.replay[0].ID != 2 || sub.replay[1].ID != 3 {
+		t.Fatalf("unexpected replay: %+v", sub.replay)
+	}
+	if sub.resync {
+		t.Fatal("resync requested although nothing was evicted")
+	}
+
+	for i := int64(4); i <= activityHistorySize+4; i++ {
+		hub.Publish(context.Background(), transferEvent(i, 1, 2, i))
+	}
+	if !hub.Subscribe(2, 1).resync {
+		t.Fatal("expected a resync once the history no longer covers the gap")
+	}
+}
+
+// The history is in memory, so after a restart it only knows what came since
+func TestActivityHubResyncsWhatItCantReplay(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+
+	if !hub.Subscribe(2, 5).resync {
+		t.Fatal("expected a resync from a hub that has seen nothing yet")
+	}
+	if hub.Subscribe(2, 0).resync {
+		t.Fatal("expected no resync for a subscriber that isn't resuming")
+	}
+
+	hub.Publish(context.Background(), transferEvent(10, 1, 2, 5))
+	if !hub.Subscribe(3, 5).resync || !hub.Subscribe(2, 5).resync {
+		t.Fatal("expected a resync from before the hub's first event")
+	}
+	if sub := hub.Subscribe(3, 9); sub.resync || len(sub.replay) != 0 {
+		t.Fatal("expected nothing missed since the hub's first event")
+	}
+}
+
+func TestActivityHubSweepsUnwatchedHistory(t *testing.T) {
+	// Driven by hand, as the loop would
+	hub := NewActivityHub()
+	watched := hub.subscribe(2, 0)
+	hub.broadcast(&ActivityEvent{ID: 5, AccountID: 1})
+	hub.broadcast(&ActivityEvent{ID: 6, AccountID: 2})
+
+	later := time.Now().Add(activityHistoryTTL)
+	hub.sweep(later)
+	if _, ok := hub.history[1]; ok {
+		t.Fatal("expected the history nobody listens to to go")
+	}
+	if _, ok := hub.history[2]; !ok {
+		t.Fatal("expected a subscriber's history to stay")
+	}
+
+	// Kept for a while after the subscriber leaves, so it can come back
+	hub.drop(watched)
+	hub.sweep(time.Now().Add(activityHistoryTTL / 2))
+	again := hub.subscribe(2, 5)
+	if len(again.replay) != 1 || again.resync {
+		t.Fatalf("expected a replay of event 6, got %+v", again)
+	}
+	hub.drop(again)
+	hub.sweep(later.Add(activityHistoryTTL))
+	if len(hub.history) != 0 {
+		t.Fatalf("expected no history left, got %d", len(hub.history))
+	}
+	if !hub.subscribe(1, 5).resync || hub.subscribe(1, 6).resync {
+		t.Fatal("expected a resync only from before what was swept")
+	}
+}
+
+func TestActivityHubDropsSlowSubscribers(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+
+	slow := hub.Subscribe(2, 0)
+	// Nobody reads from slow, publishing must go on regardless
+	for i := int64(1); i <= activityBufferSize+1; i++ {
+		hub.Publish(context.Background(), transferEvent(i, 1, 2, 1))
+	}
+
+	n := 0
+	for range slow.Events() {
+		n++
+	}
+	if n != activityBufferSize {
+		t.Fatalf("expected %d buffered events before the drop, got %d", activityBufferSize, n)
+	}
+	// Unsubscribing after being dropped is harmless
+	hub.Unsubscribe(slow)
+}
+
+func TestAccountEventsStream(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+	hub.Publish(context.Background(), transferEvent(1, 1, 2, 10))
+
+	server := httptest.NewServer(newAPIServer("", nil, nil, nil, nil, nil, hub, slog.Default(), nil).routes())
+	defer server.Close()
+
+	token, err := createJWT(&Account{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/account/2/events", nil)
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Last-Event-ID", "0")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	hub.Publish(context.Background(), transferEvent(2, 1, 2, 20))
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "id: 2" || lines[1] != "event: "+ActivityTransferReceived || !strings.Contains(lines[2], `"amount":20`) {
+		t.Fatalf("unexpected event: %q", lines)
+	}
+
+	other, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/account/1/events", nil)
+	other.Header.Set("Authorization", token)
+	resp, err = http.DefaultClient.Do(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected someone else's stream to be forbidden, got %d", resp.StatusCode)
+	}
+}
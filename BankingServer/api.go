@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
-	"os"
+	"errors"
 	"strconv"
+	"strings"
 
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"reflect"
-	"runtime"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
@@ -32,40 +37,135 @@ type apiError struct {
 	ErrorMsg string
 }
 
+// How long a route gets before we stop waiting on it, mostly on the DB.
+// Streams are the exception, they're meant to last
+const (
+	readRouteTimeout  = 3 * time.Second
+	writeRouteTimeout = 5 * time.Second
+	noRouteTimeout    = time.Duration(0)
+)
+
 // And the decorator function
-func httpHandlerDecorator(f apiFunc) http.HandlerFunc {
+func httpHandlerDecorator(f apiFunc, timeout time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := f(w, r); err != nil {
-			// We need to handle the error, and for now we'll simply log and tell the client
-			// Get the name of the culprit function
-			funcName := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
-			errMsg := fmt.Sprintf("Error on handler function %s: %v", funcName, err)
-			log.Println(errMsg)
-			// Then write to client
-			if err = WriteJSON(w, http.StatusInternalServerError, "Something went wrong on our side"); err != nil {
-				log.Println("Error writing to client:", err)
-			}
+		// Everything the handler does downstream inherits this deadline through the context
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		err := f(w, r)
+		if err == nil {
+			return
+		}
+
+		logger := requestLogger(r.Context())
+		var invalid *invalidRequestError
+		switch {
+		// Some errors are the client's business, and deserve a proper answer
+		case errors.As(err, &invalid):
+			WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: err.Error()})
+			return
+		case errors.Is(err, ErrAccountNotFound) || errors.Is(err, ErrAPIKeyNotFound):
+			WriteJSON(w, http.StatusNotFound, apiError{ErrorMsg: err.Error()})
+			return
+		case errors.Is(err, ErrAccountFrozen):
+			WriteJSON(w, http.StatusLocked, apiError{ErrorMsg: err.Error()})
+			return
+		case errors.Is(err, ErrPermissionDenied):
+			permissionDenied(w, r, err)
+			return
+		case errors.Is(err, ErrStepUpRequired):
+			// Unlike a plain permission denied, the client can do something about it
+			WriteJSON(w, http.StatusForbidden, apiError{ErrorMsg: err.Error()})
+			return
+		// The driver doesn't always say it was cancelled, but the context knows
+		case errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded):
+			logger.Warn("handler timed out", "timeout", timeout.String(), "err", err)
+			WriteJSON(w, http.StatusGatewayTimeout, apiError{ErrorMsg: "request timed out"})
+			return
+		case errors.Is(r.Context().Err(), context.Canceled):
+			// The client hung up, there's nobody left to answer
+			logger.Info("handler cancelled", "err", err)
+			return
+		case isStoreUnavailable(err):
+			logger.Error("storage unavailable", "err", err)
+			w.Header().Set("Retry-After", "5")
+			WriteJSON(w, http.StatusServiceUnavailable, apiError{ErrorMsg: "service temporarily unavailable"})
+			return
+		}
+
+		// We need to handle the error, and for now we'll simply log and tell the client
+		logger.Error("handler failed", "err", err)
+		// Then write to client
+		if err = WriteJSON(w, http.StatusInternalServerError, "Something went wrong on our side"); err != nil {
+			logger.Error("writing to client failed", "err", err)
 		}
 	}
 }
 
+// isStoreUnavailable tells apart "the DB can't be reached" from "the DB said no"
+func isStoreUnavailable(err error) bool {
+	var netErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, ErrCircuitOpen) ||
+		errors.As(err, &netErr)
+}
+
 type APIServer struct {
 	listenAddr string
-	store      Storage
+	accounts   *AccountService
+	transfers  *TransferService
+	totp       *TOTPService
+	apiKeys    *APIKeyService
+	webhooks   WebhookStore
+	activity   *ActivityHub
+	// nil when CACHE_SIZE turned the cache off
+	cache   *CachedStore
+	limiter *RateLimiter
+	// Replays the answers to retried POSTs
+	idempotency *Idempotency
+	logger      *slog.Logger
+	// May be nil, for no tracing
+	tracer *Tracer
 }
 
-func newAPIServer(listenAddr string, store Storage) *APIServer {
+func newAPIServer(listenAddr string, store Storage, webhooks WebhookStore, statements StatementStore, totp TOTPStore, apiKeys APIKeyStore, activity *ActivityHub, logger *slog.Logger, tracer *Tracer) *APIServer {
+	cache, _ := store.(*CachedStore)
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:  listenAddr,
+		accounts:    NewAccountService(store, statements),
+		transfers:   NewTransferService(store),
+		totp:        NewTOTPService(totp),
+		apiKeys:     NewAPIKeyService(apiKeys),
+		webhooks:    webhooks,
+		activity:    activity,
+		cache:       cache,
+		limiter:     NewRateLimiter(NewMemoryRateLimitBackend(), defaultRouteLimits, defaultRateLimit),
+		idempotency: NewIdempotency(NewMemoryIdempotencyBackend(defaultIdempotencyTTL)),
+		logger:      logger,
+		tracer:      tracer,
 	}
 }
 
 func (s *APIServer) Run() {
+	router := s.routes()
+	router.Use(s.limiter.Middleware)
+
+	err := http.ListenAndServe(s.listenAddr, withRequestLogging(s.logger, withTracing(s.tracer, router)))
+	if err != nil {
+		s.logger.Error("server stopped", "err", err)
+		return
+	}
+}
+
+// routes is kept apart from Run so tests can serve the exact same router
+func (s *APIServer) routes() *mux.Router {
 	// Before you listen and serve anything, we need at least one router
 	// Ok, theoretically, we don't need it, but practically, we do
 
 	router := mux.NewRouter()
+	v1 := router.PathPrefix(apiPrefix).Subrouter()
 
 	// But the below methods aren't http handlers: they return an error, which http handlers don't
 	// So while we could simply handle the error internally, that creates what is essentially
@@ -73,25 +173,149 @@ func (s *APIServer) Run() {
 	// Instead, we'll use the decorator pattern: we'll wrap these handlers inside a function (
 	// with said function corresponding to the http.handler signature) and handle any error
 	// there, once and for all
-	router.HandleFunc("/account/{id}", withJWTAuth(httpHandlerDecorator(s.handleGetAccountByID))).Methods("GET")
-	router.HandleFunc("/account", httpHandlerDecorator(s.handleCreateAccount)).Methods("POST")
-	router.HandleFunc("/account", httpHandlerDecorator(s.handleGetAccount)).Methods("GET")
-	router.HandleFunc("/account/{id}", httpHandlerDecorator(s.handleDeleteAccount)).Methods("DELETE")
-	router.HandleFunc("/transfer", httpHandlerDecorator(s.handleTransfer)).Methods("POST")
+	v1.HandleFunc("/account/{id}", withJWTAuth(httpHandlerDecorator(s.handleGetAccountByID, readRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/account", httpHandlerDecorator(s.handleCreateAccount, writeRouteTimeout)).Methods("POST")
+	v1.HandleFunc("/account", httpHandlerDecorator(s.handleGetAccount, readRouteTimeout)).Methods("GET")
+	v1.HandleFunc("/account/{id}", withJWTAuth(httpHandlerDecorator(s.withStepUp(s.handleDeleteAccount), writeRouteTimeout))).Methods("DELETE")
+	v1.HandleFunc("/transfer", httpHandlerDecorator(s.withStepUp(s.handleTransfer), writeRouteTimeout)).Methods("POST")
+	v1.HandleFunc("/account/{id}/events", withJWTAuth(httpHandlerDecorator(s.handleAccountEvents, noRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/account/{id}/deposit", withJWTAuth(httpHandlerDecorator(s.handleDeposit, writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/account/{id}/webhooks", withJWTAuth(httpHandlerDecorator(s.handleCreateWebhook, writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/account/{id}/webhooks", withJWTAuth(httpHandlerDecorator(s.handleGetWebhooks, readRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/account/{id}/webhooks/deliveries", withJWTAuth(httpHandlerDecorator(s.handleGetWebhookDeliveries, readRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/account/{id}/webhooks/{webhookID}", withJWTAuth(httpHandlerDecorator(s.handleDeleteWebhook, writeRouteTimeout))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/totp", withJWTAuth(httpHandlerDecorator(s.handleEnrollTOTP, writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/account/{id}/totp/verify", withJWTAuth(httpHandlerDecorator(s.handleVerifyTOTP, writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/account/{id}/totp", withAdminAuth(httpHandlerDecorator(s.handleResetTOTP, writeRouteTimeout))).Methods("DELETE")
+	v1.HandleFunc("/account/{id}/statement", withJWTAuth(httpHandlerDecorator(s.handleGetStatement, readRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/account/{id}/freeze", withAdminAuth(httpHandlerDecorator(s.handleSetAccountStatus(AccountFrozen), writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/account/{id}/unfreeze", withAdminAuth(httpHandlerDecorator(s.handleSetAccountStatus(AccountActive), writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/apikey", withAdminAuth(httpHandlerDecorator(s.handleCreateAPIKey, writeRouteTimeout))).Methods("POST")
+	v1.HandleFunc("/apikey", withAdminAuth(httpHandlerDecorator(s.handleGetAPIKeys, readRouteTimeout))).Methods("GET")
+	v1.HandleFunc("/apikey/{keyID}", withAdminAuth(httpHandlerDecorator(s.handleRevokeAPIKey, writeRouteTimeout))).Methods("DELETE")
+	v1.HandleFunc("/cache/stats", withAdminAuth(httpHandlerDecorator(s.handleCacheStats, readRouteTimeout))).Methods("GET")
+	// The document describes the router, this route included, so it's only served
+	// once everything else is registered
+	// Not versioned, verifiers expect it where it is
+	router.HandleFunc("/.well-known/jwks.json", httpHandlerDecorator(handleJWKS, readRouteTimeout)).Methods("GET")
+	openapi := router.Path("/openapi.json").Methods("GET")
+	router.NotFoundHandler = handleUnversioned(router)
+
+	router.Use(withRouteInfo, withReadSession, s.withCaller, s.idempotency.Middleware)
+
+	doc, err := buildOpenAPI(router)
+	if err != nil {
+		panic(err)
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	openapi.HandlerFunc(handleOpenAPI(body))
+
+	return router
+}
+
+// withReadSession tells the store who's asking, so whoever just wrote something
+// reads it back from the primary rather than from a replica that hasn't caught up.
+// That's the account when the request carries a valid token, its address otherwise
+func withReadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := "addr:" + clientIP(r)
+		if sub, ok := tokenSubject(r); ok {
+			session = fmt.Sprintf("account:%d", sub)
+		}
 
-	err := http.ListenAndServe(s.listenAddr, router)
+		next.ServeHTTP(w, r.WithContext(WithReadSession(r.Context(), session)))
+	})
+}
+
+// withCaller tells the services who's asking, going by the API key or else the
+// token. No key or token, or a bad one, is nobody, which the services only let do
+// what anyone may
+func (s *APIServer) withCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if raw := r.Header.Get(apiKeyHeader); raw != "" {
+			key, err := s.apiKeys.Authenticate(r.Context(), raw)
+			if err == nil {
+				// A key's reads follow its writes like an account's do
+				ctx := WithReadSession(r.Context(), "key:"+key.ID)
+				r = r.WithContext(WithCaller(ctx, Caller{APIKey: key}))
+			} else if !errors.Is(err, ErrInvalidAPIKey) {
+				requestLogger(r.Context()).Error("could not check the API key", "err", err)
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := validateJWT(r.Header.Get("Authorization"))
+		if err == nil && token.Valid {
+			r = r.WithContext(WithCaller(r.Context(), callerFromToken(token)))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func callerFromToken(token *jwt.Token) Caller {
+	claims := token.Claims.(jwt.MapClaims)
+	sub, _ := claims["sub"].(float64)
+	caller := Caller{AccountID: int(sub), Admin: isAdminToken(token)}
+	if at, ok := claims["stepUpAt"].(float64); ok {
+		caller.StepUpAt = time.Unix(int64(at), 0)
+	}
+	return caller
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is ignored on
+// purpose: anyone can set it, and we're not behind a proxy we'd trust
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Println("Error starting up server:", err)
-		return
+		return r.RemoteAddr
 	}
+	return host
+}
+
+// tokenSubject is the account of a request carrying a valid token. It doesn't check
+// the token is for the account in the URL, that's still withJWTAuth's job
+func tokenSubject(r *http.Request) (int, bool) {
+	// Worked out once per request, when the request is logged
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return info.Subject, info.HasSubject
+	}
+
+	token, err := validateJWT(r.Header.Get("Authorization"))
+	if err != nil || !token.Valid {
+		return 0, false
+	}
+	sub, ok := token.Claims.(jwt.MapClaims)["sub"].(float64)
+	return int(sub), ok
 }
 
 func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
+	query, err := ParseAccountQuery(r.URL.Query())
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: err.Error()})
+	}
+
+	page, err := s.accounts.List(r.Context(), query)
 	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, accounts)
+
+	// The body stays a plain list, everything about the page goes in the headers
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+
+	accounts := page.Accounts
+	if accounts == nil {
+		accounts = []*Account{}
+	}
+	return writeResponse(w, r, http.StatusOK, accounts)
 }
 
 func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
@@ -103,12 +327,12 @@ func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	account, err := s.store.GetAccountByID(id)
+	account, err := s.accounts.Get(r.Context(), id)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, account)
+	return writeResponse(w, r, http.StatusOK, account)
 }
 
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
@@ -117,18 +341,12 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	newAccount := NewAccount(newAccountBody.FirstName, newAccountBody.LastName)
-	id, err := s.store.CreateAccount(newAccount)
-	if err != nil {
-		return err
-	}
-
-	tokenString, err := createJWT(newAccount, id)
+	_, tokenString, err := s.accounts.Open(r.Context(), newAccountBody.FirstName, newAccountBody.LastName)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusCreated, tokenString)
+	return writeResponse(w, r, http.StatusCreated, tokenString)
 }
 
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
@@ -137,11 +355,11 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	if err = s.store.DeleteAccount(id); err != nil {
+	if err = s.accounts.Close(r.Context(), id); err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, "Account deleted")
+	return writeResponse(w, r, http.StatusOK, "Account deleted")
 }
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 	transferReq := new(TransferRequest)
@@ -150,7 +368,330 @@ func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	return WriteJSON(w, http.StatusAccepted, transferReq)
+	err := s.transfers.Transfer(r.Context(), transferReq.FromAccount, transferReq.ToAccount, int64(transferReq.Amount))
+	if errors.Is(err, ErrInsufficientFunds) {
+		return WriteJSON(w, http.StatusUnprocessableEntity, apiError{ErrorMsg: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusAccepted, transferReq)
+}
+
+func (s *APIServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	depositReq := new(DepositRequest)
+	if err := json.NewDecoder(r.Body).Decode(depositReq); err != nil {
+		return err
+	}
+	if err := s.transfers.Deposit(r.Context(), id, depositReq.Amount); err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusAccepted, depositReq)
+}
+
+func (s *APIServer) handleCreateWebhook(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+	// Webhooks are the owner's, an API key for the account gets past withJWTAuth but not here
+	if err := authorizeAccount(r.Context(), id); err != nil {
+		return err
+	}
+
+	webhookReq := new(CreateWebhookRequest)
+	if err := json.NewDecoder(r.Body).Decode(webhookReq); err != nil {
+		return err
+	}
+
+	hook, err := NewWebhook(r.Context(), id, webhookReq.URL)
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: err.Error()})
+	}
+
+	if hook.ID, err = s.webhooks.CreateWebhook(r.Context(), hook); err != nil {
+		return err
+	}
+
+	// The one and only time the secret leaves the server
+	return writeResponse(w, r, http.StatusCreated, hook)
+}
+
+func (s *APIServer) handleGetWebhooks(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+	if err := authorizeAccount(r.Context(), id); err != nil {
+		return err
+	}
+
+	hooks, err := s.webhooks.GetWebhooks(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, hooks)
+}
+
+func (s *APIServer) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+	if err := authorizeAccount(r.Context(), id); err != nil {
+		return err
+	}
+
+	webhookID, err := strconv.Atoi(mux.Vars(r)["webhookID"])
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: "invalid webhook id"})
+	}
+
+	err = s.webhooks.DeleteWebhook(r.Context(), id, webhookID)
+	if errors.Is(err, ErrWebhookNotFound) {
+		return WriteJSON(w, http.StatusNotFound, apiError{ErrorMsg: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, "Webhook deleted")
+}
+
+func (s *APIServer) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+	if err := authorizeAccount(r.Context(), id); err != nil {
+		return err
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > 500 {
+			return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: "limit must be between 1 and 500"})
+		}
+	}
+
+	deliveries, err := s.webhooks.GetDeliveries(r.Context(), id, limit)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, deliveries)
+}
+
+func (s *APIServer) handleGetStatement(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	from, to, err := ParseStatementPeriod(r.URL.Query(), time.Now())
+	if err != nil {
+		return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: err.Error()})
+	}
+
+	statement, err := s.accounts.Statement(r.Context(), id, from, to)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, statement)
+}
+
+func (s *APIServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	setup, err := s.totp.Enroll(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	// The one and only time the secret leaves the server, like a webhook's
+	return writeResponse(w, r, http.StatusCreated, setup)
+}
+
+func (s *APIServer) handleVerifyTOTP(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	verifyReq := new(TOTPVerifyRequest)
+	if err := json.NewDecoder(r.Body).Decode(verifyReq); err != nil {
+		return err
+	}
+
+	token, err := s.totp.Verify(r.Context(), id, verifyReq.Code)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, TOTPVerifyResponse{Token: token})
+}
+
+func (s *APIServer) handleResetTOTP(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.totp.Reset(r.Context(), id); err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, "TOTP reset")
+}
+
+// handleSetAccountStatus is the handler for freezing, or unfreezing, depending on status
+func (s *APIServer) handleSetAccountStatus(status AccountStatus) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := readID(r)
+		if err != nil {
+			return err
+		}
+
+		account, err := s.accounts.SetStatus(r.Context(), id, status)
+		if err != nil {
+			return err
+		}
+
+		return writeResponse(w, r, http.StatusOK, account)
+	}
+}
+
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	createReq := new(CreateAPIKeyRequest)
+	if err := json.NewDecoder(r.Body).Decode(createReq); err != nil {
+		return err
+	}
+
+	key, raw, err := s.apiKeys.Issue(r.Context(), createReq)
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusCreated, CreateAPIKeyResponse{Key: raw, APIKey: key})
+}
+
+func (s *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	keys, err := s.apiKeys.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, keys)
+}
+
+func (s *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	key, err := s.apiKeys.Revoke(r.Context(), mux.Vars(r)["keyID"])
+	if err != nil {
+		return err
+	}
+
+	return writeResponse(w, r, http.StatusOK, key)
+}
+
+// handleCacheStats is how well the account cache is doing, since this process started
+func (s *APIServer) handleCacheStats(w http.ResponseWriter, r *http.Request) error {
+	if s.cache == nil {
+		return writeResponse(w, r, http.StatusNotFound, apiError{ErrorMsg: "the account cache is off"})
+	}
+
+	return writeResponse(w, r, http.StatusOK, s.cache.Stats())
+}
+
+const sseHeartbeatInterval = 15 * time.Second
+
+// handleAccountEvents streams the account's activity as Server-Sent Events.
+// Clients that drop (or get dropped for being slow) resume with Last-Event-ID
+func (s *APIServer) handleAccountEvents(w http.ResponseWriter, r *http.Request) error {
+	id, err := readID(r)
+	if err != nil {
+		return err
+	}
+
+	// withJWTAuth only checks a key is for the account, the stream is a read
+	if err := authorizeAccountFor(r.Context(), id, APIKeyRead); err != nil {
+		return err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming unsupported by the response writer")
+	}
+
+	var lastEventID int64
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		if lastEventID, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: "invalid Last-Event-ID"})
+		}
+	}
+
+	sub := s.activity.Subscribe(id, lastEventID)
+	defer s.activity.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// Once the headers are out there's no telling the client about errors anymore,
+	// so from here on a failed write just ends the stream
+	if sub.resync {
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+	for _, ev := range sub.replay {
+		if err := writeSSE(w, ev); err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			if err := writeSSE(w, ev); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w io.Writer, ev *ActivityEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
 }
 
 // When you use the same code more than once, it's time to make a function for it
@@ -164,45 +705,88 @@ func readID(r *http.Request) (int, error) {
 	return id, nil
 }
 
+// Account tokens expire like admin tokens do, or a retired signing key would never
+// be done with. There are no passwords to log in again with: once one has expired,
+// bankctl token account issues the next
+const accountTokenTTL = 30 * 24 * time.Hour
+
 func createJWT(acc *Account, id int) (string, error) {
+	now := time.Now()
 	claims := &jwt.MapClaims{
-		"expiresAt":     15000,
 		"accountNumber": acc.AccNumber,
-		"sub": id,
+		"sub":           id,
+		"iat":           now.Unix(),
+		"exp":           now.Add(accountTokenTTL).Unix(),
+	}
+
+	return signJWT(claims)
+}
+
+// Admin tokens aren't anyone's account: they open every account, and the routes
+// only admins get to use. They're issued by bankctl, and expire
+func createAdminJWT(name string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &jwt.MapClaims{
+		"admin": true,
+		"name":  name,
+		"iat":   now.Unix(),
+		"exp":   now.Add(ttl).Unix(),
 	}
 
-	secret := os.Getenv("JWT_TOKEN")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signJWT(claims)
+}
 
-	return token.SignedString([]byte(secret))
+func isAdminToken(token *jwt.Token) bool {
+	admin, _ := token.Claims.(jwt.MapClaims)["admin"].(bool)
+	return admin
 }
 
 func validateJWT(tokenString string) (*jwt.Token, error) {
+	// The token used to be sent on its own, the OpenAPI document says it's a bearer
+	// token, both work
+	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+
 	// THIS LINE RIGHT HERE is the most important part
-	// The secret has to be securely inputted from the env variables
-	secret := os.Getenv("JWT_TOKEN")
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
+	// Which key checks the token is jwtKeyFunc's call, see jwks.go
+	return jwt.Parse(tokenString, jwtKeyFunc)
 }
 
 // Let's implement JWTs
+// An API key does instead of a token, if it's for the account. What it may do on
+// the account is then up to the services, see authorizeAccountFor
 func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("Calling JWT Auth middleware")
+		if r.Header.Get(apiKeyHeader) != "" {
+			// withCaller already checked it
+			key := callerFrom(r.Context()).APIKey
+			if key == nil {
+				permissionDenied(w, r, ErrInvalidAPIKey)
+				return
+			}
+			id, err := readID(r)
+			if err != nil || !key.CoversAccount(id) {
+				permissionDenied(w, r, fmt.Errorf("API key %s isn't for this account", key.ID))
+				return
+			}
+
+			handlerFunc(w, r)
+			return
+		}
 
 		tokenString := r.Header.Get("Authorization")
 		token, err := validateJWT(tokenString)
 		if err != nil {
-			permissionDenied(w, err)
+			permissionDenied(w, r, err)
 			return
 		}
 
 		if !token.Valid {
-			permissionDenied(w, err)
+			permissionDenied(w, r, err)
+			return
+		}
+
+		if isAdminToken(token) {
+			handlerFunc(w, r)
 			return
 		}
 
@@ -211,12 +795,41 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 
 		id, err := readID(r)
 		if err != nil {
-			permissionDenied(w, err)
+			permissionDenied(w, r, err)
 			return
 		}
 		
 		if id != int(claims["sub"].(float64)) {
-			permissionDenied(w, err)
+			permissionDenied(w, r, err)
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
+
+// withStepUp goes in front of the handlers for what a stolen token shouldn't be
+// enough for, see TOTPService.RequireStepUp. The caller's already known by then,
+// withCaller is router middleware
+func (s *APIServer) withStepUp(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := s.totp.RequireStepUp(r.Context()); err != nil {
+			return err
+		}
+
+		return f(w, r)
+	}
+}
+
+func withAdminAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := validateJWT(r.Header.Get("Authorization"))
+		if err != nil {
+			permissionDenied(w, r, err)
+			return
+		}
+		if !token.Valid || !isAdminToken(token) {
+			permissionDenied(w, r, errors.New("not an admin token"))
 			return
 		}
 
@@ -224,7 +837,7 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func permissionDenied(w http.ResponseWriter, err error) {
-	log.Println("Error validating token:", err)
+func permissionDenied(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(r.Context()).Info("permission denied", "err", err)
 	WriteJSON(w, http.StatusForbidden, apiError{ErrorMsg: "permission denied"})
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoratorMapsErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{accountNotFound(1), http.StatusNotFound},
+		{errors.New("boom"), http.StatusInternalServerError},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		handler := httpHandlerDecorator(func(w http.ResponseWriter, r *http.Request) error {
+			return c.err
+		}, readRouteTimeout)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != c.want {
+			t.Errorf("%v: got status %d, want %d", c.err, rec.Code, c.want)
+		}
+	}
+}
+
+func TestDecoratorTimesOut(t *testing.T) {
+	// Stands in for a query stuck on a slow DB, which only gives up when its context does
+	slow := func(w http.ResponseWriter, r *http.Request) error {
+		<-r.Context().Done()
+		return r.Context().Err()
+	}
+
+	rec := httptest.NewRecorder()
+	httpHandlerDecorator(slow, 10*time.Millisecond)(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	httpHandlerDecorator(slow, time.Second)(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if rec.Body.Len() != 0 {
+		t.Fatalf("nothing should be written to a client that left, got %q", rec.Body.String())
+	}
+}
+
+func TestTransferNeedsTheSendersToken(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	ctx := context.Background()
+	store := NewMemoryStore()
+	from, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	to, _ := store.CreateAccount(ctx, NewAccount("Alan", "Turing"))
+	store.Deposit(ctx, from, 100)
+	router := newAPIServer("", store, nil, nil, store, store, nil, slog.Default(), nil).routes()
+	others, _ := createJWT(&Account{}, to)
+
+	for _, token := range []string{"", "not-a-token", others} {
+		req := httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(`{"fromAccount":1,"toAccount":2,"amount":30}`))
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("expected %q to be refused, got %d", token, rec.Code)
+		}
+	}
+	if acc, _ := store.GetAccountByID(ctx, from); acc.Balance != 100 {
+		t.Fatalf("expected nothing sent, got a balance of %d", acc.Balance)
+	}
+}
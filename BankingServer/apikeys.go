@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API keys are for partner backends, which have nobody around to log in. An admin
+// issues one for some accounts and some permissions, and the key goes in the
+// X-API-Key header instead of a token. A key is never an account's owner: it can
+// read, or transfer from, the accounts it's for, and that's all. No step-up
+// either, there's no phone to take a code from.
+//
+// A key is apiKeyPrefix, its ID, a dot and the secret. Only the secret's hash is
+// kept, the key itself is shown once, when it's issued
+
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "bk_"
+	// Keys that don't say when they expire do after this
+	apiKeyDefaultTTL = 90 * 24 * time.Hour
+	apiKeyMaxTTL     = 366 * 24 * time.Hour
+	// How stale LastUsedAt may get, so a busy key isn't a write per request
+	apiKeyTouchInterval = time.Minute
+)
+
+type APIKeyPermission string
+
+const (
+	APIKeyRead     APIKeyPermission = "read"
+	APIKeyTransfer APIKeyPermission = "transfer"
+)
+
+type APIKey struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	AccountIDs  []int              `json:"accountIds"`
+	Permissions []APIKeyPermission `json:"permissions"`
+	// SHA-256 of the secret, hex encoded
+	Hash       string     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Allows says whether the key may do perm on the account
+func (k *APIKey) Allows(accountID int, perm APIKeyPermission) bool {
+	return k.CoversAccount(accountID) && slices.Contains(k.Permissions, perm)
+}
+
+func (k *APIKey) CoversAccount(accountID int) bool {
+	return slices.Contains(k.AccountIDs, accountID)
+}
+
+type CreateAPIKeyRequest struct {
+	// What the key is for, "acme payouts" say
+	Name        string             `json:"name"`
+	AccountIDs  []int              `json:"accountIds"`
+	Permissions []APIKeyPermission `json:"permissions"`
+	// Defaults to apiKeyDefaultTTL from now
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type CreateAPIKeyResponse struct {
+	// Only ever shown once
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"apiKey"`
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(context.Context, *APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	// Newest first, revoked and expired keys included
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+	// RevokeAPIKey keeps the first revocation time when the key already was
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+)
+
+type APIKeyService struct {
+	store APIKeyStore
+	now   func() time.Time
+}
+
+func NewAPIKeyService(store APIKeyStore) *APIKeyService {
+	return &APIKeyService{store: store, now: time.Now}
+}
+
+// Issue makes a key, which only admins get to do. The key comes back along with
+// what's kept of it
+func (s *APIKeyService) Issue(ctx context.Context, req *CreateAPIKeyRequest) (*APIKey, string, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, "", err
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, "", invalidRequest("name is required")
+	}
+	if len(req.AccountIDs) == 0 {
+		return nil, "", invalidRequest("a key is for one account at least")
+	}
+	if len(req.Permissions) == 0 {
+		return nil, "", invalidRequest("a key has one permission at least")
+	}
+	for _, perm := range req.Permissions {
+		if perm != APIKeyRead && perm != APIKeyTransfer {
+			return nil, "", invalidRequest(fmt.Sprintf("unknown permission %q, it's read or transfer", perm))
+		}
+	}
+
+	now := s.now().UTC()
+	expiresAt := now.Add(apiKeyDefaultTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > apiKeyMaxTTL {
+		return nil, "", invalidRequest("expiresAt must be in the next year")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+
+	accounts := slices.Clone(req.AccountIDs)
+	slices.Sort(accounts)
+	perms := slices.Clone(req.Permissions)
+	slices.Sort(perms)
+	key := &APIKey{
+		ID:          hex.EncodeToString(id),
+		Name:        name,
+		AccountIDs:  slices.Compact(accounts),
+		Permissions: slices.Compact(perms),
+		Hash:        hashAPIKeySecret(encodedSecret),
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.store.CreateAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+
+	return key, apiKeyPrefix + key.ID + "." + encodedSecret, nil
+}
+
+func (s *APIKeyService) List(ctx context.Context) ([]*APIKey, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.store.ListAPIKeys(ctx)
+}
+
+// Revoke is for good, a revoked key can't be brought back. It's kept, so whoever
+// looks at the keys later can tell what it was
+func (s *APIKeyService) Revoke(ctx context.Context, id string) (*APIKey, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.RevokeAPIKey(ctx, id, s.now().UTC()); err != nil {
+		return nil, err
+	}
+
+	return s.store.GetAPIKey(ctx, id)
+}
+
+// Authenticate finds the key raw is, unless it's expired or revoked. Whatever's
+// wrong with it, it's ErrInvalidAPIKey, the reason is only for the logs
+func (s *APIKeyService) Authenticate(ctx context.Context, raw string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, apiKeyPrefix), ".")
+	if !ok || !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidAPIKey)
+	}
+
+	key, err := s.store.GetAPIKey(ctx, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, fmt.Errorf("%w: unknown key %s", ErrInvalidAPIKey, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, fmt.Errorf("%w: wrong secret for key %s", ErrInvalidAPIKey, id)
+	}
+	now := s.now()
+	if key.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: key %s is revoked", ErrInvalidAPIKey, id)
+	}
+	if !now.Before(key.ExpiresAt) {
+		return nil, fmt.Errorf("%w: key %s expired", ErrInvalidAPIKey, id)
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		// Not knowing when the key was last used is no reason to turn it away
+		if err := s.store.TouchAPIKey(ctx, id, now.UTC()); err != nil {
+			requestLogger(ctx).Warn("could not record the API key's use", "key", id, "err", err)
+		}
+	}
+
+	return key, nil
+}
+
+// The secret is 32 random bytes, nothing to brute force, so a plain hash is
+// enough where passwords would take a slow one
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (st *PostgresStore) createAPIKeyTable(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS APIKey (
+		id VARCHAR(16) PRIMARY KEY,
+		name TEXT NOT NULL,
+		accountIDs TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		hash VARCHAR(64) NOT NULL,
+		createdAt timestamp NOT NULL,
+		expiresAt timestamp NOT NULL,
+		lastUsedAt timestamp,
+		revokedAt timestamp
+	)`
+
+	_, err := st.q.ExecContext(ctx, query)
+	return err
+}
+
+// The accounts and permissions are JSON arrays, which SQLite has no type for either
+func (st *sqlStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	accounts, err := json.Marshal(key.AccountIDs)
+	if err != nil {
+		return err
+	}
+	perms, err := json.Marshal(key.Permissions)
+	if err != nil {
+		return err
+	}
+
+	_, err = st.q.ExecContext(ctx, `INSERT INTO APIKey (id, name, accountIDs, permissions, hash, createdAt, expiresAt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key.ID, key.Name, string(accounts), string(perms), key.Hash, key.CreatedAt, key.ExpiresAt)
+	return err
+}
+
+const apiKeyColumns = "id, name, accountIDs, permissions, hash, createdAt, expiresAt, lastUsedAt, revokedAt"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	key := new(APIKey)
+	var accounts, perms string
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &accounts, &perms, &key.Hash, &key.CreatedAt, &key.ExpiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(accounts), &key.AccountIDs); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(perms), &key.Permissions); err != nil {
+		return nil, err
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+
+	return key, nil
+}
+
+func (st *sqlStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	key, err := scanAPIKey(st.q.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM APIKey WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return key, err
+}
+
+func (st *sqlStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := st.q.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM APIKey ORDER BY createdAt DESC, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (st *sqlStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := st.q.ExecContext(ctx, "UPDATE APIKey SET revokedAt = COALESCE(revokedAt, $1) WHERE id = $2", at, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (st *sqlStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	_, err := st.q.ExecContext(ctx, "UPDATE APIKey SET lastUsedAt = $1 WHERE id = $2", at, id)
+	return err
+}
+
+func copyAPIKey(key *APIKey) *APIKey {
+	copied := *key
+	copied.AccountIDs = slices.Clone(key.AccountIDs)
+	copied.Permissions = slices.Clone(key.Permissions)
+	return &copied
+}
+
+func (st *MemoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		if _, ok := tx.state.apiKeys[key.ID]; ok {
+			return fmt.Errorf("API key %s already exists", key.ID)
+		}
+		tx.state.apiKeys[key.ID] = copyAPIKey(key)
+		return nil
+	})
+}
+
+func (st *MemoryStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var key *APIKey
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		saved, ok := tx.state.apiKeys[id]
+		if !ok {
+			return ErrAPIKeyNotFound
+		}
+		key = copyAPIKey(saved)
+		return nil
+	})
+
+	return key, err
+}
+
+func (st *MemoryStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	keys := []*APIKey{}
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		for _, key := range tx.state.apiKeys {
+			keys = append(keys, copyAPIKey(key))
+		}
+		return nil
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, err
+}
+
+func (st *MemoryStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		key, ok := tx.state.apiKeys[id]
+		if !ok {
+			return ErrAPIKeyNotFound
+		}
+		if key.RevokedAt == nil {
+			key.RevokedAt = &at
+		}
+		return nil
+	})
+}
+
+func (st *MemoryStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		if key, ok := tx.state.apiKeys[id]; ok {
+			key.LastUsedAt = &at
+		}
+		return nil
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charm-113c/bankingserver/client"
+)
+
+func TestAPIKeyStores(t *testing.T) {
+	for name, newStorage := range storageBackends() {
+		t.Run(name, func(t *testing.T) {
+			store, ok := newStorage(t).(APIKeyStore)
+			if !ok {
+				t.Skip("not an APIKeyStore")
+			}
+			ctx := context.Background()
+			created := time.Now().UTC().Truncate(time.Second)
+			key := &APIKey{ID: "0011223344556677", Name: "acme", AccountIDs: []int{1, 2}, Permissions: []APIKeyPermission{APIKeyRead},
+				Hash: hashAPIKeySecret("secret"), CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+			if err := store.CreateAPIKey(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.TouchAPIKey(ctx, key.ID, created.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.RevokeAPIKey(ctx, key.ID, created.Add(2*time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			// The first revocation is the one that counts
+			store.RevokeAPIKey(ctx, key.ID, created.Add(3*time.Minute))
+
+			got, err := store.GetAPIKey(ctx, key.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != "acme" || len(got.AccountIDs) != 2 || got.Permissions[0] != APIKeyRead || got.Hash != key.Hash ||
+				got.LastUsedAt == nil || !got.RevokedAt.Equal(created.Add(2*time.Minute)) {
+				t.Fatalf("unexpected key %+v", got)
+			}
+
+			if keys, err := store.ListAPIKeys(ctx); err != nil || len(keys) != 1 {
+				t.Fatalf("unexpected keys %v, %v", keys, err)
+			}
+			if _, err := store.GetAPIKey(ctx, "nothing"); !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			if err := store.RevokeAPIKey(ctx, "nothing", created); !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewAPIKeyService(store)
+	ctx := WithCaller(context.Background(), Caller{Admin: true})
+
+	key, raw, err := s.Issue(ctx, &CreateAPIKeyRequest{Name: "acme", AccountIDs: []int{1}, Permissions: []APIKeyPermission{APIKeyRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(key.Hash, raw[strings.Index(raw, ".")+1:]) {
+		t.Fatal("expected only the secret's hash to be kept")
+	}
+	if _, err := s.Authenticate(context.Background(), raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(context.Background(), raw+"x"); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("expected a wrong secret to be refused, got %v", err)
+	}
+
+	s.now = func() time.Time { return time.Now().Add(apiKeyDefaultTTL) }
+	if _, err := s.Authenticate(context.Background(), raw); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("expected an expired key to be refused, got %v", err)
+	}
+
+	// Only admins issue them
+	_, _, err = s.Issue(WithCaller(context.Background(), Caller{AccountID: 1}), &CreateAPIKeyRequest{Name: "mine", AccountIDs: []int{1},
+		Permissions: []APIKeyPermission{APIKeyTransfer}})
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	server := newSDKServer(t)
+	adminToken, _ := createAdminJWT("ops", time.Hour)
+	admin := client.New(server.URL, client.WithToken(adminToken), client.WithBackoff(time.Millisecond))
+
+	open := func(first, last string) int {
+		token, _ := admin.CreateAccount(ctx, first, last)
+		acc, err := client.New(server.URL).Login(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc.ID
+	}
+	adaID, alanID, graceID := open("Ada", "Lovelace"), open("Alan", "Turing"), open("Grace", "Hopper")
+	admin.Deposit(ctx, adaID, 100)
+
+	raw, key, err := admin.CreateAPIKey(ctx, client.CreateAPIKeyRequest{
+		Name: "acme payouts", AccountIDs: []int{adaID, alanID}, Permissions: []string{client.PermissionRead, client.PermissionTransfer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partner := client.New(server.URL, client.WithAPIKey(raw))
+
+	if acc, err := partner.GetAccount(ctx, adaID); err != nil || acc.Balance != 100 {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+	if err := partner.Transfer(ctx, adaID, graceID, 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partner.GetStatement(ctx, adaID, time.Time{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the key's accounts, and only what it was given
+	if _, err := partner.GetAccount(ctx, graceID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if err := partner.Transfer(ctx, graceID, adaID, 10); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if err := partner.Deposit(ctx, adaID, 10); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if err := partner.DeleteAccount(ctx, alanID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if _, err := partner.ListAPIKeys(ctx); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	readOnly, _, _ := admin.CreateAPIKey(ctx, client.CreateAPIKeyRequest{
+		Name: "acme reports", AccountIDs: []int{adaID}, Permissions: []string{client.PermissionRead},
+	})
+	if err := client.New(server.URL, client.WithAPIKey(readOnly)).Transfer(ctx, adaID, alanID, 10); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	keys, err := admin.ListAPIKeys(ctx)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("unexpected keys %v, %v", keys, err)
+	}
+	for _, k := range keys {
+		if k.ID == key.ID && k.LastUsedAt == nil {
+			t.Fatal("expected the key's use to be recorded")
+		}
+	}
+
+	revoked, err := admin.RevokeAPIKey(ctx, key.ID)
+	if err != nil || revoked.RevokedAt == nil {
+		t.Fatalf("unexpected key %+v, %v", revoked, err)
+	}
+	if _, err := partner.GetAccount(ctx, adaID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected a revoked key to be refused, got %v", err)
+	}
+	if _, err := admin.RevokeAPIKey(ctx, "nothing"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charm-113c/bankingserver/client"
+)
+
+// bankctl is the admin tool, built into the server binary: it runs when the binary
+// is called bankctl (make bankctl), or as `bankingserver bankctl`. That way it can use
+// the store directly, which it does unless it's given the API's URL. Going through
+// the API is the better habit: a running server caches accounts for CACHE_TTL, and
+// only sees what the tool did directly once that's up
+
+const bankctlUsage = `Usage: bankctl [flags] <command> [args]
+
+Commands:
+  accounts list [-name N] [-sort S] [-limit N] [-cursor C]
+  accounts create -first NAME -last NAME
+  accounts show ID
+  accounts freeze ID
+  accounts unfreeze ID
+  accounts close ID
+  accounts reset-totp ID
+  token admin [-name N] [-ttl 1h]
+  token account ID
+  keys generate -dir DIR [-alg EdDSA]
+  transfer -from ID -to ID -amount N
+  statement ID [-from TIME] [-to TIME]
+
+Times are RFC 3339. Without -api the store is opened from the same env variables
+as the server's (STORAGE_DRIVER, POSTGRES_*, SQLITE_PATH). Admin tokens are signed
+the way the server signs them, with the key set in JWT_KEYS_DIR or with JWT_TOKEN.
+New keys only sign once JWT_SIGNING_KID says so, see jwks.go. Account tokens are
+signed the same way, for an account whose token has expired. reset-totp is for an
+owner who lost their authenticator, they enroll again with their account token.
+
+Flags:
+`
+
+// bankctlBackend is what the commands need, from the store or over HTTP
+type bankctlBackend interface {
+	CreateAccount(ctx context.Context, firstName, lastName string) (*Account, string, error)
+	// values is GET /account's query string
+	ListAccounts(ctx context.Context, values url.Values) (*AccountPage, error)
+	GetAccount(ctx context.Context, id int) (*Account, error)
+	SetAccountStatus(ctx context.Context, id int, status AccountStatus) (*Account, error)
+	CloseAccount(ctx context.Context, id int) error
+	Transfer(ctx context.Context, from, to int, amount int64) error
+	Statement(ctx context.Context, id int, from, to time.Time) (*Statement, error)
+	ResetTOTP(ctx context.Context, id int) error
+}
+
+type bankctlOpener func(apiURL, token string) (bankctlBackend, error)
+
+var errUsage = errors.New("usage")
+
+type bankctl struct {
+	stdout io.Writer
+	stderr io.Writer
+	// table or json
+	output  string
+	open    func() (bankctlBackend, error)
+	backend bankctlBackend
+}
+
+// runBankctl runs one command and returns the exit code: 1 when it failed, 2 when
+// it was called wrong
+func runBankctl(args []string, stdout, stderr io.Writer, open bankctlOpener) int {
+	fs := flag.NewFlagSet("bankctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, bankctlUsage)
+		fs.PrintDefaults()
+	}
+	apiURL := fs.String("api", os.Getenv("BANKCTL_API"), "the API's URL, instead of the store (env BANKCTL_API)")
+	token := fs.String("token", os.Getenv("BANKCTL_TOKEN"), "token for the API, usually an admin one (env BANKCTL_TOKEN)")
+	output := fs.String("o", "table", "output: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output %q, it's table or json\n", *output)
+		return 2
+	}
+
+	ctl := &bankctl{stdout: stdout, stderr: stderr, output: *output}
+	ctl.open = func() (bankctlBackend, error) { return open(*apiURL, *token) }
+
+	err := ctl.run(context.Background(), fs.Args())
+	switch {
+	case errors.Is(err, errUsage):
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintln(stderr, "bankctl:", err)
+		return 1
+	}
+	return 0
+}
+
+func (ctl *bankctl) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "accounts":
+		if len(args) < 2 {
+			return errUsage
+		}
+		switch args[1] {
+		case "list":
+			return ctl.listAccounts(ctx, args[2:])
+		case "create":
+			return ctl.createAccount(ctx, args[2:])
+		case "show":
+			return ctl.withAccountID(args[2:], func(b bankctlBackend, id int) (*Account, error) {
+				return b.GetAccount(ctx, id)
+			})
+		case "freeze":
+			return ctl.withAccountID(args[2:], func(b bankctlBackend, id int) (*Account, error) {
+				return b.SetAccountStatus(ctx, id, AccountFrozen)
+			})
+		case "unfreeze":
+			return ctl.withAccountID(args[2:], func(b bankctlBackend, id int) (*Account, error) {
+				return b.SetAccountStatus(ctx, id, AccountActive)
+			})
+		case "close":
+			return ctl.closeAccount(ctx, args[2:])
+		case "reset-totp":
+			return ctl.resetTOTP(ctx, args[2:])
+		}
+	case "token":
+		if len(args) >= 2 && args[1] == "admin" {
+			return ctl.adminToken(args[2:])
+		}
+		if len(args) >= 2 && args[1] == "account" {
+			return ctl.accountToken(ctx, args[2:])
+		}
+	case "keys":
+		if len(args) >= 2 && args[1] == "generate" {
+			return ctl.generateKey(args[2:])
+		}
+	case "transfer":
+		return ctl.transfer(ctx, args[1:])
+	case "statement":
+		return ctl.statement(ctx, args[1:])
+	}
+
+	return errUsage
+}
+
+// connect opens the backend the first time a command needs it, so issuing a token
+// doesn't need a DB
+func (ctl *bankctl) connect() (bankctlBackend, error) {
+	if ctl.backend == nil {
+		backend, err := ctl.open()
+		if err != nil {
+			return nil, err
+		}
+		ctl.backend = backend
+	}
+	return ctl.backend, nil
+}
+
+func (ctl *bankctl) listAccounts(ctx context.Context, args []string) error {
+	fs := ctl.flags("accounts list")
+	name := fs.String("name", "", "first or last name prefix")
+	sort := fs.String("sort", "", "id, createdAt, balance or lastName, - in front for descending")
+	limit := fs.Int("limit", 0, "page size")
+	cursor := fs.String("cursor", "", "where the previous page left off")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	values := url.Values{}
+	for k, v := range map[string]string{"name": *name, "sort": *sort, "cursor": *cursor} {
+		if v != "" {
+			values.Set(k, v)
+		}
+	}
+	if *limit > 0 {
+		values.Set("limit", strconv.Itoa(*limit))
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	page, err := backend.ListAccounts(ctx, values)
+	if err != nil {
+		return err
+	}
+
+	if ctl.output == "json" {
+		out := struct {
+			Accounts   []*Account `json:"accounts"`
+			Total      int        `json:"total"`
+			NextCursor string     `json:"nextCursor,omitempty"`
+		}{page.Accounts, page.Total, page.NextCursor}
+		if out.Accounts == nil {
+			out.Accounts = []*Account{}
+		}
+		return ctl.printJSON(out)
+	}
+
+	tw := ctl.table("ID", "NUMBER", "NAME", "BALANCE", "STATUS", "CREATED")
+	for _, acc := range page.Accounts {
+		accountRow(tw, acc)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(ctl.stdout, "\n%d of %d accounts\n", len(page.Accounts), page.Total)
+	if page.NextCursor != "" {
+		fmt.Fprintf(ctl.stdout, "next page: -cursor %s\n", page.NextCursor)
+	}
+	return nil
+}
+
+func (ctl *bankctl) createAccount(ctx context.Context, args []string) error {
+	fs := ctl.flags("accounts create")
+	first := fs.String("first", "", "first name")
+	last := fs.String("last", "", "last name")
+	if err := fs.Parse(args); err != nil || *first == "" || *last == "" {
+		return errUsage
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	acc, token, err := backend.CreateAccount(ctx, *first, *last)
+	if err != nil {
+		return err
+	}
+
+	if ctl.output == "json" {
+		return ctl.printJSON(struct {
+			Account *Account `json:"account"`
+			Token   string   `json:"token"`
+		}{acc, token})
+	}
+	if err := ctl.printAccount(acc); err != nil {
+		return err
+	}
+	fmt.Fprintf(ctl.stdout, "\ntoken: %s\n", token)
+	return nil
+}
+
+// withAccountID runs the commands that take an account ID and print the account
+func (ctl *bankctl) withAccountID(args []string, fn func(bankctlBackend, int) (*Account, error)) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q", args[0])
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	acc, err := fn(backend, id)
+	if err != nil {
+		return err
+	}
+
+	return ctl.printAccount(acc)
+}
+
+func (ctl *bankctl) closeAccount(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q", args[0])
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	// Closing what isn't there would succeed silently, which isn't what ops wants to hear
+	if _, err := backend.GetAccount(ctx, id); err != nil {
+		return err
+	}
+	if err := backend.CloseAccount(ctx, id); err != nil {
+		return err
+	}
+
+	return ctl.printResult(map[string]any{"closed": id}, fmt.Sprintf("account %d closed", id))
+}
+
+// resetTOTP is for an owner who lost their authenticator
+func (ctl *bankctl) resetTOTP(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q", args[0])
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	if _, err := backend.GetAccount(ctx, id); err != nil {
+		return err
+	}
+	if err := backend.ResetTOTP(ctx, id); err != nil {
+		return err
+	}
+
+	return ctl.printResult(map[string]any{"totpReset": id}, fmt.Sprintf("TOTP reset for account %d, its owner can enroll again", id))
+}
+
+func (ctl *bankctl) adminToken(args []string) error {
+	fs := ctl.flags("token admin")
+	name := fs.String("name", os.Getenv("USER"), "who the token is for, it ends up in the claims")
+	ttl := fs.Duration("ttl", time.Hour, "how long the token lasts")
+	if err := fs.Parse(args); err != nil || *ttl <= 0 {
+		return errUsage
+	}
+	if os.Getenv("JWT_TOKEN") == "" && os.Getenv("JWT_KEYS_DIR") == "" {
+		return errors.New("neither JWT_KEYS_DIR nor JWT_TOKEN is set, there's nothing to sign the token with")
+	}
+
+	token, err := createAdminJWT(*name, *ttl)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(*ttl).UTC().Format(time.RFC3339)
+	if ctl.output == "json" {
+		return ctl.printJSON(map[string]string{"token": token, "name": *name, "expiresAt": expires})
+	}
+	fmt.Fprintln(ctl.stdout, token)
+	return nil
+}
+
+// accountToken is the way back in for an account whose token has expired
+func (ctl *bankctl) accountToken(ctx context.Context, args []string) error {
+	if os.Getenv("JWT_TOKEN") == "" && os.Getenv("JWT_KEYS_DIR") == "" {
+		return errors.New("neither JWT_KEYS_DIR nor JWT_TOKEN is set, there's nothing to sign the token with")
+	}
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q", args[0])
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	acc, err := backend.GetAccount(ctx, id)
+	if err != nil {
+		return err
+	}
+	token, err := createJWT(acc, acc.ID)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(accountTokenTTL).UTC().Format(time.RFC3339)
+	if ctl.output == "json" {
+		return ctl.printJSON(map[string]string{"token": token, "expiresAt": expires})
+	}
+	fmt.Fprintln(ctl.stdout, token)
+	return nil
+}
+
+func (ctl *bankctl) generateKey(args []string) error {
+	fs := ctl.flags("keys generate")
+	dir := fs.String("dir", os.Getenv("JWT_KEYS_DIR"), "where the key goes (env JWT_KEYS_DIR)")
+	alg := fs.String("alg", "EdDSA", "EdDSA or RS256")
+	if err := fs.Parse(args); err != nil || *dir == "" {
+		return errUsage
+	}
+
+	kid, err := generateJWTKey(*dir, *alg)
+	if err != nil {
+		return err
+	}
+
+	return ctl.printResult(map[string]string{"kid": kid, "alg": *alg}, kid)
+}
+
+func (ctl *bankctl) transfer(ctx context.Context, args []string) error {
+	fs := ctl.flags("transfer")
+	from := fs.Int("from", 0, "account the money leaves")
+	to := fs.Int("to", 0, "account the money goes to")
+	amount := fs.Int64("amount", 0, "how much")
+	if err := fs.Parse(args); err != nil || *from == 0 || *to == 0 {
+		return errUsage
+	}
+	// Same rules as POST /transfer, which the store doesn't check by itself
+	if *amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if *from == *to {
+		return errors.New("cannot transfer to the same account")
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	if err := backend.Transfer(ctx, *from, *to, *amount); err != nil {
+		return err
+	}
+
+	return ctl.printResult(
+		TransferRequest{FromAccount: *from, ToAccount: *to, Amount: int(*amount)},
+		fmt.Sprintf("transferred %d from account %d to account %d", *amount, *from, *to))
+}
+
+func (ctl *bankctl) statement(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errUsage
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid account ID %q", args[0])
+	}
+
+	fs := ctl.flags("statement")
+	fromFlag := fs.String("from", "", "start of the period, the first of the month by default")
+	toFlag := fs.String("to", "", "end of the period, excluded, now by default")
+	if err := fs.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	values := url.Values{}
+	if *fromFlag != "" {
+		values.Set("from", *fromFlag)
+	}
+	if *toFlag != "" {
+		values.Set("to", *toFlag)
+	}
+	from, to, err := ParseStatementPeriod(values, time.Now())
+	if err != nil {
+		return err
+	}
+
+	backend, err := ctl.connect()
+	if err != nil {
+		return err
+	}
+	statement, err := backend.Statement(ctx, id, from, to)
+	if err != nil {
+		return err
+	}
+
+	if ctl.output == "json" {
+		return ctl.printJSON(statement)
+	}
+
+	fmt.Fprintf(ctl.stdout, "Statement for account %d, %s to %s\n\n", statement.AccountID,
+		statement.From.Format(time.RFC3339), statement.To.Format(time.RFC3339))
+	tw := ctl.table("ID", "DATE", "TYPE", "AMOUNT", "BALANCE", "COUNTERPARTY")
+	for _, e := range statement.Entries {
+		counterparty := ""
+		if e.Counterparty != 0 {
+			counterparty = strconv.Itoa(e.Counterparty)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n", e.ID, e.OccurredAt.Format(time.RFC3339), e.Type, e.Amount, e.Balance, counterparty)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctl.stdout, "\ncredits: %d  debits: %d", statement.Credits, statement.Debits)
+	if statement.OpeningBalance != nil {
+		fmt.Fprintf(ctl.stdout, "  opening: %d  closing: %d", *statement.OpeningBalance, *statement.ClosingBalance)
+	}
+	fmt.Fprintln(ctl.stdout)
+	return nil
+}
+
+func (ctl *bankctl) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ctl.stderr)
+	return fs
+}
+
+func (ctl *bankctl) table(headers ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(ctl.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	return tw
+}
+
+func accountRow(tw io.Writer, acc *Account) {
+	fmt.Fprintf(tw, "%d\t%d\t%s %s\t%d\t%s\t%s\n", acc.ID, acc.AccNumber, acc.FirstName, acc.LastName,
+		acc.Balance, acc.Status, acc.CreatedAt.Format(time.RFC3339))
+}
+
+func (ctl *bankctl) printAccount(acc *Account) error {
+	if ctl.output == "json" {
+		return ctl.printJSON(acc)
+	}
+	tw := ctl.table("ID", "NUMBER", "NAME", "BALANCE", "STATUS", "CREATED")
+	accountRow(tw, acc)
+	return tw.Flush()
+}
+
+// printResult is for the commands with nothing to tabulate: v in JSON, msg otherwise
+func (ctl *bankctl) printResult(v any, msg string) error {
+	if ctl.output == "json" {
+		return ctl.printJSON(v)
+	}
+	_, err := fmt.Fprintln(ctl.stdout, msg)
+	return err
+}
+
+func (ctl *bankctl) printJSON(v any) error {
+	enc := json.NewEncoder(ctl.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// openBankctlBackend is the HTTP API when there's a URL, the store otherwise
+func openBankctlBackend(apiURL, token string) (bankctlBackend, error) {
+	if apiURL != "" {
+		return &apiBackend{
+			url: apiURL,
+			c:   client.New(apiURL, client.WithToken(token)),
+		}, nil
+	}
+
+	logger, err := newLogger(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStore(logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return newStoreBackend(store, store, store), nil
+}
+
+// storeBackend goes through the same services as the API. Whoever can reach the
+// store directly is an operator, and gets to do what an admin does
+type storeBackend struct {
+	accounts  *AccountService
+	transfers *TransferService
+	totp      *TOTPService
+}
+
+func newStoreBackend(store Storage, statements StatementStore, totp TOTPStore) *storeBackend {
+	return &storeBackend{
+		accounts:  NewAccountService(store, statements),
+		transfers: NewTransferService(store),
+		totp:      NewTOTPService(totp),
+	}
+}
+
+func asOperator(ctx context.Context) context.Context {
+	return WithCaller(ctx, Caller{Admin: true})
+}
+
+func (b *storeBackend) CreateAccount(ctx context.Context, firstName, lastName string) (*Account, string, error) {
+	return b.accounts.Open(asOperator(ctx), firstName, lastName)
+}
+
+func (b *storeBackend) ListAccounts(ctx context.Context, values url.Values) (*AccountPage, error) {
+	query, err := ParseAccountQuery(values)
+	if err != nil {
+		return nil, err
+	}
+	return b.accounts.List(asOperator(ctx), query)
+}
+
+func (b *storeBackend) GetAccount(ctx context.Context, id int) (*Account, error) {
+	return b.accounts.Get(asOperator(ctx), id)
+}
+
+func (b *storeBackend) SetAccountStatus(ctx context.Context, id int, status AccountStatus) (*Account, error) {
+	return b.accounts.SetStatus(asOperator(ctx), id, status)
+}
+
+func (b *storeBackend) CloseAccount(ctx context.Context, id int) error {
+	return b.accounts.Close(asOperator(ctx), id)
+}
+
+func (b *storeBackend) Transfer(ctx context.Context, from, to int, amount int64) error {
+	return b.transfers.Transfer(asOperator(ctx), from, to, amount)
+}
+
+func (b *storeBackend) Statement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	return b.accounts.Statement(asOperator(ctx), id, from, to)
+}
+
+func (b *storeBackend) ResetTOTP(ctx context.Context, id int) error {
+	return b.totp.Reset(asOperator(ctx), id)
+}
+
+type apiBackend struct {
+	url string
+	c   *client.Client
+}
+
+func (b *apiBackend) CreateAccount(ctx context.Context, firstName, lastName string) (*Account, string, error) {
+	token, err := b.c.CreateAccount(ctx, firstName, lastName)
+	if err != nil {
+		return nil, "", err
+	}
+	// The API only answers with the token, which is enough to go and get the rest
+	acc, err := client.New(b.url).Login(ctx, token)
+	if err != nil {
+		return nil, "", err
+	}
+	return fromClientAccount(acc), token, nil
+}
+
+func (b *apiBackend) ListAccounts(ctx context.Context, values url.Values) (*AccountPage, error) {
+	opts := client.ListOptions{
+		Name:   values.Get("name"),
+		Sort:   values.Get("sort"),
+		Cursor: values.Get("cursor"),
+	}
+	opts.Limit, _ = strconv.Atoi(values.Get("limit"))
+
+	page, err := b.c.ListAccounts(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &AccountPage{Total: page.Total, NextCursor: page.NextCursor}
+	for i := range page.Accounts {
+		out.Accounts = append(out.Accounts, fromClientAccount(&page.Accounts[i]))
+	}
+	return out, nil
+}
+
+func (b *apiBackend) GetAccount(ctx context.Context, id int) (*Account, error) {
+	acc, err := b.c.GetAccount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return fromClientAccount(acc), nil
+}
+
+func (b *apiBackend) SetAccountStatus(ctx context.Context, id int, status AccountStatus) (*Account, error) {
+	var acc *client.Account
+	var err error
+	if status == AccountFrozen {
+		acc, err = b.c.FreezeAccount(ctx, id)
+	} else {
+		acc, err = b.c.UnfreezeAccount(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromClientAccount(acc), nil
+}
+
+func (b *apiBackend) CloseAccount(ctx context.Context, id int) error {
+	return b.c.DeleteAccount(ctx, id)
+}
+
+func (b *apiBackend) Transfer(ctx context.Context, from, to int, amount int64) error {
+	return b.c.Transfer(ctx, from, to, amount)
+}
+
+func (b *apiBackend) Statement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	s, err := b.c.GetStatement(ctx, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{
+		AccountID:      s.AccountID,
+		From:           s.From,
+		To:             s.To,
+		OpeningBalance: s.OpeningBalance,
+		ClosingBalance: s.ClosingBalance,
+		Credits:        s.Credits,
+		Debits:         s.Debits,
+		Entries:        make([]*ActivityEvent, 0, len(s.Entries)),
+	}
+	for _, e := range s.Entries {
+		statement.Entries = append(statement.Entries, &ActivityEvent{
+			ID:           e.ID,
+			AccountID:    e.AccountID,
+			Type:         e.Type,
+			Amount:       e.Amount,
+			Balance:      e.Balance,
+			Counterparty: e.Counterparty,
+			OccurredAt:   e.OccurredAt,
+		})
+	}
+	return statement, nil
+}
+
+func (b *apiBackend) ResetTOTP(ctx context.Context, id int) error {
+	return b.c.ResetTOTP(ctx, id)
+}
+
+func fromClientAccount(acc *client.Account) *Account {
+	return &Account{
+		ID:        acc.ID,
+		FirstName: acc.FirstName,
+		LastName:  acc.LastName,
+		AccNumber: acc.Number,
+		Balance:   acc.Balance,
+		Status:    AccountStatus(acc.Status),
+		CreatedAt: acc.CreatedAt,
+	}
+}
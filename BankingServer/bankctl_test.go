@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type bankctlResult struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+// bankctlOn runs bankctl against store, as if it had opened it itself
+func bankctlOn(store *MemoryStore) func(args ...string) bankctlResult {
+	open := func(apiURL, token string) (bankctlBackend, error) {
+		if apiURL != "" {
+			return openBankctlBackend(apiURL, token)
+		}
+		return newStoreBackend(store, store, store), nil
+	}
+
+	return func(args ...string) bankctlResult {
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		code := runBankctl(args, stdout, stderr, open)
+		return bankctlResult{code, stdout.String(), stderr.String()}
+	}
+}
+
+func decodeOutput(t *testing.T, res bankctlResult, v any) {
+	t.Helper()
+	if res.code != 0 {
+		t.Fatalf("exit %d: %s", res.code, res.stderr)
+	}
+	if err := json.Unmarshal([]byte(res.stdout), v); err != nil {
+		t.Fatalf("not JSON: %s", res.stdout)
+	}
+}
+
+func TestBankctlAgainstTheStore(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	store := NewMemoryStore()
+	bankctl := bankctlOn(store)
+
+	var created struct {
+		Account *Account
+		Token   string
+	}
+	decodeOutput(t, bankctl("-o", "json", "accounts", "create", "-first", "Ada", "-last", "Lovelace"), &created)
+	if created.Account.ID != 1 || created.Account.Status != AccountActive || created.Token == "" {
+		t.Fatalf("unexpected account %+v", created)
+	}
+	bankctl("accounts", "create", "-first", "Alan", "-last", "Turing")
+	NewTransferService(store).Deposit(asOperator(context.Background()), 1, 100)
+
+	if res := bankctl("transfer", "-from", "1", "-to", "2", "-amount", "30"); res.code != 0 {
+		t.Fatalf("transfer failed: %s", res.stderr)
+	}
+
+	// Frozen accounts keep their money
+	var frozen Account
+	decodeOutput(t, bankctl("-o", "json", "accounts", "freeze", "1"), &frozen)
+	if frozen.Status != AccountFrozen {
+		t.Fatalf("expected a frozen account, got %+v", frozen)
+	}
+	res := bankctl("transfer", "-from", "1", "-to", "2", "-amount", "30")
+	if res.code != 1 || !strings.Contains(res.stderr, "frozen") {
+		t.Fatalf("expected the transfer refused, got %d %q", res.code, res.stderr)
+	}
+	bankctl("accounts", "unfreeze", "1")
+
+	res = bankctl("accounts", "list")
+	if res.code != 0 || !strings.Contains(res.stdout, "Ada Lovelace") || !strings.Contains(res.stdout, "2 of 2 accounts") {
+		t.Fatalf("unexpected list\n%s", res.stdout)
+	}
+
+	var statement Statement
+	decodeOutput(t, bankctl("-o", "json", "statement", "1"), &statement)
+	if len(statement.Entries) != 2 || statement.Credits != 100 || statement.Debits != 30 ||
+		*statement.OpeningBalance != 0 || *statement.ClosingBalance != 70 {
+		t.Fatalf("unexpected statement %+v", statement)
+	}
+	if res := bankctl("statement", "2"); !strings.Contains(res.stdout, ActivityTransferReceived) {
+		t.Fatalf("unexpected statement table\n%s", res.stdout)
+	}
+
+	// Issued again once the first has expired
+	res = bankctl("token", "account", "1")
+	if token, err := validateJWT(strings.TrimSpace(res.stdout)); err != nil || token.Claims.(jwt.MapClaims)["sub"].(float64) != 1 {
+		t.Fatalf("unexpected account token %q, %v", res.stdout, err)
+	}
+
+	// Account 1's owner lost their phone
+	store.SaveTOTP(context.Background(), &TOTPEnrollment{AccountID: 1, Secret: []byte{1}, Confirmed: true, CreatedAt: time.Now()})
+	if res := bankctl("accounts", "reset-totp", "1"); res.code != 0 {
+		t.Fatalf("reset failed: %s", res.stderr)
+	}
+	if _, err := store.GetTOTP(context.Background(), 1); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Fatalf("expected TOTP gone, got %v", err)
+	}
+	if res := bankctl("accounts", "reset-totp", "99"); res.code != 1 {
+		t.Fatal("expected resetting a missing account to fail")
+	}
+
+	if res := bankctl("accounts", "close", "2"); res.code != 0 {
+		t.Fatalf("close failed: %s", res.stderr)
+	}
+	if res := bankctl("accounts", "show", "2"); res.code != 1 {
+		t.Fatal("closed account still there")
+	}
+
+	if res := bankctl("accounts", "frobnicate"); res.code != 2 || !strings.Contains(res.stderr, "Usage") {
+		t.Fatalf("expected usage, got %d", res.code)
+	}
+}
+
+func TestBankctlAgainstTheAPI(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	store := NewMemoryStore()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := httptest.NewServer(newAPIServer("", store, nil, store, store, store, nil, logger, nil).routes())
+	defer server.Close()
+	bankctl := bankctlOn(nil)
+
+	res := bankctl("token", "admin", "-name", "ops", "-ttl", "5m")
+	if res.code != 0 {
+		t.Fatalf("no admin token: %s", res.stderr)
+	}
+	admin := strings.TrimSpace(res.stdout)
+
+	var created struct {
+		Account *Account
+		Token   string
+	}
+	decodeOutput(t, bankctl("-api", server.URL, "-o", "json", "accounts", "create", "-first", "Ada", "-last", "Lovelace"), &created)
+	id := created.Account.ID
+
+	// Showing and freezing someone's account takes an admin token
+	if res := bankctl("-api", server.URL, "accounts", "freeze", "1"); res.code != 1 {
+		t.Fatal("froze an account without a token")
+	}
+	if res := bankctl("-api", server.URL, "-token", created.Token, "accounts", "freeze", "1"); res.code != 1 {
+		t.Fatal("the owner's token froze the account")
+	}
+	var frozen Account
+	decodeOutput(t, bankctl("-api", server.URL, "-token", admin, "-o", "json", "accounts", "freeze", "1"), &frozen)
+	if frozen.ID != id || frozen.Status != AccountFrozen {
+		t.Fatalf("unexpected account %+v", frozen)
+	}
+	if acc, _ := store.GetAccountByID(context.Background(), id); acc.Status != AccountFrozen {
+		t.Fatal("account not frozen in the store")
+	}
+
+	res = bankctl("-api", server.URL, "-token", admin, "accounts", "show", "1")
+	if res.code != 0 || !strings.Contains(res.stdout, "frozen") {
+		t.Fatalf("unexpected account table %d\n%s%s", res.code, res.stdout, res.stderr)
+	}
+
+	var statement Statement
+	decodeOutput(t, bankctl("-api", server.URL, "-token", admin, "-o", "json", "statement", "1"), &statement)
+	if statement.AccountID != id || len(statement.Entries) != 0 {
+		t.Fatalf("unexpected statement %+v", statement)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CachedStore keeps recently read accounts in memory, in front of any other Storage.
+// Only GetAccountByID is cached, everything else goes straight through, and every
+// write drops the accounts it touched. The cache lives in this process, so it's only
+// right as long as this process is the only one writing.
+// Misses are read wherever the store sends them, a replica included. A replica may
+// not have a write yet for a while after it, so an account written in the last
+// replicaLag is handed back but not cached, or its old copy could stay for a TTL
+type CachedStore struct {
+	Storage
+
+	size       int
+	ttl        time.Duration
+	replicaLag time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	// Most recently used at the front
+	lru *list.List
+	// Reads on their way to the store, so concurrent misses for an ID wait for one read
+	inflight map[int]*cacheCall
+	// When accounts were last written, for as long as replicaLag
+	written map[int]time.Time
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	id        int
+	acc       *Account
+	expiresAt time.Time
+}
+
+type cacheCall struct {
+	done chan struct{}
+	acc  *Account
+	err  error
+	// Set when the account was written while it was being read, the result may be stale
+	stale bool
+}
+
+type CacheStats struct {
+	Hits uint64 `json:"hits"`
+	// Misses that went to the store
+	Misses uint64 `json:"misses"`
+	// Misses that waited on someone else's read instead
+	Coalesced uint64 `json:"coalesced"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = 30 * time.Second
+)
+
+func NewCachedStore(store Storage, size int, ttl time.Duration) *CachedStore {
+	return &CachedStore{
+		Storage:    store,
+		size:       size,
+		ttl:        ttl,
+		replicaLag: defaultStickyWindow,
+		now:        time.Now,
+		entries:    make(map[int]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[int]*cacheCall),
+		written:    make(map[int]time.Time),
+	}
+}
+
+func (st *CachedStore) Stats() CacheStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stats := st.stats
+	stats.Size = st.lru.Len()
+	return stats
+}
+
+func (st *CachedStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	st.mu.Lock()
+	if acc, ok := st.lookup(id); ok {
+		st.stats.Hits++
+		st.mu.Unlock()
+		return acc, nil
+	}
+
+	if call, ok := st.inflight[id]; ok {
+		st.stats.Coalesced++
+		st.mu.Unlock()
+		return st.wait(ctx, id, call)
+	}
+
+	st.stats.Misses++
+	call := &cacheCall{done: make(chan struct{})}
+	st.inflight[id] = call
+	st.mu.Unlock()
+
+	call.acc, call.err = st.Storage.GetAccountByID(ctx, id)
+
+	st.mu.Lock()
+	delete(st.inflight, id)
+	// Not found isn't cached, the account may well be created next
+	if call.err == nil && !call.stale && !st.recentlyWritten(id) {
+		st.add(id, call.acc)
+	}
+	st.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	copied := *call.acc
+	return &copied, nil
+}
+
+// wait is a coalesced miss, which gets the result of the read already under way
+func (st *CachedStore) wait(ctx context.Context, id int, call *cacheCall) (*Account, error) {
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// The read we waited on was cut short by its own caller, which says nothing about ours
+	if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+		return st.Storage.GetAccountByID(ctx, id)
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	copied := *call.acc
+	return &copied, nil
+}
+
+// recentlyWritten tells whether a replica may still have the account as it was
+// before its last write. It expects st.mu to be held
+func (st *CachedStore) recentlyWritten(id int) bool {
+	at, ok := st.written[id]
+	if ok && st.now().Sub(at) >= st.replicaLag {
+		delete(st.written, id)
+		return false
+	}
+	return ok
+}
+
+// lookup and add expect st.mu to be held
+func (st *CachedStore) lookup(id int) (*Account, bool) {
+	elem, ok := st.entries[id]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !st.now().Before(entry.expiresAt) {
+		st.lru.Remove(elem)
+		delete(st.entries, id)
+		return nil, false
+	}
+
+	st.lru.MoveToFront(elem)
+	// Callers get their own copy, what's cached must not change under us
+	copied := *entry.acc
+	return &copied, true
+}
+
+func (st *CachedStore) add(id int, acc *Account) {
+	entry := &cacheEntry{id: id, acc: acc, expiresAt: st.now().Add(st.ttl)}
+	if elem, ok := st.entries[id]; ok {
+		elem.Value = entry
+		st.lru.MoveToFront(elem)
+		return
+	}
+
+	st.entries[id] = st.lru.PushFront(entry)
+	for st.lru.Len() > st.size {
+		oldest := st.lru.Back()
+		st.lru.Remove(oldest)
+		delete(st.entries, oldest.Value.(*cacheEntry).id)
+		st.stats.Evictions++
+	}
+}
+
+// invalidate drops the accounts, and spoils any read of them still under way.
+// It runs after the write, so a read that started earlier can't put the old
+// account back once we're done
+func (st *CachedStore) invalidate(ids ...int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	// Accounts written once and never read again would otherwise stay forever
+	if len(st.written) > st.size {
+		for id, at := range st.written {
+			if now.Sub(at) >= st.replicaLag {
+				delete(st.written, id)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		st.written[id] = now
+		if elem, ok := st.entries[id]; ok {
+			st.lru.Remove(elem)
+			delete(st.entries, id)
+		}
+		if call, ok := st.inflight[id]; ok {
+			call.stale = true
+		}
+	}
+}
+
+// Writes drop what they touched whether they succeeded or not, a failed write may
+// still have got as far as the DB
+
+func (st *CachedStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	defer st.invalidate(acc.ID)
+	return st.Storage.UpdateAccount(ctx, acc)
+}
+
+func (st *CachedStore) DeleteAccount(ctx context.Context, id int) error {
+	defer st.invalidate(id)
+	return st.Storage.DeleteAccount(ctx, id)
+}
+
+func (st *CachedStore) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	defer st.invalidate(fromID, toID)
+	return st.Storage.Transfer(ctx, fromID, toID, amount)
+}
+
+func (st *CachedStore) Deposit(ctx context.Context, id int, amount int64) error {
+	defer st.invalidate(id)
+	return st.Storage.Deposit(ctx, id, amount)
+}
+
+func (st *CachedStore) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	defer st.invalidate(id)
+	return st.Storage.SetAccountStatus(ctx, id, status)
+}
+
+// WithTx hands fn the uncached transaction, since reads in there must see its own
+// writes, and drops everything fn wrote once the transaction is over
+func (st *CachedStore) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	touched := make(map[int]bool)
+	defer func() {
+		ids := make([]int, 0, len(touched))
+		for id := range touched {
+			ids = append(ids, id)
+		}
+		st.invalidate(ids...)
+	}()
+
+	return st.Storage.WithTx(ctx, func(tx Storage) error {
+		return fn(&cacheTx{Storage: tx, touched: touched})
+	}, opts...)
+}
+
+// cacheTx notes down which accounts a transaction writes
+type cacheTx struct {
+	Storage
+	touched map[int]bool
+}
+
+func (tx *cacheTx) UpdateAccount(ctx context.Context, acc *Account) error {
+	tx.touched[acc.ID] = true
+	return tx.Storage.UpdateAccount(ctx, acc)
+}
+
+func (tx *cacheTx) DeleteAccount(ctx context.Context, id int) error {
+	tx.touched[id] = true
+	return tx.Storage.DeleteAccount(ctx, id)
+}
+
+func (tx *cacheTx) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	tx.touched[fromID] = true
+	tx.touched[toID] = true
+	return tx.Storage.Transfer(ctx, fromID, toID, amount)
+}
+
+func (tx *cacheTx) Deposit(ctx context.Context, id int, amount int64) error {
+	tx.touched[id] = true
+	return tx.Storage.Deposit(ctx, id, amount)
+}
+
+func (tx *cacheTx) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	tx.touched[id] = true
+	return tx.Storage.SetAccountStatus(ctx, id, status)
+}
+
+func (tx *cacheTx) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	return tx.Storage.WithTx(ctx, func(inner Storage) error {
+		return fn(&cacheTx{Storage: inner, touched: tx.touched})
+	}, opts...)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the reads reaching the store, and can hold them up
+type countingStore struct {
+	Storage
+	reads atomic.Int32
+	// Reads that were kept off the replicas
+	primaryReads atomic.Int32
+	release      chan struct{}
+}
+
+func (s *countingStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.reads.Add(1)
+	if primary, _ := ctx.Value(readPrimaryKey{}).(bool); primary {
+		s.primaryReads.Add(1)
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	return s.Storage.GetAccountByID(ctx, id)
+}
+
+func newTestCache(t *testing.T, size int) (*CachedStore, *countingStore, int) {
+	t.Helper()
+	inner := &countingStore{Storage: NewMemoryStore()}
+	cache := NewCachedStore(inner, size, time.Minute)
+	id, err := cache.CreateAccount(context.Background(), NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache, inner, id
+}
+
+func TestCacheHitsAndExpires(t *testing.T) {
+	ctx := context.Background()
+	cache, inner, id := newTestCache(t, 10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetAccountByID(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.reads.Load() != 1 {
+		t.Fatalf("expected 1 read from the store, got %d", inner.reads.Load())
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	now = now.Add(time.Minute)
+	cache.GetAccountByID(ctx, id)
+	if inner.reads.Load() != 2 {
+		t.Fatal("expired entry was still served")
+	}
+}
+
+func TestCacheReturnsCopies(t *testing.T) {
+	ctx := context.Background()
+	cache, _, id := newTestCache(t, 10)
+
+	acc, _ := cache.GetAccountByID(ctx, id)
+	acc.Balance = 1_000_000
+
+	cached, _ := cache.GetAccountByID(ctx, id)
+	if cached.Balance != 0 {
+		t.Fatal("a caller changed the cached account")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	cache, inner, first := newTestCache(t, 2)
+	second, _ := cache.CreateAccount(ctx, NewAccount("Grace", "Hopper"))
+	third, _ := cache.CreateAccount(ctx, NewAccount("Alan", "Turing"))
+
+	cache.GetAccountByID(ctx, first)
+	cache.GetAccountByID(ctx, second)
+	cache.GetAccountByID(ctx, first)
+	cache.GetAccountByID(ctx, third)
+
+	inner.reads.Store(0)
+	cache.GetAccountByID(ctx, first)
+	cache.GetAccountByID(ctx, third)
+	if inner.reads.Load() != 0 {
+		t.Fatal("recently used accounts were evicted")
+	}
+	cache.GetAccountByID(ctx, second)
+	if inner.reads.Load() != 1 {
+		t.Fatal("least recently used account wasn't evicted")
+	}
+	if stats := cache.Stats(); stats.Evictions != 2 || stats.Size != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheInvalidatesOnWrites(t *testing.T) {
+	ctx := context.Background()
+	cache, _, id := newTestCache(t, 10)
+	other, _ := cache.CreateAccount(ctx, NewAccount("Grace", "Hopper"))
+
+	writes := []func() error{
+		func() error { return cache.Deposit(ctx, id, 100) },
+		func() error { return cache.Transfer(ctx, id, other, 40) },
+		func() error {
+			return cache.UpdateAccount(ctx, &Account{ID: id, FirstName: "Augusta", LastName: "King"})
+		},
+		func() error {
+			return cache.WithTx(ctx, func(tx Storage) error { return tx.Deposit(ctx, other, 5) })
+		},
+	}
+	for _, write := range writes {
+		// Warm both up, then check the write is visible straight away
+		before, _ := cache.GetAccountByID(ctx, id)
+		otherBefore, _ := cache.GetAccountByID(ctx, other)
+		if err := write(); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := cache.GetAccountByID(ctx, id)
+		otherAfter, _ := cache.GetAccountByID(ctx, other)
+		if *before == *after && *otherBefore == *otherAfter {
+			t.Fatal("write not visible through the cache")
+		}
+	}
+
+	if err := cache.DeleteAccount(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetAccountByID(ctx, id); err == nil {
+		t.Fatal("deleted account still served from the cache")
+	}
+}
+
+// Misses may go to a replica, which may not have an account's last write yet
+func TestCacheSkipsRecentWritesOnReplicaReads(t *testing.T) {
+	ctx := context.Background()
+	cache, inner, id := newTestCache(t, 10)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.GetAccountByID(ctx, id)
+	if inner.primaryReads.Load() != 0 {
+		t.Fatal("expected the miss to be left to the store's read routing")
+	}
+
+	cache.Deposit(ctx, id, 10)
+	cache.GetAccountByID(ctx, id)
+	cache.GetAccountByID(ctx, id)
+	if inner.reads.Load() != 3 {
+		t.Fatalf("expected reads right after a write not to be cached, got %d reads", inner.reads.Load())
+	}
+
+	now = now.Add(cache.replicaLag)
+	cache.GetAccountByID(ctx, id)
+	cache.GetAccountByID(ctx, id)
+	if inner.reads.Load() != 4 {
+		t.Fatalf("expected the account cached once replicas caught up, got %d reads", inner.reads.Load())
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	ctx := context.Background()
+	cache, inner, id := newTestCache(t, 10)
+	inner.release = make(chan struct{})
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.GetAccountByID(ctx, id); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// Let everyone pile up behind the first read before it's let through
+	for cache.Stats().Coalesced != n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(inner.release)
+	wg.Wait()
+
+	if inner.reads.Load() != 1 {
+		t.Fatalf("expected 1 read from the store, got %d", inner.reads.Load())
+	}
+}
+
+func TestCacheDropsReadsOverlappingWrites(t *testing.T) {
+	ctx := context.Background()
+	cache, inner, id := newTestCache(t, 10)
+	inner.release = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.GetAccountByID(ctx, id)
+	}()
+	for inner.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The read is under way when the deposit lands, whatever it returns may be old
+	cache.Deposit(ctx, id, 100)
+	close(inner.release)
+	<-done
+
+	inner.release = nil
+	acc, _ := cache.GetAccountByID(ctx, id)
+	if acc.Balance != 100 {
+		t.Fatalf("stale balance %d served after a deposit", acc.Balance)
+	}
+}
+
+func TestCacheStatsRoute(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	cache, _, id := newTestCache(t, 10)
+	cache.GetAccountByID(context.Background(), id)
+	cache.GetAccountByID(context.Background(), id)
+	router := newAPIServer("", cache, nil, nil, nil, nil, nil, slog.Default(), nil).routes()
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/cache/stats", nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	accountToken, _ := createJWT(&Account{}, id)
+	if rec := get(accountToken); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected an account token to be refused, got %d", rec.Code)
+	}
+	adminToken, _ := createAdminJWT("ops", time.Hour)
+	rec := get(adminToken)
+	var stats CacheStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.Hits != 1 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected stats %s", rec.Body)
+	}
+}
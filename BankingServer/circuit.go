@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerStore stops calling a store that can't be reached. After enough
+// failures in a row it fails every call straight away with ErrCircuitOpen, rather
+// than have each request wait for a timeout, until the cooldown is over. Then one
+// call is let through to see how things are: if it works we're back in business,
+// if not the breaker opens for another cooldown.
+// Only the store being unreachable or timing out counts as a failure, see isStoreUnavailable.
+// Not found, insufficient funds and friends mean the store is doing just fine
+type CircuitBreakerStore struct {
+	Storage
+
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	logger    *slog.Logger
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// One call is out finding whether the store is back, everyone else fails fast
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCooldown  = 10 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("store unavailable, circuit open")
+
+func NewCircuitBreakerStore(store Storage, threshold int, cooldown time.Duration, logger *slog.Logger) *CircuitBreakerStore {
+	return &CircuitBreakerStore{
+		Storage:   store,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		logger:    logger,
+	}
+}
+
+// allow tells whether a call may go through
+func (st *CircuitBreakerStore) allow() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch st.state {
+	case circuitOpen:
+		if st.now().Sub(st.openedAt) < st.cooldown {
+			return ErrCircuitOpen
+		}
+		st.setState(circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// done records how a call that went through turned out
+func (st *CircuitBreakerStore) done(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// A call given up on by its caller tells nothing either way. If it was the one
+	// finding out, the next call can have a go
+	if errors.Is(err, context.Canceled) {
+		if st.state == circuitHalfOpen {
+			st.setState(circuitOpen)
+		}
+		return
+	}
+
+	// A DB that hangs is as down as one that refuses connections
+	if err == nil || !(isStoreUnavailable(err) || errors.Is(err, context.DeadlineExceeded)) {
+		st.failures = 0
+		st.setState(circuitClosed)
+		return
+	}
+
+	st.failures++
+	if st.state == circuitHalfOpen || st.failures >= st.threshold {
+		st.openedAt = st.now()
+		st.setState(circuitOpen)
+	}
+}
+
+// setState expects st.mu to be held
+func (st *CircuitBreakerStore) setState(state circuitState) {
+	if st.state != state {
+		st.logger.Warn("store circuit breaker changed state", "from", st.state.String(), "to", state.String(), "failures", st.failures)
+		st.state = state
+	}
+}
+
+func (st *CircuitBreakerStore) call(fn func() error) error {
+	if err := st.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	st.done(err)
+	return err
+}
+
+func (st *CircuitBreakerStore) CreateAccount(ctx context.Context, acc *Account) (int, error) {
+	id := -1
+	err := st.call(func() (err error) {
+		id, err = st.Storage.CreateAccount(ctx, acc)
+		return err
+	})
+
+	return id, err
+}
+
+func (st *CircuitBreakerStore) DeleteAccount(ctx context.Context, id int) error {
+	return st.call(func() error { return st.Storage.DeleteAccount(ctx, id) })
+}
+
+func (st *CircuitBreakerStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	return st.call(func() error { return st.Storage.UpdateAccount(ctx, acc) })
+}
+
+func (st *CircuitBreakerStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	var acc *Account
+	err := st.call(func() (err error) {
+		acc, err = st.Storage.GetAccountByID(ctx, id)
+		return err
+	})
+
+	return acc, err
+}
+
+func (st *CircuitBreakerStore) GetAccounts(ctx context.Context, q *AccountQuery) (*AccountPage, error) {
+	var page *AccountPage
+	err := st.call(func() (err error) {
+		page, err = st.Storage.GetAccounts(ctx, q)
+		return err
+	})
+
+	return page, err
+}
+
+func (st *CircuitBreakerStore) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	return st.call(func() error { return st.Storage.Transfer(ctx, fromID, toID, amount) })
+}
+
+func (st *CircuitBreakerStore) Deposit(ctx context.Context, id int, amount int64) error {
+	return st.call(func() error { return st.Storage.Deposit(ctx, id, amount) })
+}
+
+func (st *CircuitBreakerStore) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	return st.call(func() error { return st.Storage.SetAccountStatus(ctx, id, status) })
+}
+
+func (st *CircuitBreakerStore) RecordEvent(ctx context.Context, eventType EventType, aggregateID int, payload any) error {
+	return st.call(func() error { return st.Storage.RecordEvent(ctx, eventType, aggregateID, payload) })
+}
+
+// The whole transaction counts as one call, fn works on the transaction directly
+func (st *CircuitBreakerStore) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	return st.call(func() error { return st.Storage.WithTx(ctx, fn, opts...) })
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingStore fails every read with err, when there's one
+type failingStore struct {
+	Storage
+	err   error
+	calls int
+}
+
+func (s *failingStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Storage.GetAccountByID(ctx, id)
+}
+
+func newTestBreaker(t *testing.T) (*CircuitBreakerStore, *failingStore, int, *time.Time) {
+	t.Helper()
+	inner := &failingStore{Storage: NewMemoryStore()}
+	id, err := inner.CreateAccount(context.Background(), NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breaker := NewCircuitBreakerStore(inner, 3, time.Second, slog.Default())
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	return breaker, inner, id, &now
+}
+
+var errDBDown = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	ctx := context.Background()
+	breaker, inner, id, now := newTestBreaker(t)
+	inner.err = errDBDown
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.GetAccountByID(ctx, id); !errors.Is(err, errDBDown) {
+			t.Fatalf("expected the store's error, got %v", err)
+		}
+	}
+
+	// Open: nothing reaches the store until the cooldown is over
+	if _, err := breaker.GetAccountByID(ctx, id); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if inner.calls != 3 {
+		t.Fatalf("store called %d times while open", inner.calls)
+	}
+	if !isStoreUnavailable(ErrCircuitOpen) {
+		t.Fatal("an open circuit should be a 503")
+	}
+
+	// A probe that fails opens it again straight away
+	*now = now.Add(time.Second)
+	breaker.GetAccountByID(ctx, id)
+	if _, err := breaker.GetAccountByID(ctx, id); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a failed probe to reopen the circuit, got %v", err)
+	}
+
+	// And one that works closes it
+	*now = now.Add(time.Second)
+	inner.err = nil
+	if _, err := breaker.GetAccountByID(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if breaker.state != circuitClosed || breaker.failures != 0 {
+		t.Fatalf("circuit should be closed, is %s with %d failures", breaker.state, breaker.failures)
+	}
+}
+
+func TestCircuitBreakerOnlyCountsOutages(t *testing.T) {
+	ctx := context.Background()
+	breaker, inner, _, _ := newTestBreaker(t)
+
+	// A store answering no is a store that's up
+	for i := 0; i < 5; i++ {
+		if _, err := breaker.GetAccountByID(ctx, 404); !errors.Is(err, ErrAccountNotFound) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	inner.err = context.Canceled
+	for i := 0; i < 5; i++ {
+		breaker.GetAccountByID(ctx, 404)
+	}
+	if breaker.state != circuitClosed {
+		t.Fatalf("circuit opened on errors that aren't outages: %s", breaker.state)
+	}
+
+	// Timeouts are, a DB that hangs is down too
+	inner.err = context.DeadlineExceeded
+	for i := 0; i < 3; i++ {
+		breaker.GetAccountByID(ctx, 404)
+	}
+	if breaker.state != circuitOpen {
+		t.Fatalf("circuit should be open after timeouts, is %s", breaker.state)
+	}
+}
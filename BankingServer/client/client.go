@@ -0,0 +1,552 @@
+// Package client talks to the banking server's HTTP API, so our services stop
+// writing their own requests to it
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// These mirror the server's types, the server being a main package nobody can import
+
+type Account struct {
+	ID        int       `json:"id"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Number    int64     `json:"number"`
+	Balance   int64     `json:"balance"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// StatementEntry is one movement of money, Amount being negative for money going out
+type StatementEntry struct {
+	ID           int64     `json:"id"`
+	AccountID    int       `json:"accountId"`
+	Type         string    `json:"type"`
+	Amount       int64     `json:"amount"`
+	Balance      int64     `json:"balance"`
+	Counterparty int       `json:"counterparty,omitempty"`
+	OccurredAt   time.Time `json:"occurredAt"`
+}
+
+type Statement struct {
+	AccountID int       `json:"accountId"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	// Nil when nothing happened in the period
+	OpeningBalance *int64           `json:"openingBalance,omitempty"`
+	ClosingBalance *int64           `json:"closingBalance,omitempty"`
+	Credits        int64            `json:"credits"`
+	Debits         int64            `json:"debits"`
+	Entries        []StatementEntry `json:"entries"`
+}
+
+// TOTPSetup is what goes in the authenticator app, it's only ever shown once
+type TOTPSetup struct {
+	// Base32
+	Secret string `json:"secret"`
+	// otpauth://, for a QR code
+	URI string `json:"uri"`
+}
+
+type totpVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+type totpVerifyResponse struct {
+	Token string `json:"token"`
+}
+
+// APIKey is what the server keeps of a key, the key itself it only shows once
+type APIKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	AccountIDs  []int      `json:"accountIds"`
+	Permissions []string   `json:"permissions"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+// The permissions a key can have on its accounts
+const (
+	PermissionRead     = "read"
+	PermissionTransfer = "transfer"
+)
+
+type CreateAPIKeyRequest struct {
+	Name        string   `json:"name"`
+	AccountIDs  []int    `json:"accountIds"`
+	Permissions []string `json:"permissions"`
+	// Nil for the server's default, 90 days
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type createAPIKeyResponse struct {
+	Key    string  `json:"key"`
+	APIKey *APIKey `json:"apiKey"`
+}
+
+type createAccountRequest struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type transferRequest struct {
+	FromAccount int   `json:"fromAccount"`
+	ToAccount   int   `json:"toAccount"`
+	Amount      int64 `json:"amount"`
+}
+
+type depositRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+// ListOptions filters and pages GET /account. The zero value is the first page
+// of everything
+type ListOptions struct {
+	// First or last name prefix
+	Name        string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	MinBalance  *int64
+	MaxBalance  *int64
+	// id, createdAt, balance or lastName, prefixed with - for descending
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+type AccountPage struct {
+	Accounts []Account
+	// How many accounts match, across all pages
+	Total int
+	// Empty on the last page
+	NextCursor string
+}
+
+// The version of the API this client speaks, paths are relative to it
+const apiVersion = "/v1"
+
+const (
+	defaultMaxRetries = 3
+	defaultBackoff    = 200 * time.Millisecond
+	defaultTimeout    = 10 * time.Second
+)
+
+// Client is safe for concurrent use
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+
+	// Set once, by WithAPIKey
+	apiKey string
+
+	mu        sync.RWMutex
+	token     string
+	accountID int
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken authenticates every request with token, as is. Admin tokens, which
+// aren't any account's, go in this way rather than through Login
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey authenticates every request with an API key, for backends with
+// nobody around to log in. It goes instead of any token
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetries is how many times a request is tried again after the first, 0 for never
+func WithRetries(n int) Option {
+	return func(c *Client) { c.maxRetries = n }
+}
+
+// WithBackoff is the wait before the first retry, doubling with each one after.
+// A longer Retry-After from the server wins
+func WithBackoff(d time.Duration) Option {
+	return func(c *Client) { c.backoff = d }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// CreateAccount opens an account and returns its token. Login with it to act as the account
+func (c *Client) CreateAccount(ctx context.Context, firstName, lastName string) (string, error) {
+	var token string
+	_, err := c.do(ctx, http.MethodPost, "/account", nil, createAccountRequest{FirstName: firstName, LastName: lastName}, &token)
+	return token, err
+}
+
+// Login makes the client act as the account token was issued for, once the server
+// has accepted it. The server has no passwords: tokens come from CreateAccount
+func (c *Client) Login(ctx context.Context, token string) (*Account, error) {
+	id, err := tokenSubject(token)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := new(Account)
+	if _, err := c.doAs(ctx, token, http.MethodGet, "/account/"+strconv.Itoa(id), nil, nil, acc); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.token, c.accountID = token, id
+	c.mu.Unlock()
+
+	return acc, nil
+}
+
+// AccountID is the account the client logged in as, 0 before it did
+func (c *Client) AccountID() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.accountID
+}
+
+func (c *Client) GetAccount(ctx context.Context, id int) (*Account, error) {
+	acc := new(Account)
+	if _, err := c.do(ctx, http.MethodGet, "/account/"+strconv.Itoa(id), nil, nil, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (c *Client) ListAccounts(ctx context.Context, opts ListOptions) (*AccountPage, error) {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	set("name", opts.Name)
+	set("sort", opts.Sort)
+	set("cursor", opts.Cursor)
+	if opts.Limit > 0 {
+		set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.CreatedFrom != nil {
+		set("createdFrom", opts.CreatedFrom.Format(time.RFC3339Nano))
+	}
+	if opts.CreatedTo != nil {
+		set("createdTo", opts.CreatedTo.Format(time.RFC3339Nano))
+	}
+	if opts.MinBalance != nil {
+		set("minBalance", strconv.FormatInt(*opts.MinBalance, 10))
+	}
+	if opts.MaxBalance != nil {
+		set("maxBalance", strconv.FormatInt(*opts.MaxBalance, 10))
+	}
+
+	page := new(AccountPage)
+	header, err := c.do(ctx, http.MethodGet, "/account", query, nil, &page.Accounts)
+	if err != nil {
+		return nil, err
+	}
+	page.Total, _ = strconv.Atoi(header.Get("X-Total-Count"))
+	page.NextCursor = header.Get("X-Next-Cursor")
+
+	return page, nil
+}
+
+// DeleteAccount and Transfer take the owner's token stepped up, see StepUp, or an
+// admin token. Transfer also takes an API key allowed to transfer
+func (c *Client) DeleteAccount(ctx context.Context, id int) error {
+	_, err := c.do(ctx, http.MethodDelete, "/account/"+strconv.Itoa(id), nil, nil, nil)
+	return err
+}
+
+func (c *Client) Transfer(ctx context.Context, from, to int, amount int64) error {
+	_, err := c.do(ctx, http.MethodPost, "/transfer", nil, transferRequest{FromAccount: from, ToAccount: to, Amount: amount}, nil)
+	return err
+}
+
+// Deposit takes an admin token
+func (c *Client) Deposit(ctx context.Context, id int, amount int64) error {
+	_, err := c.do(ctx, http.MethodPost, "/account/"+strconv.Itoa(id)+"/deposit", nil, depositRequest{Amount: amount}, nil)
+	return err
+}
+
+// FreezeAccount and UnfreezeAccount take an admin token
+func (c *Client) FreezeAccount(ctx context.Context, id int) (*Account, error) {
+	acc := new(Account)
+	if _, err := c.do(ctx, http.MethodPost, "/account/"+strconv.Itoa(id)+"/freeze", nil, nil, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+func (c *Client) UnfreezeAccount(ctx context.Context, id int) (*Account, error) {
+	acc := new(Account)
+	if _, err := c.do(ctx, http.MethodPost, "/account/"+strconv.Itoa(id)+"/unfreeze", nil, nil, acc); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// GetStatement covers [from, to). Zero times leave it to the server, which
+// defaults to the current month so far
+func (c *Client) GetStatement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.Format(time.RFC3339Nano))
+	}
+
+	statement := new(Statement)
+	if _, err := c.do(ctx, http.MethodGet, "/account/"+strconv.Itoa(id)+"/statement", query, nil, statement); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// EnrollTOTP sets up TOTP for the account, which is what StepUp takes codes from.
+// It takes the owner's token, stepped up once TOTP is confirmed
+func (c *Client) EnrollTOTP(ctx context.Context, id int) (*TOTPSetup, error) {
+	setup := new(TOTPSetup)
+	if _, err := c.do(ctx, http.MethodPost, "/account/"+strconv.Itoa(id)+"/totp", nil, nil, setup); err != nil {
+		return nil, err
+	}
+	return setup, nil
+}
+
+// ResetTOTP takes TOTP off the account, so its owner can enroll again. It takes
+// an admin token
+func (c *Client) ResetTOTP(ctx context.Context, id int) error {
+	_, err := c.do(ctx, http.MethodDelete, "/account/"+strconv.Itoa(id)+"/totp", nil, nil, nil)
+	return err
+}
+
+// StepUp checks a TOTP code for the account the client logged in as, and the
+// client carries on with the stepped up token the server answers with
+func (c *Client) StepUp(ctx context.Context, code string) error {
+	id := c.AccountID()
+	if id == 0 {
+		return errors.New("StepUp takes a client that logged in")
+	}
+
+	var resp totpVerifyResponse
+	if _, err := c.do(ctx, http.MethodPost, "/account/"+strconv.Itoa(id)+"/totp/verify", nil, totpVerifyRequest{Code: code}, &resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.token = resp.Token
+	c.mu.Unlock()
+
+	return nil
+}
+
+// CreateAPIKey, ListAPIKeys and RevokeAPIKey take an admin token. CreateAPIKey
+// returns the key, which the server won't show again, with what it keeps of it
+func (c *Client) CreateAPIKey(ctx context.Context, req CreateAPIKeyRequest) (string, *APIKey, error) {
+	var resp createAPIKeyResponse
+	if _, err := c.do(ctx, http.MethodPost, "/apikey", nil, req, &resp); err != nil {
+		return "", nil, err
+	}
+	return resp.Key, resp.APIKey, nil
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	if _, err := c.do(ctx, http.MethodGet, "/apikey", nil, nil, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	key := new(APIKey)
+	if _, err := c.do(ctx, http.MethodDelete, "/apikey/"+url.PathEscape(id), nil, nil, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey sets the key the POSTs made with ctx are sent with. Without
+// one, each call gets a key of its own, which covers its retries but not a caller
+// that gives up and calls again
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out any) (http.Header, error) {
+	c.mu.RLock()
+	token := c.token
+	c.mu.RUnlock()
+
+	return c.doAs(ctx, token, method, path, query, in, out)
+}
+
+// doAs sends the request, trying again while the answer is one worth waiting out.
+// POSTs are only safe to send twice because they carry the same idempotency key
+// every time
+func (c *Client) doAs(ctx context.Context, token, method, path string, query url.Values, in, out any) (http.Header, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	if method == http.MethodPost && key == "" {
+		key = newIdempotencyKey()
+	}
+
+	target := c.baseURL + apiVersion + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.apiKey != "" {
+			req.Header.Set("X-API-Key", c.apiKey)
+		} else if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if method == http.MethodPost {
+			req.Header.Set("Idempotency-Key", key)
+		}
+
+		header, err := c.send(req, out)
+		if err == nil {
+			return header, nil
+		}
+		if attempt >= c.maxRetries || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		wait := c.backoff << attempt
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) send(req *http.Request, out any) (http.Header, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, newError(resp, data)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("decoding %s %s response: %w", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// retryable is whether trying again might go differently: the request never got
+// an answer, or the answer was "not now"
+func retryable(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		// The same request is still running on the server, the retry gets its answer
+		return true
+	}
+	return false
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// tokenSubject reads the account a token is for. It doesn't check the signature,
+// that's the server's business
+func tokenSubject(token string) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("malformed token: %w", err)
+	}
+	var claims struct {
+		Sub *float64 `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Sub == nil {
+		return 0, errors.New("token has no subject")
+	}
+
+	return int(*claims.Sub), nil
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The real server is exercised from the main package, see sdk_test.go. These are
+// the answers it's hard to get out of it on demand
+
+func TestRetriesKeepTheIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		n := len(keys)
+		mu.Unlock()
+
+		if n < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"ErrorMsg":"service temporarily unavailable"}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"fromAccount":1,"toAccount":2,"amount":5}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL, WithBackoff(time.Millisecond))
+	if err := c.Transfer(context.Background(), 1, 2, 5); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Fatalf("expected 3 attempts with the same key, got %q", keys)
+	}
+
+	// A new call is a new transfer, and gets a key of its own
+	c.Transfer(context.Background(), 1, 2, 5)
+	if keys[3] == keys[0] {
+		t.Fatal("two transfers sent with the same key")
+	}
+	// Unless the caller says it's the same one
+	ctx := WithIdempotencyKey(context.Background(), "order-42")
+	c.Transfer(ctx, 1, 2, 5)
+	if keys[4] != "order-42" {
+		t.Fatalf("caller's key not used, got %q", keys[4])
+	}
+}
+
+func TestErrorsAreDecoded(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		is     error
+		msg    string
+	}{
+		{http.StatusNotFound, `{"ErrorMsg":"account 9 not found"}`, ErrNotFound, "account 9 not found"},
+		{http.StatusForbidden, `{"ErrorMsg":"permission denied"}`, ErrPermissionDenied, "permission denied"},
+		{http.StatusUnprocessableEntity, `{"ErrorMsg":"insufficient funds"}`, ErrInsufficientFunds, "insufficient funds"},
+		{http.StatusInternalServerError, `"Something went wrong on our side"`, nil, "Something went wrong on our side"},
+	}
+
+	for _, tc := range cases {
+		var calls int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		_, err := New(server.URL, WithRetries(2)).GetAccount(context.Background(), 9)
+		server.Close()
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status || apiErr.Message != tc.msg {
+			t.Errorf("%d: unexpected error %v", tc.status, err)
+		}
+		if tc.is != nil && !errors.Is(err, tc.is) {
+			t.Errorf("%d: %v isn't %v", tc.status, err, tc.is)
+		}
+		// None of these get better by asking again
+		if calls != 1 {
+			t.Errorf("%d: tried %d times", tc.status, calls)
+		}
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ErrorMsg":"rate limit exceeded"}`))
+	}))
+	defer server.Close()
+
+	err := New(server.URL, WithRetries(2), WithBackoff(time.Millisecond)).DeleteAccount(context.Background(), 1)
+	if !errors.Is(err, ErrRateLimited) || calls != 3 {
+		t.Fatalf("expected 3 attempts and a rate limit error, got %d and %v", calls, err)
+	}
+}
+
+func TestTokenSubject(t *testing.T) {
+	// {"alg":"HS256","typ":"JWT"} and {"sub":7}, the signature doesn't matter here
+	id, err := tokenSubject("eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOjd9.c2ln")
+	if err != nil || id != 7 {
+		t.Fatalf("got %d, %v", id, err)
+	}
+	if _, err := tokenSubject("not-a-token"); err == nil {
+		t.Fatal("expected a malformed token to be rejected")
+	}
+}
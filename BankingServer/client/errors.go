@@ -0,0 +1,82 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compare with errors.Is, an *Error is each of these for the status it stands for
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrPermissionDenied  = errors.New("permission denied")
+	ErrInvalidRequest    = errors.New("invalid request")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrAccountFrozen     = errors.New("account is frozen")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrUnavailable       = errors.New("service unavailable")
+	// Also ErrPermissionDenied: StepUp and try again
+	ErrStepUpRequired = errors.New("step-up required")
+)
+
+// Error is an answer of 400 or more from the server
+type Error struct {
+	StatusCode int
+	// What the server said, from its apiError body when there was one
+	Message string
+	// How long the server asked us to wait, on 429s and 503s
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("banking API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return target == ErrPermissionDenied ||
+			target == ErrStepUpRequired && strings.Contains(e.Message, "step-up required")
+	case http.StatusBadRequest:
+		return target == ErrInvalidRequest
+	case http.StatusUnprocessableEntity:
+		// Also what a reused idempotency key gets, the message tells them apart
+		return target == ErrInsufficientFunds && strings.Contains(e.Message, "insufficient funds")
+	case http.StatusLocked:
+		return target == ErrAccountFrozen
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	}
+	return false
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	// Errors are apiError bodies, except for the 500s, which are a JSON string
+	var apiErr struct {
+		ErrorMsg string
+	}
+	var msg string
+	switch {
+	case json.Unmarshal(body, &apiErr) == nil && apiErr.ErrorMsg != "":
+		e.Message = apiErr.ErrorMsg
+	case json.Unmarshal(body, &msg) == nil:
+		e.Message = msg
+	default:
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	return e
+}
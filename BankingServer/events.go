@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Domain events are what the rest of the world gets to know about us.
+// They're written to the outbox in the same transaction as the change they describe,
+// so an event exists if and only if the change was committed.
+type EventType string
+
+const (
+	EventAccountCreated    EventType = "AccountCreated"
+	EventAccountDeleted    EventType = "AccountDeleted"
+	EventTransferCompleted EventType = "TransferCompleted"
+	EventDepositCompleted  EventType = "DepositCompleted"
+	// Frozen or unfrozen
+	EventAccountStatusChanged EventType = "AccountStatusChanged"
+)
+
+type Event struct {
+	ID          int64           `json:"id"`
+	Type        EventType       `json:"type"`
+	AggregateID int             `json:"aggregateId"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	// How many delivery attempts have failed so far, it's of no interest to consumers
+	Attempts int `json:"-"`
+}
+
+// The names stay out of events, they're PII and the outbox keeps events as they are
+type AccountCreatedPayload struct {
+	ID     int           `json:"id"`
+	Number int64         `json:"number"`
+	Status AccountStatus `json:"status"`
+}
+
+type AccountDeletedPayload struct {
+	ID int `json:"id"`
+}
+
+type AccountStatusChangedPayload struct {
+	ID     int           `json:"id"`
+	Status AccountStatus `json:"status"`
+}
+
+type TransferCompletedPayload struct {
+	FromAccount int   `json:"fromAccount"`
+	ToAccount   int   `json:"toAccount"`
+	Amount      int64 `json:"amount"`
+	// Balances right after the transfer, so consumers don't have to ask
+	FromBalance int64 `json:"fromBalance"`
+	ToBalance   int64 `json:"toBalance"`
+}
+
+type DepositCompletedPayload struct {
+	AccountID int   `json:"accountId"`
+	Amount    int64 `json:"amount"`
+	Balance   int64 `json:"balance"`
+}
+
+// Where the events end up is none of the store's business, anything that can take
+// an event (or fail to) will do
+type EventPublisher interface {
+	Publish(context.Context, *Event) error
+}
+
+// WebhookPublisher POSTs every event as JSON to a single URL.
+// Delivery is at-least-once, so the receiver should deduplicate on X-Event-ID
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(ev.ID, 10))
+	req.Header.Set("X-Event-Type", string(ev.Type))
+	InjectTraceparent(ctx, req.Header)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered with status %d", p.url, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// WriterPublisher writes one JSON line per event, to stdout or a file.
+// Handy when there's nobody listening yet, or to inspect what would be sent
+type WriterPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// The file is opened in append mode, so restarts don't wipe past events
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterPublisher(f), nil
+}
+
+func (p *WriterPublisher) Publish(_ context.Context, ev *Event) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.w.Write(append(line, '\n'))
+	return err
+}
+
+// MultiPublisher hands every event to all of its publishers.
+// If one fails the whole event is retried, so the others may see it twice
+type MultiPublisher []EventPublisher
+
+func (m MultiPublisher) Publish(ctx context.Context, ev *Event) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Publish(ctx, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Same as with the JWT secret, the destination comes from the env variables
+func newEventPublisher() (EventPublisher, error) {
+	if url := os.Getenv("EVENT_WEBHOOK_URL"); url != "" {
+		return NewWebhookPublisher(url), nil
+	}
+	if path := os.Getenv("EVENT_LOG_FILE"); path != "" {
+		return NewFilePublisher(path)
+	}
+
+	return NewWriterPublisher(os.Stdout), nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/charm-113c/bankingserver/bankpb"
+)
+
+// The gRPC API is for internal services. It's another door into the APIServer:
+// same store, same activity hub, same operations as the REST handlers, see bankpb/banking.proto
+
+// What the interceptors need to know about a method, which the REST API gets from
+// the way its routes are registered
+type grpcMethod struct {
+	timeout time.Duration
+	// Callable without a token
+	public bool
+	// Takes a stepped up token, like the routes behind withStepUp
+	stepUp bool
+}
+
+var grpcMethods = map[string]grpcMethod{
+	bankpb.Banking_CreateAccount_FullMethodName:  {timeout: writeRouteTimeout, public: true},
+	bankpb.Banking_GetAccount_FullMethodName:     {timeout: readRouteTimeout},
+	bankpb.Banking_ListAccounts_FullMethodName:   {timeout: readRouteTimeout, public: true},
+	bankpb.Banking_DeleteAccount_FullMethodName:  {timeout: writeRouteTimeout, stepUp: true},
+	bankpb.Banking_Transfer_FullMethodName:       {timeout: writeRouteTimeout, stepUp: true},
+	bankpb.Banking_Deposit_FullMethodName:        {timeout: writeRouteTimeout},
+	bankpb.Banking_StreamActivity_FullMethodName: {timeout: noRouteTimeout},
+}
+
+func newGRPCServer(api *APIServer) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(api.unaryInterceptor),
+		grpc.ChainStreamInterceptor(api.streamInterceptor),
+	)
+	bankpb.RegisterBankingServer(server, &bankingService{api: api})
+
+	return server
+}
+
+func (s *APIServer) RunGRPC(listenAddr string) {
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		s.logger.Error("gRPC server could not listen", "err", err)
+		return
+	}
+
+	if err := newGRPCServer(s).Serve(lis); err != nil {
+		s.logger.Error("gRPC server stopped", "err", err)
+	}
+}
+
+// unaryInterceptor is httpHandlerDecorator and the middlewares rolled into one:
+// request ID and logging, tracing, auth, timeout, and turning errors into statuses
+func (s *APIServer) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	method := grpcMethods[info.FullMethod]
+	ctx, done := s.startRPC(ctx, info.FullMethod)
+
+	var resp any
+	ctx, err := s.authenticate(ctx, method)
+	if err == nil {
+		if method.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, method.timeout)
+			defer cancel()
+		}
+		resp, err = handler(ctx, req)
+	}
+
+	err = grpcStatus(ctx, err)
+	done(err)
+	return resp, err
+}
+
+func (s *APIServer) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	method := grpcMethods[info.FullMethod]
+	ctx, done := s.startRPC(ss.Context(), info.FullMethod)
+
+	ctx, err := s.authenticate(ctx, method)
+	if err == nil {
+		err = handler(srv, &grpcStream{ServerStream: ss, ctx: ctx})
+	}
+
+	err = grpcStatus(ctx, err)
+	done(err)
+	return err
+}
+
+// grpcStream is how a stream handler gets the context the interceptor worked on
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (st *grpcStream) Context() context.Context {
+	return st.ctx
+}
+
+// startRPC does for a call what withRequestLogging and withTracing do for a request.
+// done logs the call's line and finishes its span
+func (s *APIServer) startRPC(ctx context.Context, fullMethod string) (context.Context, func(error)) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := firstMetadata(md, "x-request-id")
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+
+	info := &requestInfo{ID: id, Route: fullMethod, Logger: s.logger.With("request_id", id)}
+	ctx = context.WithValue(ctx, requestInfoKey{}, info)
+
+	var span *Span
+	if s.tracer != nil {
+		if sc, ok := parseTraceparent(firstMetadata(md, traceparentHeader)); ok {
+			ctx = withRemoteSpanContext(ctx, sc)
+		}
+		ctx, span = s.tracer.Start(ctx, "gRPC "+fullMethod)
+		span.SetAttr("rpc.system", "grpc")
+		span.SetAttr("rpc.method", fullMethod)
+		span.SetAttr("rpc.request.id", id)
+		info.Logger = info.Logger.With("trace_id", span.TraceID.String())
+	}
+
+	return ctx, func(err error) {
+		code := status.Code(err)
+		attrs := []any{
+			"rpc", fullMethod,
+			"code", code.String(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if info.HasSubject {
+			attrs = append(attrs, "subject", info.Subject)
+		}
+		info.Logger.Info("rpc", attrs...)
+
+		if span != nil {
+			span.SetAttr("rpc.grpc.status_code", int(code))
+			if code == codes.Internal || code == codes.Unavailable || code == codes.DeadlineExceeded {
+				span.RecordError(err)
+			}
+			span.Finish()
+		}
+	}
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// authenticate checks the API key in the "x-api-key" metadata, or else the token in
+// "authorization", when there is one, and tells the services who's calling. Only
+// public methods do without
+func (s *APIServer) authenticate(ctx context.Context, method grpcMethod) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if raw := firstMetadata(md, "x-api-key"); raw != "" {
+		key, err := s.apiKeys.Authenticate(ctx, raw)
+		if errors.Is(err, ErrInvalidAPIKey) {
+			requestLogger(ctx).Info("permission denied", "err", err)
+			return ctx, status.Error(codes.Unauthenticated, "invalid API key")
+		}
+		if err != nil {
+			return ctx, err
+		}
+		// Keys never step up, see apikeys.go
+		return WithCaller(WithReadSession(ctx, "key:"+key.ID), Caller{APIKey: key}), nil
+	}
+
+	tokenString := firstMetadata(md, "authorization")
+	if tokenString == "" {
+		if method.public {
+			return ctx, nil
+		}
+		return ctx, status.Error(codes.Unauthenticated, "missing token")
+	}
+
+	token, err := validateJWT(tokenString)
+	if err != nil || !token.Valid {
+		requestLogger(ctx).Info("permission denied", "err", err)
+		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	caller := callerFromToken(token)
+	session := "token:admin"
+	if caller.AccountID != 0 {
+		info := requestInfoFrom(ctx)
+		info.Subject, info.HasSubject = caller.AccountID, true
+		session = fmt.Sprintf("account:%d", caller.AccountID)
+	}
+
+	ctx = WithCaller(WithReadSession(ctx, session), caller)
+	if method.stepUp {
+		if err := s.totp.RequireStepUp(ctx); err != nil {
+			return ctx, err
+		}
+	}
+
+	return ctx, nil
+}
+
+// grpcStatus is the switch of httpHandlerDecorator, with status codes for answers
+func grpcStatus(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	logger := requestLogger(ctx)
+	var invalid *invalidRequestError
+	switch {
+	case errors.As(err, &invalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrPermissionDenied):
+		logger.Info("permission denied", "err", err)
+		return status.Error(codes.PermissionDenied, "permission denied")
+	case errors.Is(err, ErrStepUpRequired):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrAccountNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrAccountFrozen) || errors.Is(err, ErrInsufficientFunds):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logger.Warn("handler timed out", "err", err)
+		return status.Error(codes.DeadlineExceeded, "request timed out")
+	case errors.Is(ctx.Err(), context.Canceled):
+		logger.Info("handler cancelled", "err", err)
+		return status.Error(codes.Canceled, "request cancelled")
+	case isStoreUnavailable(err):
+		logger.Error("storage unavailable", "err", err)
+		return status.Error(codes.Unavailable, "service temporarily unavailable")
+	}
+
+	logger.Error("handler failed", "err", err)
+	return status.Error(codes.Internal, "something went wrong on our side")
+}
+
+type bankingService struct {
+	bankpb.UnimplementedBankingServer
+	api *APIServer
+}
+
+func (b *bankingService) CreateAccount(ctx context.Context, req *bankpb.CreateAccountRequest) (*bankpb.CreateAccountResponse, error) {
+	account, token, err := b.api.accounts.Open(ctx, req.FirstName, req.LastName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bankpb.CreateAccountResponse{Account: accountToProto(account), Token: token}, nil
+}
+
+func (b *bankingService) GetAccount(ctx context.Context, req *bankpb.GetAccountRequest) (*bankpb.Account, error) {
+	account, err := b.api.accounts.Get(ctx, int(req.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	return accountToProto(account), nil
+}
+
+func (b *bankingService) ListAccounts(ctx context.Context, req *bankpb.ListAccountsRequest) (*bankpb.ListAccountsResponse, error) {
+	// Made back into the query string GET /account would get, so both are checked the same way
+	values := url.Values{}
+	setValue := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	setValue("name", req.Name)
+	setValue("sort", req.Sort)
+	setValue("cursor", req.Cursor)
+	if req.Limit != 0 {
+		values.Set("limit", strconv.Itoa(int(req.Limit)))
+	}
+	if req.CreatedFrom != nil {
+		values.Set("createdFrom", req.CreatedFrom.AsTime().Format(time.RFC3339Nano))
+	}
+	if req.CreatedTo != nil {
+		values.Set("createdTo", req.CreatedTo.AsTime().Format(time.RFC3339Nano))
+	}
+	if req.MinBalance != nil {
+		values.Set("minBalance", strconv.FormatInt(*req.MinBalance, 10))
+	}
+	if req.MaxBalance != nil {
+		values.Set("maxBalance", strconv.FormatInt(*req.MaxBalance, 10))
+	}
+
+	query, err := ParseAccountQuery(values)
+	if err != nil {
+		return nil, invalidRequest(err.Error())
+	}
+	page, err := b.api.accounts.List(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &bankpb.ListAccountsResponse{Total: int64(page.Total), NextCursor: page.NextCursor}
+	for _, account := range page.Accounts {
+		resp.Accounts = append(resp.Accounts, accountToProto(account))
+	}
+	return resp, nil
+}
+
+func (b *bankingService) DeleteAccount(ctx context.Context, req *bankpb.DeleteAccountRequest) (*bankpb.DeleteAccountResponse, error) {
+	if err := b.api.accounts.Close(ctx, int(req.Id)); err != nil {
+		return nil, err
+	}
+
+	return &bankpb.DeleteAccountResponse{}, nil
+}
+
+func (b *bankingService) Transfer(ctx context.Context, req *bankpb.TransferRequest) (*bankpb.TransferResponse, error) {
+	if err := b.api.transfers.Transfer(ctx, int(req.FromAccount), int(req.ToAccount), req.Amount); err != nil {
+		return nil, err
+	}
+
+	return &bankpb.TransferResponse{}, nil
+}
+
+func (b *bankingService) Deposit(ctx context.Context, req *bankpb.DepositRequest) (*bankpb.DepositResponse, error) {
+	if err := b.api.transfers.Deposit(ctx, int(req.AccountId), req.Amount); err != nil {
+		return nil, err
+	}
+
+	return &bankpb.DepositResponse{}, nil
+}
+
+// StreamActivity is handleAccountEvents without the SSE framing. gRPC has its own
+// keepalives, so no heartbeats either
+func (b *bankingService) StreamActivity(req *bankpb.StreamActivityRequest, stream bankpb.Banking_StreamActivityServer) error {
+	// Not a service of its own, the hub is already the one place streams come from
+	ctx := stream.Context()
+	if err := authorizeAccountFor(ctx, int(req.AccountId), APIKeyRead); err != nil {
+		return err
+	}
+	if b.api.activity == nil {
+		return status.Error(codes.Unimplemented, "activity streams are off")
+	}
+
+	sub := b.api.activity.Subscribe(int(req.AccountId), req.LastEventId)
+	defer b.api.activity.Unsubscribe(sub)
+
+	// Headers out means subscribed, nothing published from here on is missed
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	if sub.resync {
+		if err := stream.Send(&bankpb.StreamActivityResponse{Update: &bankpb.StreamActivityResponse_Resync{Resync: true}}); err != nil {
+			return err
+		}
+	}
+	for _, ev := range sub.replay {
+		if err := stream.Send(activityToProto(ev)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// Too slow, or the hub stopped. Either way the client resumes from its last event
+				return status.Error(codes.Aborted, "stream dropped, resume from the last event")
+			}
+			if err := stream.Send(activityToProto(ev)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func accountToProto(acc *Account) *bankpb.Account {
+	return &bankpb.Account{
+		Id:        int64(acc.ID),
+		FirstName: acc.FirstName,
+		LastName:  acc.LastName,
+		Number:    acc.AccNumber,
+		Balance:   acc.Balance,
+		Status:    string(acc.Status),
+		CreatedAt: timestamppb.New(acc.CreatedAt),
+	}
+}
+
+func activityToProto(ev *ActivityEvent) *bankpb.StreamActivityResponse {
+	return &bankpb.StreamActivityResponse{Update: &bankpb.StreamActivityResponse_Event{Event: &bankpb.ActivityEvent{
+		Id:           ev.ID,
+		AccountId:    int64(ev.AccountID),
+		Type:         ev.Type,
+		Amount:       ev.Amount,
+		Balance:      ev.Balance,
+		Counterparty: int64(ev.Counterparty),
+		OccurredAt:   timestamppb.New(ev.OccurredAt),
+	}}}
+}
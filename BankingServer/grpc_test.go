@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/charm-113c/bankingserver/bankpb"
+)
+
+// newGRPCTestClient serves the gRPC API in memory, over a bufconn listener
+func newGRPCTestClient(t *testing.T, store *MemoryStore, hub *ActivityHub) bankpb.BankingClient {
+	t.Helper()
+	t.Setenv("JWT_TOKEN", "test-secret")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	lis := bufconn.Listen(1 << 20)
+	server := newGRPCServer(newAPIServer("", store, nil, store, store, store, hub, logger, nil))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return bankpb.NewBankingClient(conn)
+}
+
+func withToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func TestGRPCAccountsAndTransfers(t *testing.T) {
+	ctx := context.Background()
+	c := newGRPCTestClient(t, NewMemoryStore(), nil)
+
+	ada, err := c.CreateAccount(ctx, &bankpb.CreateAccountRequest{FirstName: "Ada", LastName: "Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alan, _ := c.CreateAccount(ctx, &bankpb.CreateAccountRequest{FirstName: "Alan", LastName: "Turing"})
+	if ada.Account.Id != 1 || ada.Account.Status != string(AccountActive) || ada.Token == "" {
+		t.Fatalf("unexpected account %+v", ada)
+	}
+	adaCtx := withToken(ctx, ada.Token)
+
+	// The token has to be there, and be the account's
+	if _, err := c.GetAccount(ctx, &bankpb.GetAccountRequest{Id: 1}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated, got %v", err)
+	}
+	if _, err := c.GetAccount(withToken(ctx, "nonsense"), &bankpb.GetAccountRequest{Id: 1}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated, got %v", err)
+	}
+	if _, err := c.GetAccount(adaCtx, &bankpb.GetAccountRequest{Id: 2}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	// Only admins deposit
+	if _, err := c.Deposit(adaCtx, &bankpb.DepositRequest{AccountId: 1, Amount: 100}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	adminToken, _ := createAdminJWT("ops", time.Hour)
+	if _, err := c.Deposit(withToken(ctx, adminToken), &bankpb.DepositRequest{AccountId: 1, Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// Nor does a token that wasn't stepped up move money
+	if _, err := c.Transfer(adaCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 40}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	adaCtx = withToken(ctx, steppedUp(1))
+	if _, err := c.Transfer(adaCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 40}); err != nil {
+		t.Fatal(err)
+	}
+	// Same checks as the REST API, since it's the same code
+	if _, err := c.Transfer(adaCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 1000}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if _, err := c.Transfer(adaCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 1, Amount: 10}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+	// Only the sender's token moves the sender's money
+	alanCtx := withToken(ctx, steppedUp(int(alan.Account.Id)))
+	if _, err := c.Transfer(alanCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 10}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	got, err := c.GetAccount(adaCtx, &bankpb.GetAccountRequest{Id: 1})
+	if err != nil || got.Balance != 60 || got.FirstName != "Ada" {
+		t.Fatalf("expected 60 left, got %+v, %v", got, err)
+	}
+
+	page, err := c.ListAccounts(ctx, &bankpb.ListAccountsRequest{Sort: "-balance", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Accounts) != 1 || page.Accounts[0].Id != 1 || page.NextCursor == "" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	if _, err := c.ListAccounts(ctx, &bankpb.ListAccountsRequest{Sort: "password"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+
+	if _, err := c.DeleteAccount(alanCtx, &bankpb.DeleteAccountRequest{Id: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetAccount(alanCtx, &bankpb.GetAccountRequest{Id: 2}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestGRPCStreamActivity(t *testing.T) {
+	hub := NewActivityHub()
+	hub.Start()
+	defer hub.Stop()
+	store := NewMemoryStore()
+	c := newGRPCTestClient(t, store, hub)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ada, _ := c.CreateAccount(ctx, &bankpb.CreateAccountRequest{FirstName: "Ada", LastName: "Lovelace"})
+	c.CreateAccount(ctx, &bankpb.CreateAccountRequest{FirstName: "Alan", LastName: "Turing"})
+	adaCtx := withToken(ctx, steppedUp(int(ada.Account.Id)))
+
+	stream, err := c.StreamActivity(adaCtx, &bankpb.StreamActivityRequest{AccountId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The subscription is only there once the server has the call, which the
+	// response headers say
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken, _ := createAdminJWT("ops", time.Hour)
+	c.Deposit(withToken(ctx, adminToken), &bankpb.DepositRequest{AccountId: 1, Amount: 100})
+	c.Transfer(adaCtx, &bankpb.TransferRequest{FromAccount: 1, ToAccount: 2, Amount: 30})
+	NewOutboxRelay(store, hub, slog.Default()).relayBatch(ctx)
+
+	for _, want := range []struct {
+		typ     string
+		amount  int64
+		balance int64
+	}{
+		{ActivityDepositReceived, 100, 100},
+		{ActivityTransferSent, -30, 70},
+	} {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := resp.GetEvent()
+		if ev.GetType() != want.typ || ev.Amount != want.amount || ev.Balance != want.balance {
+			t.Fatalf("expected %+v, got %+v", want, ev)
+		}
+	}
+
+	other, err := c.StreamActivity(adaCtx, &bankpb.StreamActivityRequest{AccountId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected someone else's stream to be denied, got %v", err)
+	}
+}
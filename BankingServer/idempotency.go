@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A client that never got an answer to a POST can't tell whether it went through.
+// Sending the request again with the same Idempotency-Key gets it the answer to the
+// first one, rather than a second transfer
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen   = 255
+	// How long an answer is kept around for a retry to find
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+// IdempotentResponse is the answer given to the first request with a key
+type IdempotentResponse struct {
+	// A hash of the request, so a key reused for a different one is caught
+	Fingerprint string
+	// False while the first request is still running
+	Done        bool
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyBackend is where the answers are kept. Like the rate limiter's, memory
+// is fine for one server, several need to share
+type IdempotencyBackend interface {
+	// Begin claims key for a request. When someone already did, it returns what they recorded
+	Begin(ctx context.Context, key, fingerprint string) (*IdempotentResponse, error)
+	// Finish records the answer to the request that claimed key
+	Finish(ctx context.Context, key string, res *IdempotentResponse) error
+	// Release gives key up, for answers that are worth trying again
+	Release(ctx context.Context, key string) error
+}
+
+type Idempotency struct {
+	backend IdempotencyBackend
+}
+
+func NewIdempotency(backend IdempotencyBackend) *Idempotency {
+	return &Idempotency{backend: backend}
+}
+
+// Middleware is meant for router.Use. Only POSTs need it, the rest of the API is
+// idempotent already
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: fmt.Sprintf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen)})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, apiError{ErrorMsg: "could not read request body"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		// Keys are the client's, so two clients picking the same one mustn't collide
+		owner := "ip:" + clientIP(r)
+		if sub, ok := tokenSubject(r); ok {
+			owner = fmt.Sprintf("sub:%d", sub)
+		}
+		// Partners behind one NAT would share an address
+		if apiKey := callerFrom(r.Context()).APIKey; apiKey != nil {
+			owner = "key:" + apiKey.ID
+		}
+		scoped := route + "|" + owner + "|" + key
+
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		existing, err := i.backend.Begin(r.Context(), scoped, fingerprint)
+		if err != nil {
+			// Same as the rate limiter, this being down is no reason for the API to be
+			requestLogger(r.Context()).Warn("idempotency backend unavailable, handling the request anyway", "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch {
+		case existing == nil:
+			// We're first
+		case existing.Fingerprint != fingerprint:
+			WriteJSON(w, http.StatusUnprocessableEntity, apiError{ErrorMsg: idempotencyKeyHeader + " was already used for a different request"})
+			return
+		case !existing.Done:
+			w.Header().Set("Retry-After", "1")
+			WriteJSON(w, http.StatusConflict, apiError{ErrorMsg: "a request with this " + idempotencyKeyHeader + " is still in progress"})
+			return
+		default:
+			if existing.ContentType != "" {
+				w.Header().Set("Content-Type", existing.ContentType)
+			}
+			w.Header().Set(idempotentReplayHeader, "true")
+			w.WriteHeader(existing.Status)
+			w.Write(existing.Body)
+			return
+		}
+
+		rec := &capturingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Nothing happened on a 5xx or a 429, or at least nothing the client should be
+		// stuck with, so the retry gets another go. Nor on a 403, and the retry may
+		// well come with a better token, stepped up say
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests || rec.status == http.StatusForbidden {
+			err = i.backend.Release(context.WithoutCancel(r.Context()), scoped)
+		} else {
+			err = i.backend.Finish(context.WithoutCancel(r.Context()), scoped, &IdempotentResponse{
+				Fingerprint: fingerprint,
+				Done:        true,
+				Status:      rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+		}
+		if err != nil {
+			requestLogger(r.Context()).Error("could not record idempotent response", "key", key, "status", rec.status, "err", err)
+		}
+	})
+}
+
+// capturingWriter keeps a copy of the response it passes on
+type capturingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (cw *capturingWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *capturingWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *capturingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// MemoryIdempotencyBackend keeps the answers in this process
+type MemoryIdempotencyBackend struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	ttl       time.Duration
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	res     IdempotentResponse
+	expires time.Time
+}
+
+func NewMemoryIdempotencyBackend(ttl time.Duration) *MemoryIdempotencyBackend {
+	return &MemoryIdempotencyBackend{
+		entries:   make(map[string]*idempotencyEntry),
+		ttl:       ttl,
+		now:       time.Now,
+		lastSweep: time.Now(),
+	}
+}
+
+func (b *MemoryIdempotencyBackend) Begin(ctx context.Context, key, fingerprint string) (*IdempotentResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Sub(b.lastSweep) >= rateLimitSweepInterval {
+		b.sweep(now)
+	}
+
+	if entry, ok := b.entries[key]; ok && now.Before(entry.expires) {
+		res := entry.res
+		return &res, nil
+	}
+	b.entries[key] = &idempotencyEntry{
+		res:     IdempotentResponse{Fingerprint: fingerprint},
+		expires: now.Add(b.ttl),
+	}
+	return nil, nil
+}
+
+func (b *MemoryIdempotencyBackend) Finish(ctx context.Context, key string, res *IdempotentResponse) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[key] = &idempotencyEntry{res: *res, expires: b.now().Add(b.ttl)}
+	return nil
+}
+
+func (b *MemoryIdempotencyBackend) Release(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries, key)
+	return nil
+}
+
+func (b *MemoryIdempotencyBackend) sweep(now time.Time) {
+	for key, entry := range b.entries {
+		if !now.Before(entry.expires) {
+			delete(b.entries, key)
+		}
+	}
+	b.lastSweep = now
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	ctx := context.Background()
+	store := NewMemoryStore()
+	from, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	to, _ := store.CreateAccount(ctx, NewAccount("Alan", "Turing"))
+	store.Deposit(ctx, from, 100)
+	router := newAPIServer("", store, nil, nil, store, store, nil, slog.Default(), nil).routes()
+	token := steppedUp(from)
+
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/transfer", strings.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, key)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"fromAccount":1,"toAccount":2,"amount":30}`
+
+	first := send("abc", body)
+	again := send("abc", body)
+	if first.Code != http.StatusAccepted || again.Code != http.StatusAccepted || again.Body.String() != first.Body.String() {
+		t.Fatalf("expected the same answer twice, got %d %q and %d %q", first.Code, first.Body, again.Code, again.Body)
+	}
+	if again.Header().Get(idempotentReplayHeader) != "true" || first.Header().Get(idempotentReplayHeader) != "" {
+		t.Fatal("replay not marked as one")
+	}
+	if acc, _ := store.GetAccountByID(ctx, to); acc.Balance != 30 {
+		t.Fatalf("expected one transfer, got a balance of %d", acc.Balance)
+	}
+
+	if rec := send("abc", `{"fromAccount":1,"toAccount":2,"amount":31}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a reused key to be refused, got %d", rec.Code)
+	}
+	// Without a key, a POST sent twice happens twice
+	send("", body)
+	send("", body)
+	if acc, _ := store.GetAccountByID(ctx, to); acc.Balance != 90 {
+		t.Fatalf("expected two more transfers, got a balance of %d", acc.Balance)
+	}
+}
+
+func TestMemoryIdempotencyBackend(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	b := NewMemoryIdempotencyBackend(time.Hour)
+	b.now = func() time.Time { return now }
+
+	if res, _ := b.Begin(ctx, "k", "f"); res != nil {
+		t.Fatal("first request found something recorded")
+	}
+	// Still running
+	if res, _ := b.Begin(ctx, "k", "f"); res == nil || res.Done {
+		t.Fatalf("expected an unfinished entry, got %+v", res)
+	}
+
+	b.Finish(ctx, "k", &IdempotentResponse{Fingerprint: "f", Done: true, Status: http.StatusAccepted})
+	if res, _ := b.Begin(ctx, "k", "f"); res == nil || !res.Done || res.Status != http.StatusAccepted {
+		t.Fatalf("expected the recorded answer, got %+v", res)
+	}
+
+	b.Release(ctx, "k")
+	if res, _ := b.Begin(ctx, "k", "f"); res != nil {
+		t.Fatal("released key still taken")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if res, _ := b.Begin(ctx, "k", "f"); res != nil {
+		t.Fatal("expired key still taken")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// With JWT_KEYS_DIR set, tokens are signed with asymmetric keys, one PEM file per
+// key named <kid>.pem: RSA keys sign RS256, Ed25519 keys EdDSA. Private keys can
+// sign, public ones only verify, which is what a retired key is left as until the
+// tokens it signed have expired: accountTokenTTL after it stopped signing, unless an
+// admin token was given a longer -ttl. JWT_SIGNING_KID picks the key that signs, and
+// can be left out when there's only one private key.
+//
+// Rotating is: add the new key (bankctl keys generate), wait for it to be in
+// everyone's copy of /.well-known/jwks.json, point JWT_SIGNING_KID at it, and
+// swap the old one for its public half. The directory is read again every
+// jwtKeysReloadInterval, so none of that takes a restart.
+//
+// Tokens without a kid are from before, HS256 with JWT_TOKEN. They're accepted for
+// as long as JWT_TOKEN is set, and JWT_TOKEN still signs when there's no key set
+
+const jwtKeysReloadInterval = time.Minute
+
+type jwtKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// *rsa.PrivateKey or ed25519.PrivateKey, nil for a key that only verifies
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+type jwtKeySet struct {
+	keys map[string]*jwtKey
+	// nil when every key is a public one
+	signing *jwtKey
+}
+
+var jwtKeyCache struct {
+	sync.Mutex
+	config   string
+	set      *jwtKeySet
+	loadedAt time.Time
+}
+
+// currentJWTKeys is the key set the env describes, nil when there's none and
+// tokens are HS256
+func currentJWTKeys() (*jwtKeySet, error) {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	signingKID := os.Getenv("JWT_SIGNING_KID")
+	config := dir + "|" + signingKID
+
+	jwtKeyCache.Lock()
+	defer jwtKeyCache.Unlock()
+	if jwtKeyCache.config == config && time.Since(jwtKeyCache.loadedAt) < jwtKeysReloadInterval {
+		return jwtKeyCache.set, nil
+	}
+
+	set, err := loadJWTKeySet(dir, signingKID)
+	if err != nil {
+		// A bad edit to the directory shouldn't take every token down with it
+		if jwtKeyCache.config == config {
+			slog.Warn("could not reload the JWT keys, keeping the ones already loaded", "dir", dir, "err", err)
+			jwtKeyCache.loadedAt = time.Now()
+			return jwtKeyCache.set, nil
+		}
+		return nil, err
+	}
+
+	jwtKeyCache.config, jwtKeyCache.set, jwtKeyCache.loadedAt = config, set, time.Now()
+	return set, nil
+}
+
+func loadJWTKeySet(dir, signingKID string) (*jwtKeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	set := &jwtKeySet{keys: map[string]*jwtKey{}}
+	var private []*jwtKey
+	for _, file := range files {
+		key, err := readJWTKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		set.keys[key.kid] = key
+		if key.private != nil {
+			private = append(private, key)
+		}
+	}
+
+	switch {
+	case signingKID != "":
+		set.signing = set.keys[signingKID]
+		if set.signing == nil || set.signing.private == nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KID %q isn't a private key in %s", signingKID, dir)
+		}
+	case len(private) == 1:
+		set.signing = private[0]
+	case len(private) > 1:
+		return nil, fmt.Errorf("%s has %d private keys, JWT_SIGNING_KID has to say which one signs", dir, len(private))
+	}
+
+	return set, nil
+}
+
+func readJWTKey(file string) (*jwtKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not PEM")
+	}
+
+	key := &jwtKey{kid: strings.TrimSuffix(filepath.Base(file), ".pem")}
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public, key.method = k, &k.PublicKey, jwt.SigningMethodRS256
+	case *rsa.PublicKey:
+		key.public, key.method = k, jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		key.private, key.public, key.method = k, k.Public(), jwt.SigningMethodEdDSA
+	case ed25519.PublicKey:
+		key.public, key.method = k, jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, it's RSA or Ed25519", parsed)
+	}
+	if rsaKey, ok := key.public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys are 2048 bits at least")
+	}
+
+	return key, nil
+}
+
+// signJWT signs with the key set's signing key, or JWT_TOKEN when there's no key set
+func signJWT(claims jwt.Claims) (string, error) {
+	keys, err := currentJWTKeys()
+	if err != nil {
+		return "", err
+	}
+	if keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(os.Getenv("JWT_TOKEN")))
+	}
+	if keys.signing == nil {
+		return "", errors.New("there's no private key in JWT_KEYS_DIR to sign with")
+	}
+
+	token := jwt.NewWithClaims(keys.signing.method, claims)
+	token.Header["kid"] = keys.signing.kid
+	return token.SignedString(keys.signing.private)
+}
+
+// jwtKeyFunc finds what checks the token's signature. The algorithm has to be the
+// key's own, or an RSA public key, which is public, could pass for an HMAC secret
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		secret := os.Getenv("JWT_TOKEN")
+		if secret == "" {
+			return nil, errors.New("token has no kid, and there's no JWT_TOKEN to check it with")
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(secret), nil
+	}
+
+	keys, err := currentJWTKeys()
+	if err != nil {
+		return nil, err
+	}
+	var key *jwtKey
+	if keys != nil {
+		key = keys.keys[kid]
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+
+	return key.public, nil
+}
+
+// generateJWTKey writes a new private key to dir, named after its kid, which is
+// the date and some randomness so keys sort in the order they were made
+func generateJWTKey(dir, alg string) (string, error) {
+	var private any
+	var err error
+	switch alg {
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return "", fmt.Errorf("unknown algorithm %q, it's EdDSA or RS256", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(suffix)
+
+	file, err := os.OpenFile(filepath.Join(dir, kid+".pem"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return kid, pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// jwk is a public key as RFC 7517 has it
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// handleJWKS publishes the public half of every key, so other services can check
+// our tokens without being able to make them. Empty while tokens are HS256
+func handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	keys, err := currentJWTKeys()
+	if err != nil {
+		return err
+	}
+
+	set := jwkSet{Keys: []jwk{}}
+	if keys != nil {
+		for _, key := range keys.keys {
+			set.Keys = append(set.Keys, publicJWK(key))
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	// Verifiers cache it, which is why a new key goes out before it signs anything
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwtKeysReloadInterval.Seconds())))
+	return WriteJSON(w, http.StatusOK, set)
+}
+
+func publicJWK(key *jwtKey) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	out := jwk{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		out.Kty, out.N, out.E = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		out.Kty, out.Crv, out.X = "OKP", "Ed25519", b64(pub)
+	}
+
+	return out
+}
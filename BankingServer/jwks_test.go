@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// reloadJWTKeys makes the next token read the directory again, as it would once
+// jwtKeysReloadInterval is up
+func reloadJWTKeys() {
+	jwtKeyCache.Lock()
+	jwtKeyCache.loadedAt = time.Time{}
+	jwtKeyCache.Unlock()
+}
+
+func tokenKID(t *testing.T, tokenString string) string {
+	t.Helper()
+	token, err := validateJWT(tokenString)
+	if err != nil || !token.Valid {
+		t.Fatalf("token refused: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("JWT_TOKEN", "")
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_SIGNING_KID", "")
+	acc := NewAccount("Ada", "Lovelace")
+
+	old, err := generateJWTKey(dir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := createJWT(acc, 1)
+	if kid := tokenKID(t, oldToken); kid != old {
+		t.Fatalf("expected the token signed by %s, got %q", old, kid)
+	}
+
+	// A new key is published before it signs anything
+	next, _ := generateJWTKey(dir, "EdDSA")
+	reloadJWTKeys()
+	// Two private keys and no JWT_SIGNING_KID don't load, the keys already loaded stay
+	if _, err := loadJWTKeySet(dir, ""); err == nil {
+		t.Fatal("expected two private keys and no JWT_SIGNING_KID to be refused")
+	}
+	if token, _ := createJWT(acc, 1); tokenKID(t, token) != old {
+		t.Fatal("expected the old key to keep signing")
+	}
+	t.Setenv("JWT_SIGNING_KID", next)
+	newToken, _ := createJWT(acc, 1)
+	if kid := tokenKID(t, newToken); kid != next {
+		t.Fatalf("expected the token signed by %s, got %q", next, kid)
+	}
+	tokenKID(t, oldToken)
+
+	// Retired, the old key only verifies, and once it's gone its tokens are too
+	key, _ := readJWTKey(filepath.Join(dir, old+".pem"))
+	der, _ := x509.MarshalPKIXPublicKey(key.public)
+	os.WriteFile(filepath.Join(dir, old+".pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	reloadJWTKeys()
+	tokenKID(t, oldToken)
+	os.Remove(filepath.Join(dir, old+".pem"))
+	reloadJWTKeys()
+	if _, err := validateJWT(oldToken); err == nil {
+		t.Fatal("expected a token from a removed key to be refused")
+	}
+	tokenKID(t, newToken)
+}
+
+func TestJWTKeyConfusion(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("JWT_TOKEN", "test-secret")
+	t.Setenv("JWT_SIGNING_KID", "")
+	legacy, _ := createJWT(NewAccount("Ada", "Lovelace"), 1)
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	kid, _ := generateJWTKey(dir, "RS256")
+	reloadJWTKeys()
+
+	// The public key is no secret, so it can't pass for an HMAC one
+	key, _ := readJWTKey(filepath.Join(dir, kid+".pem"))
+	der, _ := x509.MarshalPKIXPublicKey(key.public)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"admin": true})
+	forged.Header["kid"] = kid
+	forgedString, _ := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if _, err := validateJWT(forgedString); err == nil {
+		t.Fatal("expected an HS256 token under an RSA kid to be refused")
+	}
+
+	// Tokens from before the key set last as long as JWT_TOKEN does
+	tokenKID(t, legacy)
+	t.Setenv("JWT_TOKEN", "")
+	if _, err := validateJWT(legacy); err == nil {
+		t.Fatal("expected a token without a kid to be refused")
+	}
+}
+
+// Or a retired key's tokens would be good for as long as it's kept
+func TestAccountTokensExpire(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	t.Setenv("JWT_KEYS_DIR", "")
+	tokenString, _ := createJWT(NewAccount("Ada", "Lovelace"), 1)
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil || time.Until(exp.Time) > accountTokenTTL {
+		t.Fatalf("unexpected expiry %v, %v", exp, err)
+	}
+
+	expired, _ := signJWT(jwt.MapClaims{"sub": 1, "exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := validateJWT(expired); err == nil {
+		t.Fatal("expected an expired token to be refused")
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_SIGNING_KID", "")
+	generateJWTKey(dir, "EdDSA")
+	reloadJWTKeys()
+	token, _ := createAdminJWT("ops", time.Hour)
+
+	rec := httptest.NewRecorder()
+	router := newAPIServer("", nil, nil, nil, nil, nil, nil, slog.Default(), nil).routes()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var set struct {
+		Keys []map[string]string
+	}
+	json.Unmarshal(rec.Body.Bytes(), &set)
+	if len(set.Keys) != 1 || set.Keys[0]["kty"] != "OKP" || set.Keys[0]["d"] != "" {
+		t.Fatalf("unexpected key set %v", set)
+	}
+
+	// Which is all another service needs to check our tokens
+	x, _ := base64.RawURLEncoding.DecodeString(set.Keys[0]["x"])
+	parsed, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return ed25519.PublicKey(x), nil },
+		jwt.WithValidMethods([]string{"EdDSA"}))
+	if err != nil || !isAdminToken(parsed) {
+		t.Fatalf("token didn't check out with the published key: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newLogger writes JSON lines, at the level LOG_LEVEL asks for (debug, info, warn
+// or error), info by default
+func newLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q", s)
+		}
+	}
+
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})), nil
+}
+
+// requestInfo is what we know about a request, filled in as it goes down the middlewares
+// and read back once it's done. It's shared by pointer, so what the router learns
+// reaches the access log sitting outside of it
+type requestInfo struct {
+	ID     string
+	Route  string
+	Logger *slog.Logger
+	// Set when the request carries a valid token
+	Subject    int
+	HasSubject bool
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestLogger is the logger for whatever request ctx belongs to, tagged with its ID.
+// Outside of a request, it's the default logger
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.Logger
+	}
+	return slog.Default()
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// IDs from clients are kept when they look like IDs, so a request can be followed
+// from whoever sent it. Anything else could be used to forge log lines
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestLogging gives every request an ID, and logs one line about it once
+// it's been answered. It goes around the router, so even requests no route
+// matched get an ID and a line
+func withRequestLogging(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{ID: id, Logger: logger.With("request_id", id)}
+		info.Subject, info.HasSubject = tokenSubject(r)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		attrs := []any{
+			"method", r.Method,
+			"route", info.Route,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", rec.bytes,
+			"remote_ip", clientIP(r),
+		}
+		if info.HasSubject {
+			attrs = append(attrs, "subject", info.Subject)
+		}
+		info.Logger.Info("request", attrs...)
+	})
+}
+
+// withRouteInfo runs inside the router, which is the only place that knows the route
+func withRouteInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := requestInfoFrom(r.Context()); info != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.Route, _ = route.GetPathTemplate()
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseRecorder notes down the status and size of a response on its way out
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush keeps the event streams working through the recorder
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func newLoggedRouter(buf *bytes.Buffer) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/account/{id}", func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}).Methods("GET")
+	router.Use(withRouteInfo)
+
+	return withRequestLogging(slog.New(slog.NewJSONHandler(buf, nil)), router)
+}
+
+// logLines splits what the logger wrote into one map per line
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("not a JSON line: %s", line)
+		}
+		lines = append(lines, m)
+	}
+
+	return lines
+}
+
+func TestRequestLogging(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	token, err := createJWT(NewAccount("Ada", "Lovelace"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	req := httptest.NewRequest(http.MethodGet, "/account/7", nil)
+	req.Header.Set("Authorization", token)
+	rec := httptest.NewRecorder()
+	newLoggedRouter(buf).ServeHTTP(rec, req)
+
+	id := rec.Header().Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Fatalf("expected a generated request ID, got %q", id)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("expected the handler's line and the request's, got %d", len(lines))
+	}
+	// Everything logged during the request carries its ID
+	for _, line := range lines {
+		if line["request_id"] != id {
+			t.Fatalf("line without the request ID: %v", line)
+		}
+	}
+
+	access := lines[1]
+	if access["msg"] != "request" || access["method"] != "GET" || access["route"] != "/account/{id}" ||
+		access["status"] != float64(http.StatusCreated) || access["bytes"] != float64(5) || access["subject"] != float64(7) {
+		t.Fatalf("unexpected request line %v", access)
+	}
+	if _, ok := access["latency_ms"]; !ok {
+		t.Fatal("request line has no latency")
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	send := func(id string) (string, map[string]any) {
+		buf := new(bytes.Buffer)
+		req := httptest.NewRequest(http.MethodGet, "/nowhere", nil)
+		req.Header.Set(requestIDHeader, id)
+		rec := httptest.NewRecorder()
+		newLoggedRouter(buf).ServeHTTP(rec, req)
+		return rec.Header().Get(requestIDHeader), logLines(t, buf)[0]
+	}
+
+	// Unmatched requests are still logged, with the client's ID when it's a sane one
+	got, line := send("client-abc.123")
+	if got != "client-abc.123" || line["request_id"] != got || line["status"] != float64(http.StatusNotFound) {
+		t.Fatalf("client's request ID not kept: %q %v", got, line)
+	}
+
+	got, _ = send("evil\"}\n{\"forged\":true")
+	if strings.ContainsAny(got, "\"\n{") || got == "" {
+		t.Fatalf("unsafe request ID accepted: %q", got)
+	}
+}
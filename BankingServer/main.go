@@ -1,24 +1,176 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// Everything main needs from a backend, which Postgres and SQLite both are
+type serverStore interface {
+	Storage
+	OutboxStore
+	WebhookStore
+	StatementStore
+	TOTPStore
+	APIKeyStore
+	Init(context.Context) error
+}
+
+// The backend is picked from the env variables, Postgres unless told otherwise
+func newStore(logger *slog.Logger) (serverStore, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "postgres":
+		cfg, err := PostgresConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresStore(cfg, logger)
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "bankingserver.db"
+		}
+		return NewSQLiteStore(path, logger)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// The API goes through a circuit breaker, tuned by CIRCUIT_THRESHOLD and CIRCUIT_COOLDOWN,
+// and reads through a cache, sized and timed by CACHE_SIZE and CACHE_TTL.
+// CACHE_SIZE=0 turns the cache off
+func newAPIStore(store Storage, logger *slog.Logger) (Storage, error) {
+	threshold, err := envInt("CIRCUIT_THRESHOLD", defaultCircuitThreshold)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := envDuration("CIRCUIT_COOLDOWN", defaultCircuitCooldown)
+	if err != nil {
+		return nil, err
+	}
+	size, err := envInt("CACHE_SIZE", defaultCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := envDuration("CACHE_TTL", defaultCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cache goes in front, so cached accounts are still there while the breaker is open
+	store = NewCircuitBreakerStore(store, max(threshold, 1), cooldown, logger)
+	if size > 0 {
+		store = NewCachedStore(store, size, ttl)
+	}
+
+	return store, nil
+}
+
+// envInt and envDuration read an env variable, def when it's not set. Negatives are never valid
+func envInt(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return n, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return d, nil
+}
+
+func grpcAddr() string {
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		return addr
+	}
+	return ":3001"
+}
+
 func main() {
-	log.Println("Shall we dance?")
+	// The same binary is the admin tool, see bankctl.go
+	if filepath.Base(os.Args[0]) == "bankctl" {
+		os.Exit(runBankctl(os.Args[1:], os.Stdout, os.Stderr, openBankctlBackend))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bankctl" {
+		os.Exit(runBankctl(os.Args[2:], os.Stdout, os.Stderr, openBankctlBackend))
+	}
 
-	store, err := NewPostgresStore()
+	logger, err := newLogger(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Whatever still logs through the log package comes out as JSON too
+	slog.SetDefault(logger)
+
+	logger.Info("Shall we dance?")
+
+	// Keys that don't load would otherwise only show as every token being refused
+	if _, err := currentJWTKeys(); err != nil {
+		log.Fatal("Could not load the JWT keys:", err)
+	}
+
+	store, err := newStore(logger)
 	if err != nil {
 		log.Fatal("Error connecting to DB:", err)
 	}
 
-	if err = store.Init(); err != nil {
+	if err = store.Init(context.Background()); err != nil {
 		log.Fatal("Could not initialize DB:", err)
 	}
 
-	server := newAPIServer(":3000", store)
+	publisher, err := newEventPublisher()
+	if err != nil {
+		log.Fatal("Could not set up event publisher:", err)
+	}
+	activity := NewActivityHub()
+	activity.Start()
+
+	// Owner webhooks and the activity streams are just more consumers of our events
+	relay := NewOutboxRelay(store, MultiPublisher{publisher, NewWebhookFanout(store), activity}, logger)
+	relay.Start()
+
+	dispatcher := NewWebhookDispatcher(store, logger)
+	dispatcher.Start()
+
+	// Moves accounts onto the current PII key, and seals the names from before
+	if pg, ok := store.(*PostgresStore); ok && pg.EncryptsPII() {
+		NewPIIRotator(pg, logger).Start()
+	}
+
+	// Everything that writes goes through the API, so that's the only place needing the cache
+	apiStore, err := newAPIStore(store, logger)
+	if err != nil {
+		log.Fatal("Could not set up the API's store:", err)
+	}
+
+	tracer, err := newTracer()
+	if err != nil {
+		log.Fatal("Could not set up tracing:", err)
+	}
+
+	server := newAPIServer(":3000", apiStore, store, store, store, store, activity, logger, tracer)
 
 	go server.Run()
+	// Internal services talk gRPC, GRPC_ADDR sets where
+	go server.RunGRPC(grpcAddr())
 
 	select {}
 }
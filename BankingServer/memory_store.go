@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps, for tests and for running without a DB.
+// Transactions are simply run one at a time under a lock, which is as isolated as
+// it gets, so whatever level is asked for is honoured. A failed transaction puts
+// back the copy of the state taken when it started.
+type MemoryStore struct {
+	mu    *sync.Mutex
+	state *memoryState
+	// Set on the Storage handed to a WithTx callback, which already holds the lock
+	inTx bool
+}
+
+type memoryState struct {
+	accounts  map[int]*Account
+	nextID    int
+	outbox    []*Event
+	nextEvent int64
+	// Published events, which statements are read from
+	published []*Event
+	// When failed events may be tried again
+	retryAt map[int64]time.Time
+	totp    map[int]*TOTPEnrollment
+	apiKeys map[string]*APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu: new(sync.Mutex),
+		state: &memoryState{
+			accounts:  make(map[int]*Account),
+			nextID:    1,
+			nextEvent: 1,
+			retryAt:   make(map[int64]time.Time),
+			totp:      make(map[int]*TOTPEnrollment),
+			apiKeys:   make(map[string]*APIKey),
+		},
+	}
+}
+
+// read runs fn with the state locked. Reads change nothing, so there's nothing to roll back
+func (st *MemoryStore) read(ctx context.Context, fn func(*MemoryStore) error) error {
+	if st.inTx {
+		return fn(st)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return fn(st)
+}
+
+// do runs fn with the state locked, as its own transaction unless we're already in one
+func (st *MemoryStore) do(ctx context.Context, fn func(*MemoryStore) error) error {
+	if st.inTx {
+		return fn(st)
+	}
+	return st.WithTx(ctx, func(s Storage) error { return fn(s.(*MemoryStore)) })
+}
+
+func (st *MemoryStore) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	if st.inTx {
+		return fn(st)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	snapshot := st.state.clone()
+	if err := fn(&MemoryStore{mu: st.mu, state: st.state, inTx: true}); err != nil {
+		*st.state = *snapshot
+		return err
+	}
+
+	return nil
+}
+
+func (s *memoryState) clone() *memoryState {
+	c := &memoryState{
+		accounts:  make(map[int]*Account, len(s.accounts)),
+		nextID:    s.nextID,
+		outbox:    make([]*Event, len(s.outbox)),
+		nextEvent: s.nextEvent,
+		// Published events never change, the copy can share them
+		published: append([]*Event(nil), s.published...),
+		retryAt:   make(map[int64]time.Time, len(s.retryAt)),
+		totp:      make(map[int]*TOTPEnrollment, len(s.totp)),
+		apiKeys:   make(map[string]*APIKey, len(s.apiKeys)),
+	}
+	for id, at := range s.retryAt {
+		c.retryAt[id] = at
+	}
+	for id, acc := range s.accounts {
+		copied := *acc
+		c.accounts[id] = &copied
+	}
+	for id, e := range s.totp {
+		copied := *e
+		c.totp[id] = &copied
+	}
+	for id, key := range s.apiKeys {
+		c.apiKeys[id] = copyAPIKey(key)
+	}
+	for i, ev := range s.outbox {
+		copied := *ev
+		c.outbox[i] = &copied
+	}
+
+	return c
+}
+
+func (s *memoryState) addEvent(eventType EventType, aggregateID int, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.outbox = append(s.outbox, &Event{
+		ID:          s.nextEvent,
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Payload:     body,
+		CreatedAt:   time.Now().UTC(),
+	})
+	s.nextEvent++
+	return nil
+}
+
+func (st *MemoryStore) CreateAccount(ctx context.Context, acc *Account) (int, error) {
+	id := -1
+	err := st.do(ctx, func(tx *MemoryStore) error {
+		for _, existing := range tx.state.accounts {
+			if existing.AccNumber == acc.AccNumber {
+				return ErrDuplicateAccountNumber
+			}
+		}
+
+		created := *acc
+		created.ID = tx.state.nextID
+		if created.Status == "" {
+			created.Status = AccountActive
+		}
+		tx.state.accounts[created.ID] = &created
+		tx.state.nextID++
+		id = created.ID
+
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+func (st *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	var acc *Account
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		found, ok := tx.state.accounts[id]
+		if !ok {
+			return accountNotFound(id)
+		}
+		// Callers get their own copy, like they would from a DB
+		copied := *found
+		acc = &copied
+		return nil
+	})
+
+	return acc, err
+}
+
+func (st *MemoryStore) GetAccounts(ctx context.Context, q *AccountQuery) (*AccountPage, error) {
+	page := new(AccountPage)
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		var after *Account
+		if q.Cursor != nil {
+			v, err := cursorValue(q.Cursor, q.Sort)
+			if err != nil {
+				return err
+			}
+			after = accountAtCursor(q.Cursor.ID, v, q.Sort)
+		}
+
+		var matches []*Account
+		for _, acc := range tx.state.accounts {
+			if !matchesAccountQuery(acc, q) {
+				continue
+			}
+			page.Total++
+			if after != nil && !accountLess(after, acc, q.Sort) {
+				continue
+			}
+			copied := *acc
+			matches = append(matches, &copied)
+		}
+
+		sort.Slice(matches, func(i, j int) bool { return accountLess(matches[i], matches[j], q.Sort) })
+		if len(matches) > q.Limit {
+			matches = matches[:q.Limit]
+			page.NextCursor = encodeCursor(cursorFor(matches[q.Limit-1], q.Sort))
+		}
+		page.Accounts = matches
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (st *MemoryStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		existing, ok := tx.state.accounts[acc.ID]
+		if !ok {
+			return accountNotFound(acc.ID)
+		}
+		existing.FirstName = acc.FirstName
+		existing.LastName = acc.LastName
+		return nil
+	})
+}
+
+func (st *MemoryStore) DeleteAccount(ctx context.Context, id int) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		if _, ok := tx.state.accounts[id]; !ok {
+			return nil
+		}
+		delete(tx.state.accounts, id)
+		delete(tx.state.totp, id)
+		return nil
+	})
+}
+
+func (st *MemoryStore) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		from, ok := tx.state.accounts[fromID]
+		if !ok {
+			return accountNotFound(fromID)
+		}
+		if from.Status == AccountFrozen {
+			return accountFrozen(fromID)
+		}
+		if from.Balance < amount {
+			return ErrInsufficientFunds
+		}
+		to, ok := tx.state.accounts[toID]
+		if !ok {
+			return accountNotFound(toID)
+		}
+		if to.Status == AccountFrozen {
+			return accountFrozen(toID)
+		}
+
+		from.Balance -= amount
+		to.Balance += amount
+		return nil
+	})
+}
+
+func (st *MemoryStore) Deposit(ctx context.Context, id int, amount int64) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		acc, ok := tx.state.accounts[id]
+		if !ok {
+			return accountNotFound(id)
+		}
+		if acc.Status == AccountFrozen {
+			return accountFrozen(id)
+		}
+		acc.Balance += amount
+		return nil
+	})
+}
+
+func (st *MemoryStore) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		acc, ok := tx.state.accounts[id]
+		if !ok {
+			return accountNotFound(id)
+		}
+		acc.Status = status
+		return nil
+	})
+}
+
+func (st *MemoryStore) RecordEvent(ctx context.Context, eventType EventType, aggregateID int, payload any) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		return tx.state.addEvent(eventType, aggregateID, payload)
+	})
+}
+
+// The outbox side, so the relay works the same on top of memory
+
+func (st *MemoryStore) FetchPendingEvents(ctx context.Context, limit int) ([]*Event, error) {
+	var events []*Event
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		now := time.Now()
+		for _, ev := range tx.state.outbox {
+			if len(events) == limit {
+				break
+			}
+			if tx.state.retryAt[ev.ID].After(now) {
+				continue
+			}
+			copied := *ev
+			events = append(events, &copied)
+		}
+		return nil
+	})
+
+	return events, err
+}
+
+// Published events leave the outbox for the history, like the SQL stores keep them
+func (st *MemoryStore) MarkEventPublished(ctx context.Context, id int64) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		for i, ev := range tx.state.outbox {
+			if ev.ID == id {
+				tx.state.published = append(tx.state.published, ev)
+				tx.state.outbox = append(tx.state.outbox[:i], tx.state.outbox[i+1:]...)
+				delete(tx.state.retryAt, id)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (st *MemoryStore) MarkEventFailed(ctx context.Context, id int64, attempts int, nextAttemptAt time.Time) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		for _, ev := range tx.state.outbox {
+			if ev.ID == id {
+				ev.Attempts = attempts
+				tx.state.retryAt[id] = nextAttemptAt
+			}
+		}
+		return nil
+	})
+}
+
+// What the SQL filters do, done by hand
+
+func matchesAccountQuery(acc *Account, q *AccountQuery) bool {
+	if q.Name != "" {
+		name := strings.ToLower(q.Name)
+		if !strings.HasPrefix(strings.ToLower(acc.FirstName), name) && !strings.HasPrefix(strings.ToLower(acc.LastName), name) {
+			return false
+		}
+	}
+	if q.CreatedFrom != nil && acc.CreatedAt.Before(*q.CreatedFrom) {
+		return false
+	}
+	if q.CreatedTo != nil && !acc.CreatedAt.Before(*q.CreatedTo) {
+		return false
+	}
+	if q.MinBalance != nil && acc.Balance < *q.MinBalance {
+		return false
+	}
+	if q.MaxBalance != nil && acc.Balance > *q.MaxBalance {
+		return false
+	}
+
+	return true
+}
+
+// accountLess orders by the sort field, then by ID, same as the SQL ORDER BY
+func accountLess(a, b *Account, s AccountSort) bool {
+	cmp := 0
+	switch s.Field {
+	case "createdAt":
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	case "balance":
+		cmp = compareInt64(a.Balance, b.Balance)
+	case "lastName":
+		cmp = strings.Compare(a.LastName, b.LastName)
+	}
+	if cmp == 0 {
+		cmp = compareInt64(int64(a.ID), int64(b.ID))
+	}
+
+	if s.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// accountAtCursor builds a stand-in for the row the cursor points at, to compare against
+func accountAtCursor(id int, v any, s AccountSort) *Account {
+	acc := &Account{ID: id}
+	switch s.Field {
+	case "createdAt":
+		acc.CreatedAt = v.(time.Time)
+	case "balance":
+		acc.Balance = v.(int64)
+	case "lastName":
+		acc.LastName = v.(string)
+	}
+
+	return acc
+}
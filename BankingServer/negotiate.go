@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Responses come in whichever format the request's Accept header asks for, out of
+// the ones there are: JSON, which is also what asking for nothing in particular
+// gets, MessagePack, and CSV for lists. Errors are always JSON
+
+type responseFormat struct {
+	mediaType string
+	// Other names clients know it by
+	aliases     []string
+	contentType string
+	encode      func(w io.Writer, v any) error
+}
+
+var (
+	jsonFormat = responseFormat{
+		mediaType:   "application/json",
+		contentType: "application/json",
+		encode:      func(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) },
+	}
+	msgpackFormat = responseFormat{
+		mediaType:   "application/msgpack",
+		aliases:     []string{"application/x-msgpack", "application/vnd.msgpack"},
+		contentType: "application/msgpack",
+		encode:      encodeMsgpack,
+	}
+	csvFormat = responseFormat{
+		mediaType:   "text/csv",
+		contentType: "text/csv; charset=utf-8",
+		encode:      encodeCSV,
+	}
+)
+
+// writeResponse is WriteJSON for the answers that aren't errors, in the format the
+// request accepts. A request that accepts none of them gets a 406, unless it
+// already changed something: refusing to say how that went wouldn't undo it, so
+// it gets JSON
+func writeResponse(w http.ResponseWriter, r *http.Request, statusCode int, v any) error {
+	offers := []responseFormat{jsonFormat, msgpackFormat}
+	if _, ok := csvRows(v); ok {
+		offers = []responseFormat{jsonFormat, csvFormat, msgpackFormat}
+	}
+	w.Header().Add("Vary", "Accept")
+
+	format, ok := negotiate(r.Header.Get("Accept"), offers)
+	if !ok {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			format = jsonFormat
+		} else {
+			var types []string
+			for _, offer := range offers {
+				types = append(types, offer.mediaType)
+			}
+			return WriteJSON(w, http.StatusNotAcceptable, apiError{ErrorMsg: "Not acceptable, this is only available as " + strings.Join(types, ", ")})
+		}
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.WriteHeader(statusCode)
+
+	return format.encode(w, v)
+}
+
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			// A q that doesn't parse is as good as no q at all
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+
+	return ranges
+}
+
+// negotiate picks the offer the Accept header likes best, the first of them on a
+// tie. Each offer goes by the most specific range that matches it, so
+// "*/*, text/csv;q=0" is anything but CSV
+func negotiate(accept string, offers []responseFormat) (responseFormat, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+	ranges := parseAccept(accept)
+
+	var best responseFormat
+	bestQ := 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, rng := range ranges {
+			s := matchSpecificity(rng.mediaType, offer)
+			if s > specificity {
+				q, specificity = rng.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, bestQ > 0
+}
+
+// matchSpecificity is how closely a media range matches the offer: 2 for its
+// name, 1 for type/*, 0 for */*, and -1 when it doesn't
+func matchSpecificity(mediaType string, offer responseFormat) int {
+	if mediaType == offer.mediaType {
+		return 2
+	}
+	for _, alias := range offer.aliases {
+		if mediaType == alias {
+			return 2
+		}
+	}
+	if mediaType == "*/*" {
+		return 0
+	}
+	typ, _, _ := strings.Cut(offer.mediaType, "/")
+	if mediaType == typ+"/*" {
+		return 1
+	}
+	return -1
+}
+
+func encodeMsgpack(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	// The same field names as the JSON
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	return enc.Encode(v)
+}
+
+// csvTable is for what isn't a list, but has one worth a CSV in it
+type csvTable interface {
+	csvRows() any
+}
+
+// csvRows is v as a slice of structs, if it is one, which is what CSV is offered for
+func csvRows(v any) (reflect.Value, bool) {
+	if table, ok := v.(csvTable); ok {
+		v = table.csvRows()
+	}
+
+	rows := reflect.ValueOf(v)
+	if rows.Kind() != reflect.Slice {
+		return rows, false
+	}
+	elem := rows.Type().Elem()
+	if elem.Kind() == reflect.Pointer {
+		elem = elem.Elem()
+	}
+	return rows, elem.Kind() == reflect.Struct
+}
+
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// encodeCSV writes a row per item, with a column per field, named as in the JSON
+func encodeCSV(w io.Writer, v any) error {
+	rows, ok := csvRows(v)
+	if !ok {
+		return fmt.Errorf("%T has no CSV form", v)
+	}
+	elem := rows.Type().Elem()
+	if elem.Kind() == reflect.Pointer {
+		elem = elem.Elem()
+	}
+
+	var columns []csvColumn
+	var header []string
+	for i := 0; i < elem.NumField(); i++ {
+		field := elem.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+		header = append(header, name)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		if row.Kind() == reflect.Pointer {
+			if row.IsNil() {
+				continue
+			}
+			row = row.Elem()
+		}
+
+		record := make([]string, len(columns))
+		for j, col := range columns {
+			record[j] = csvValue(row.Field(col.index))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case json.RawMessage:
+		return string(value)
+	}
+	if v.Kind() == reflect.String {
+		return csvSafe(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// csvSafe keeps spreadsheets from taking text someone typed in, a name say, for a
+// formula. Numbers never go through here, so negative amounts stay numbers
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
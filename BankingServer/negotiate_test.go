@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []responseFormat{jsonFormat, csvFormat, msgpackFormat}
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/csv", "text/csv"},
+		{"text/*", "text/csv"},
+		{"application/x-msgpack", "application/msgpack"},
+		{"application/json;q=0.5, application/msgpack", "application/msgpack"},
+		// The most specific range wins, whatever comes first
+		{"*/*, application/json;q=0", "text/csv"},
+		{"text/html", ""},
+	}
+	for _, c := range cases {
+		format, ok := negotiate(c.accept, offers)
+		if got := format.mediaType; !ok && c.want != "" || ok && got != c.want {
+			t.Errorf("Accept %q: expected %q, got %q (%v)", c.accept, c.want, got, ok)
+		}
+	}
+}
+
+func TestResponseFormats(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	store.CreateAccount(ctx, NewAccount("=cmd", "Turing"))
+	router := newAPIServer("", store, nil, nil, store, store, nil, slog.Default(), nil).routes()
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/account?sort=id", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("text/csv")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != "id,firstName,lastName,number,balance,status,createdAt" {
+		t.Fatalf("unexpected CSV %v", records)
+	}
+	// Whatever someone calls themselves, it's no formula
+	if records[1][1] != "Ada" || records[2][1] != "'=cmd" {
+		t.Fatalf("unexpected rows %v", records[1:])
+	}
+
+	rec = get("application/msgpack")
+	var accounts []map[string]any
+	if err := msgpack.Unmarshal(rec.Body.Bytes(), &accounts); err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[0]["firstName"] != "Ada" || rec.Header().Get("Content-Type") != "application/msgpack" {
+		t.Fatalf("unexpected accounts %v", accounts)
+	}
+
+	if rec := get("text/html"); rec.Code != http.StatusNotAcceptable {
+		t.Fatalf("expected 406, got %d", rec.Code)
+	}
+
+	// Too late to refuse once the account's open
+	req := httptest.NewRequest(http.MethodPost, "/v1/account", strings.NewReader(`{"firstName":"Grace","lastName":"Hopper"}`))
+	req.Header.Set("Accept", "text/csv")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestUnversionedRoutesAreDeprecated(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(context.Background(), NewAccount("Ada", "Lovelace"))
+	router := newAPIServer("", store, nil, nil, store, store, nil, slog.Default(), nil).routes()
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/account")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Total-Count") != "1" {
+		t.Fatalf("unexpected response %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") == "" || rec.Header().Get("Sunset") == "" ||
+		rec.Header().Get("Link") != `</v1/account>; rel="successor-version"` {
+		t.Fatalf("not marked deprecated: %v", rec.Header())
+	}
+
+	// The current version isn't, and isn't served twice over
+	if rec := serve(http.MethodGet, "/v1/account"); rec.Code != http.StatusOK || rec.Header().Get("Deprecation") != "" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+	if rec := serve(http.MethodGet, "/v1/v1/account"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/nothing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+
+	// Past the sunset, it's gone
+	gone := unversionedAPI
+	gone.sunset = gone.since
+	rec = httptest.NewRecorder()
+	withDeprecation(gone, router).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/account", nil))
+	if rec.Code != http.StatusGone {
+		t.Fatalf("expected 410, got %d", rec.Code)
+	}
+}
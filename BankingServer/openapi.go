@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The OpenAPI document is put together from the router itself, so it lists exactly
+// the routes there are, and its schemas come from the Go types the handlers read
+// and write. What can't be read off the code (summaries, responses, which routes
+// want a token) is in apiOperations, which has to have an entry for every route:
+// TestOpenAPICoversEveryRoute fails otherwise
+
+type apiOperation struct {
+	Summary string
+	// The route wants a token for the account in its path, or an admin token
+	Auth bool
+	// The route only takes admin tokens
+	Admin bool
+	// An API key with this permission on the account does instead of a token
+	APIKey APIKeyPermission
+	Query  []apiParam
+	// A value of the type the body is decoded into, nil when there's no body
+	Request   any
+	Responses map[int]apiResponse
+}
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+type apiResponse struct {
+	Description string
+	// A value of the type written back, nil when there's no body worth describing
+	Body        any
+	ContentType string
+	Headers     map[string]string
+}
+
+// The answers every route may give, on top of its own
+var commonResponses = map[int]apiResponse{
+	http.StatusTooManyRequests:     {Description: "Rate limit exceeded, see Retry-After", Body: apiError{}},
+	http.StatusInternalServerError: {Description: "Something went wrong on our side", Body: ""},
+	http.StatusServiceUnavailable:  {Description: "Storage unavailable, see Retry-After", Body: apiError{}},
+	http.StatusGatewayTimeout:      {Description: "The request timed out", Body: apiError{}},
+}
+
+var authResponses = map[int]apiResponse{
+	http.StatusForbidden: {Description: "Missing token, or a token for another account", Body: apiError{}},
+}
+
+var adminResponses = map[int]apiResponse{
+	http.StatusForbidden: {Description: "Missing token, or not an admin token", Body: apiError{}},
+}
+
+var negotiationResponses = map[int]apiResponse{
+	http.StatusNotAcceptable: {Description: "None of the formats in Accept is available", Body: apiError{}},
+}
+
+// What the routes behind withStepUp answer without a recent enough step-up
+var stepUpResponse = apiResponse{
+	Description: "Missing token, a token for another account, or a token that wasn't stepped up with POST /v1/account/{id}/totp/verify in the last " + stepUpMaxAge.String(),
+	Body:        apiError{},
+}
+
+var idempotencyResponses = map[int]apiResponse{
+	http.StatusConflict:            {Description: "A request with the same Idempotency-Key is still in progress, see Retry-After", Body: apiError{}},
+	http.StatusUnprocessableEntity: {Description: "The Idempotency-Key was already used for a different request", Body: apiError{}},
+}
+
+// Keyed by method and route template, the same way the rate limits are
+var apiOperations = map[string]apiOperation{
+	"GET /v1/account": {
+		Summary: "List accounts, a page at a time",
+		Query: []apiParam{
+			{Name: "name", Type: "string", Description: "First or last name prefix, case-insensitive. The whole name where names are encrypted at rest"},
+			{Name: "createdFrom", Type: "date-time", Description: "Created at or after"},
+			{Name: "createdTo", Type: "date-time", Description: "Created before"},
+			{Name: "minBalance", Type: "integer"},
+			{Name: "maxBalance", Type: "integer"},
+			{Name: "sort", Type: "string", Description: "id, createdAt, balance or lastName, prefixed with - for descending. Not lastName where names are encrypted at rest"},
+			{Name: "limit", Type: "integer", Description: fmt.Sprintf("Page size, %d by default and %d at most", defaultAccountPageSize, maxAccountPageSize)},
+			{Name: "cursor", Type: "string", Description: "X-Next-Cursor of the previous page"},
+		},
+		Responses: map[int]apiResponse{
+			http.StatusOK: {
+				Description: "A page of accounts",
+				Body:        []Account{},
+				Headers: map[string]string{
+					"X-Total-Count": "Number of accounts matching the filters",
+					"X-Next-Cursor": "Cursor of the next page, absent on the last one",
+				},
+			},
+			http.StatusBadRequest: {Description: "Invalid query", Body: apiError{}},
+		},
+	},
+	"POST /v1/account": {
+		Summary: "Open an account",
+		Request: CreateAccountRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusCreated:    {Description: "The new account's token", Body: ""},
+			http.StatusBadRequest: {Description: "Missing names", Body: apiError{}},
+		},
+	},
+	"GET /v1/account/{id}": {
+		Summary: "Get an account",
+		Auth:    true,
+		APIKey:  APIKeyRead,
+		Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The account", Body: Account{}},
+			http.StatusNotFound: {Description: "No such account", Body: apiError{}},
+		},
+	},
+	"DELETE /v1/account/{id}": {
+		Summary: "Close an account",
+		Auth:    true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:        {Description: "Account deleted, or there was none", Body: ""},
+			http.StatusForbidden: stepUpResponse,
+		},
+	},
+	"POST /v1/transfer": {
+		Summary: "Move money between accounts, with the sender's token",
+		Auth:    true,
+		APIKey:  APIKeyTransfer,
+		Request: TransferRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusAccepted:            {Description: "Transfer done", Body: TransferRequest{}},
+			http.StatusBadRequest:          {Description: "Invalid amount or accounts", Body: apiError{}},
+			http.StatusNotFound:            {Description: "No such account", Body: apiError{}},
+			http.StatusUnprocessableEntity: {Description: "Insufficient funds", Body: apiError{}},
+			http.StatusLocked:              {Description: "One of the accounts is frozen", Body: apiError{}},
+			http.StatusForbidden:           stepUpResponse,
+		},
+	},
+	"GET /v1/account/{id}/events": {
+		Summary: "Stream the account's activity as Server-Sent Events",
+		Auth:    true,
+		APIKey:  APIKeyRead,
+		Responses: map[int]apiResponse{
+			http.StatusOK: {
+				Description: "A stream of ActivityEvent, resumable with Last-Event-ID. A resync event first means events may have been missed, and the account should be fetched again",
+				Body:        ActivityEvent{},
+				ContentType: "text/event-stream",
+			},
+		},
+	},
+	"POST /v1/account/{id}/deposit": {
+		Summary: "Deposit money, with an admin token",
+		Auth:    true,
+		Request: DepositRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusAccepted:   {Description: "Deposit done", Body: DepositRequest{}},
+			http.StatusForbidden:  {Description: "Not an admin token", Body: apiError{}},
+			http.StatusBadRequest: {Description: "Invalid amount", Body: apiError{}},
+			http.StatusNotFound:   {Description: "No such account", Body: apiError{}},
+			http.StatusLocked:     {Description: "The account is frozen", Body: apiError{}},
+		},
+	},
+	"POST /v1/account/{id}/webhooks": {
+		Summary: "Register a webhook",
+		Auth:    true,
+		Request: CreateWebhookRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusCreated:    {Description: "The webhook, with its signing secret. The secret is never shown again", Body: Webhook{}},
+			http.StatusBadRequest: {Description: "Invalid URL: not https, or not a public address", Body: apiError{}},
+		},
+	},
+	"GET /v1/account/{id}/webhooks": {
+		Summary: "List the account's webhooks",
+		Auth:    true,
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "The webhooks, without their secrets", Body: []Webhook{}},
+		},
+	},
+	"GET /v1/account/{id}/webhooks/deliveries": {
+		Summary: "List recent webhook deliveries",
+		Auth:    true,
+		Query: []apiParam{
+			{Name: "limit", Type: "integer", Description: "Between 1 and 500, 50 by default"},
+		},
+		Responses: map[int]apiResponse{
+			http.StatusOK:         {Description: "The deliveries, newest first", Body: []WebhookDelivery{}},
+			http.StatusBadRequest: {Description: "Invalid limit", Body: apiError{}},
+		},
+	},
+	"DELETE /v1/account/{id}/webhooks/{webhookID}": {
+		Summary: "Remove a webhook",
+		Auth:    true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:         {Description: "Webhook deleted", Body: ""},
+			http.StatusBadRequest: {Description: "Invalid webhook ID", Body: apiError{}},
+			http.StatusNotFound:   {Description: "No such webhook", Body: apiError{}},
+		},
+	},
+	"POST /v1/account/{id}/totp": {
+		Summary: "Set up TOTP, the second factor transfers and closing the account take. With the owner's token, stepped up once TOTP is confirmed",
+		Auth:    true,
+		Responses: map[int]apiResponse{
+			http.StatusCreated:   {Description: "The secret, and the otpauth:// URI to show as a QR code. Neither is shown again", Body: TOTPSetup{}},
+			http.StatusForbidden: {Description: "Not the owner's token, or TOTP is confirmed and the token wasn't stepped up in the last " + stepUpMaxAge.String(), Body: apiError{}},
+		},
+	},
+	"DELETE /v1/account/{id}/totp": {
+		Summary: "Take TOTP off an account whose owner lost the authenticator, who then enrolls again",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "TOTP reset, or there was none", Body: ""},
+		},
+	},
+	"POST /v1/account/{id}/totp/verify": {
+		Summary: "Check a TOTP code, confirming the setup the first time, and step the token up",
+		Auth:    true,
+		Request: TOTPVerifyRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusOK:         {Description: fmt.Sprintf("The account's token, stepped up for %s", stepUpMaxAge), Body: TOTPVerifyResponse{}},
+			http.StatusBadRequest: {Description: "Wrong or already used code, or TOTP isn't set up", Body: apiError{}},
+		},
+	},
+	"GET /v1/account/{id}/statement": {
+		Summary: "The account's statement for a period",
+		Auth:    true,
+		APIKey:  APIKeyRead,
+		Query: []apiParam{
+			{Name: "from", Type: "date-time", Description: "Start of the period, the first of the month by default"},
+			{Name: "to", Type: "date-time", Description: "End of the period, excluded, now by default. A year after from at most"},
+		},
+		Responses: map[int]apiResponse{
+			http.StatusOK:         {Description: "Every movement of money in the period", Body: Statement{}},
+			http.StatusBadRequest: {Description: "Invalid period", Body: apiError{}},
+		},
+	},
+	"POST /v1/account/{id}/freeze": {
+		Summary: "Freeze an account, nothing moves in or out of it until it's unfrozen",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The frozen account", Body: Account{}},
+			http.StatusNotFound: {Description: "No such account", Body: apiError{}},
+		},
+	},
+	"POST /v1/account/{id}/unfreeze": {
+		Summary: "Unfreeze an account",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The account, active again", Body: Account{}},
+			http.StatusNotFound: {Description: "No such account", Body: apiError{}},
+		},
+	},
+	"POST /v1/apikey": {
+		Summary: "Issue an API key, for a partner backend to use some accounts with",
+		Admin:   true,
+		Request: CreateAPIKeyRequest{},
+		Responses: map[int]apiResponse{
+			http.StatusCreated:    {Description: "The key, which isn't shown again, and what's kept of it", Body: CreateAPIKeyResponse{}},
+			http.StatusBadRequest: {Description: "Missing name, accounts or permissions, or an expiry more than a year away", Body: apiError{}},
+		},
+	},
+	"GET /v1/apikey": {
+		Summary: "List the API keys, revoked and expired ones included",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "The keys, newest first", Body: []APIKey{}},
+		},
+	},
+	"DELETE /v1/apikey/{keyID}": {
+		Summary: "Revoke an API key, for good",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The revoked key", Body: APIKey{}},
+			http.StatusNotFound: {Description: "No such key", Body: apiError{}},
+		},
+	},
+	"GET /v1/cache/stats": {
+		Summary: "The account cache's hits and misses since the server started",
+		Admin:   true,
+		Responses: map[int]apiResponse{
+			http.StatusOK:       {Description: "The cache's counters", Body: CacheStats{}},
+			http.StatusNotFound: {Description: "The cache is off", Body: apiError{}},
+		},
+	},
+	"GET /.well-known/jwks.json": {
+		Summary: "The public keys tokens are signed with, to check them elsewhere",
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "JSON Web Key Set, empty while tokens are signed with a shared secret", Body: jwkSet{}},
+		},
+	},
+	"GET /openapi.json": {
+		Summary: "This document",
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "OpenAPI 3 document", Body: map[string]any{}},
+		},
+	},
+}
+
+// routeKeys lists the routes on router as "METHOD template"
+func routeKeys(router *mux.Router) ([]string, error) {
+	var keys []string
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			keys = append(keys, method+" "+tmpl)
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// buildOpenAPI describes every route on router
+func buildOpenAPI(router *mux.Router) (map[string]any, error) {
+	keys, err := routeKeys(router)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := newSchemaRegistry()
+	paths := map[string]map[string]any{}
+	for _, key := range keys {
+		op, ok := apiOperations[key]
+		if !ok {
+			return nil, fmt.Errorf("route %s has no OpenAPI entry", key)
+		}
+		method, tmpl, _ := strings.Cut(key, " ")
+		// What the versioned routes answer with goes by Accept, streams aside
+		negotiated := strings.HasPrefix(tmpl, apiPrefix+"/") && op.Responses[http.StatusOK].ContentType == ""
+
+		var params []map[string]any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(tmpl, -1) {
+			params = append(params, map[string]any{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "integer"},
+			})
+		}
+		for _, q := range op.Query {
+			param := map[string]any{"name": q.Name, "in": "query", "schema": paramSchema(q.Type)}
+			if q.Description != "" {
+				param["description"] = q.Description
+			}
+			params = append(params, param)
+		}
+		if method == http.MethodPost {
+			params = append(params, map[string]any{
+				"name": idempotencyKeyHeader, "in": "header", "schema": map[string]any{"type": "string", "maxLength": maxIdempotencyKeyLen},
+				"description": "Retrying with the same key gets the first answer back, with Idempotent-Replayed: true, rather than doing it again",
+			})
+		}
+
+		// The route's own come last, they know best what a status means there
+		sets := []map[int]apiResponse{commonResponses}
+		if method == http.MethodPost {
+			sets = append(sets, idempotencyResponses)
+		}
+		if method == http.MethodGet && negotiated {
+			sets = append(sets, negotiationResponses)
+		}
+		if op.Auth {
+			sets = append(sets, authResponses)
+		}
+		if op.Admin {
+			sets = append(sets, adminResponses)
+		}
+		responses := map[string]any{}
+		for _, set := range append(sets, op.Responses) {
+			for status, res := range set {
+				responses[fmt.Sprint(status)] = schemas.response(res, negotiated && status < 300)
+			}
+		}
+
+		operation := map[string]any{
+			"summary":     op.Summary,
+			"operationId": operationID(method, strings.TrimPrefix(tmpl, apiPrefix)),
+			"responses":   responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": schemas.schemaFor(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+		if op.Auth || op.Admin {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+		}
+		if op.APIKey != "" {
+			operation["security"] = append(operation["security"].([]map[string][]string), map[string][]string{"apiKeyAuth": {}})
+			operation["description"] = fmt.Sprintf("Takes an API key with the %s permission on the account", op.APIKey)
+		}
+
+		if paths[tmpl] == nil {
+			paths[tmpl] = map[string]any{}
+		}
+		paths[tmpl][strings.ToLower(method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "BankingServer API",
+			"version": "1.0.0",
+			"description": fmt.Sprintf("The same routes without the %s prefix still work until %s, with Deprecation and Sunset headers on every response",
+				apiPrefix, unversionedAPI.sunset.Format(time.DateOnly)),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "The token POST /account answers with, which only opens the account it was issued for, or an admin token from bankctl",
+				},
+				"apiKeyAuth": map[string]any{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        apiKeyHeader,
+					"description": "A key from POST /v1/apikey, for the accounts and permissions it was issued with",
+				},
+			},
+		},
+	}, nil
+}
+
+// operationID turns "GET /account/{id}/webhooks" into "getAccountIdWebhooks"
+func operationID(method, tmpl string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(tmpl, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') }) {
+		if part == "json" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func paramSchema(typ string) map[string]any {
+	if typ == "date-time" {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	return map[string]any{"type": typ}
+}
+
+// schemaRegistry turns Go types into JSON schemas, putting the structs under
+// components/schemas and referring to them from everywhere else
+type schemaRegistry struct {
+	schemas map[string]any
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: map[string]any{}}
+}
+
+// response describes res. One that's negotiated also comes as MessagePack, and as
+// CSV when it's a list
+func (sr *schemaRegistry) response(res apiResponse, negotiated bool) map[string]any {
+	out := map[string]any{"description": res.Description}
+	if res.Body != nil {
+		contentType := res.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		schema := sr.schemaFor(reflect.TypeOf(res.Body))
+		content := map[string]any{
+			contentType: map[string]any{"schema": schema},
+		}
+		if negotiated {
+			content[msgpackFormat.mediaType] = map[string]any{"schema": schema}
+			if _, ok := csvRows(res.Body); ok {
+				content[csvFormat.mediaType] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+		}
+		out["content"] = content
+	}
+	if len(res.Headers) > 0 {
+		headers := map[string]any{}
+		for name, desc := range res.Headers {
+			headers[name] = map[string]any{"description": desc, "schema": map[string]any{"type": "string"}}
+		}
+		out["headers"] = headers
+	}
+
+	return out
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (sr *schemaRegistry) schemaFor(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sr.schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Uint, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": sr.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object"}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := sr.schemas[t.Name()]; !ok {
+			// Registered before the fields, so a type referring to itself stops here
+			sr.schemas[t.Name()] = nil
+			sr.schemas[t.Name()] = sr.structSchema(t)
+		}
+		return ref
+	}
+
+	return map[string]any{}
+}
+
+// structSchema follows encoding/json: the json tag's name, no "-" fields, and
+// omitempty fields aren't required
+func (sr *schemaRegistry) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = sr.schemaFor(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// handleOpenAPI serves the document built once, when the routes were
+func handleOpenAPI(doc []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	// routes() panics on a route missing from the document, which fails this too
+	router := newAPIServer("", nil, nil, nil, nil, nil, nil, slog.Default(), nil).routes()
+	keys, err := routeKeys(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := map[string]bool{}
+	for _, key := range keys {
+		registered[key] = true
+		if _, ok := apiOperations[key]; !ok {
+			t.Errorf("route %s isn't in the OpenAPI document, add it to apiOperations", key)
+		}
+	}
+	for key := range apiOperations {
+		if !registered[key] {
+			t.Errorf("apiOperations describes %s, which isn't a route", key)
+		}
+	}
+
+	// And a route nobody described is caught
+	router.HandleFunc("/undocumented", func(http.ResponseWriter, *http.Request) {}).Methods("GET")
+	if _, err := buildOpenAPI(router); err == nil {
+		t.Fatal("expected an undocumented route to fail the build")
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	s := newAPIServer("", nil, nil, nil, nil, nil, nil, slog.Default(), nil)
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var doc struct {
+		OpenAPI    string
+		Paths      map[string]map[string]map[string]any
+		Components struct {
+			Schemas         map[string]map[string]any
+			SecuritySchemes map[string]map[string]any
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Fatalf("unexpected version %q", doc.OpenAPI)
+	}
+
+	for _, name := range []string{"Account", "CreateAccountRequest", "TransferRequest", "apiError"} {
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+	account := doc.Components.Schemas["Account"]["properties"].(map[string]any)
+	for _, field := range []string{"id", "firstName", "lastName", "number", "balance", "createdAt"} {
+		if account[field] == nil {
+			t.Errorf("Account schema has no %s", field)
+		}
+	}
+	if bearer := doc.Components.SecuritySchemes["bearerAuth"]; bearer["scheme"] != "bearer" || bearer["bearerFormat"] != "JWT" {
+		t.Fatalf("unexpected security scheme %v", bearer)
+	}
+
+	// Routes behind withJWTAuth say so, the others don't
+	if doc.Paths["/v1/account/{id}"]["get"]["security"] == nil {
+		t.Error("GET /account/{id} doesn't require a token")
+	}
+	if doc.Paths["/v1/account"]["post"]["security"] != nil {
+		t.Error("POST /account requires a token")
+	}
+	body := doc.Paths["/v1/transfer"]["post"]["requestBody"].(map[string]any)
+	schema := body["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	if schema["$ref"] != "#/components/schemas/TransferRequest" {
+		t.Fatalf("unexpected transfer body %v", schema)
+	}
+}
+
+func TestValidateJWTBearerPrefix(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	token, err := createJWT(NewAccount("Ada", "Lovelace"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []string{token, "Bearer " + token} {
+		if parsed, err := validateJWT(header); err != nil || !parsed.Valid {
+			t.Fatalf("%q rejected: %v", header, err)
+		}
+	}
+}
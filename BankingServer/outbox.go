@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// The relay only needs these from the store, which also keeps it testable without a DB
+type OutboxStore interface {
+	FetchPendingEvents(ctx context.Context, limit int) ([]*Event, error)
+	MarkEventPublished(ctx context.Context, id int64) error
+	MarkEventFailed(ctx context.Context, id int64, attempts int, nextAttemptAt time.Time) error
+}
+
+const (
+	outboxPollInterval   = time.Second
+	outboxBatchSize      = 50
+	outboxPublishTimeout = 10 * time.Second
+	outboxMaxBackoff     = 5 * time.Minute
+)
+
+// OutboxRelay moves events from the outbox to the publisher.
+// An event is only marked as published once the publisher accepted it, so a crash
+// in between means it'll be sent again: delivery is at-least-once.
+type OutboxRelay struct {
+	store     OutboxStore
+	publisher EventPublisher
+	interval  time.Duration
+	batchSize int
+	logger    *slog.Logger
+	quitch    chan struct{}
+}
+
+func NewOutboxRelay(store OutboxStore, publisher EventPublisher, logger *slog.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		store:     store,
+		publisher: publisher,
+		interval:  outboxPollInterval,
+		batchSize: outboxBatchSize,
+		logger:    logger,
+		quitch:    make(chan struct{}),
+	}
+}
+
+func (r *OutboxRelay) Start() {
+	go r.loop()
+}
+
+func (r *OutboxRelay) Stop() {
+	close(r.quitch)
+}
+
+// Same main loop as the Server pattern: tick, work, or leave
+func (r *OutboxRelay) loop() {
+	// Stopping cancels whatever batch is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	go func() {
+		<-r.quitch
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.relayBatch(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// relayBatch publishes the pending events in order and returns how many went through
+func (r *OutboxRelay) relayBatch(ctx context.Context) int {
+	events, err := r.store.FetchPendingEvents(ctx, r.batchSize)
+	if err != nil {
+		r.logger.Error("could not fetch outbox events", "err", err)
+		return 0
+	}
+
+	published := 0
+	for _, ev := range events {
+		publishCtx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+		err := r.publisher.Publish(publishCtx, ev)
+		cancel()
+
+		if err != nil {
+			attempts := ev.Attempts + 1
+			r.logger.Warn("could not publish event", "event_id", ev.ID, "event_type", ev.Type, "attempts", attempts, "err", err)
+			if err := r.store.MarkEventFailed(ctx, ev.ID, attempts, time.Now().Add(retryBackoff(attempts))); err != nil {
+				r.logger.Error("could not record failed event", "event_id", ev.ID, "attempts", attempts, "err", err)
+			}
+			continue
+		}
+
+		if err := r.store.MarkEventPublished(ctx, ev.ID); err != nil {
+			// It'll be published again, which consumers have to put up with anyway
+			r.logger.Error("could not mark event as published", "event_id", ev.ID, "err", err)
+			continue
+		}
+		published++
+	}
+
+	return published
+}
+
+// Exponential backoff: 1s, 2s, 4s... capped so a long outage doesn't park events forever
+func retryBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+
+	backoff := time.Second
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+
+	return backoff
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An outbox that lives in memory, enough to watch the relay do its job
+type fakeOutbox struct {
+	mu        sync.Mutex
+	events    []*Event
+	published map[int64]bool
+	next      map[int64]time.Time
+}
+
+func newFakeOutbox(events ...*Event) *fakeOutbox {
+	return &fakeOutbox{
+		events:    events,
+		published: make(map[int64]bool),
+		next:      make(map[int64]time.Time),
+	}
+}
+
+func (o *fakeOutbox) FetchPendingEvents(_ context.Context, limit int) ([]*Event, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var pending []*Event
+	for _, ev := range o.events {
+		if o.published[ev.ID] || o.next[ev.ID].After(time.Now()) {
+			continue
+		}
+		copied := *ev
+		pending = append(pending, &copied)
+		if len(pending) == limit {
+			break
+		}
+	}
+	return pending, nil
+}
+
+func (o *fakeOutbox) MarkEventPublished(_ context.Context, id int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.published[id] = true
+	return nil
+}
+
+func (o *fakeOutbox) MarkEventFailed(_ context.Context, id int64, attempts int, nextAttemptAt time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, ev := range o.events {
+		if ev.ID == id {
+			ev.Attempts = attempts
+		}
+	}
+	o.next[id] = nextAttemptAt
+	return nil
+}
+
+type flakyPublisher struct {
+	failures int
+	received []int64
+}
+
+func (p *flakyPublisher) Publish(_ context.Context, ev *Event) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("receiver is down")
+	}
+	p.received = append(p.received, ev.ID)
+	return nil
+}
+
+func TestOutboxRelayPublishesPendingEvents(t *testing.T) {
+	outbox := newFakeOutbox(
+		&Event{ID: 1, Type: EventAccountCreated, AggregateID: 1},
+		&Event{ID: 2, Type: EventTransferCompleted, AggregateID: 1},
+	)
+	publisher := &flakyPublisher{}
+	relay := NewOutboxRelay(outbox, publisher, slog.Default())
+
+	if n := relay.relayBatch(context.Background()); n != 2 {
+		t.Fatalf("expected 2 events published, got %d", n)
+	}
+	if n := relay.relayBatch(context.Background()); n != 0 {
+		t.Fatalf("published events were sent again: %d", n)
+	}
+	if len(publisher.received) != 2 || publisher.received[0] != 1 || publisher.received[1] != 2 {
+		t.Fatalf("events delivered out of order: %v", publisher.received)
+	}
+}
+
+func TestOutboxRelayRetriesWithBackoff(t *testing.T) {
+	outbox := newFakeOutbox(&Event{ID: 1, Type: EventAccountDeleted, AggregateID: 3})
+	publisher := &flakyPublisher{failures: 1}
+	relay := NewOutboxRelay(outbox, publisher, slog.Default())
+
+	if n := relay.relayBatch(context.Background()); n != 0 {
+		t.Fatalf("expected the first attempt to fail, got %d published", n)
+	}
+	if outbox.events[0].Attempts != 1 {
+		t.Fatalf("expected 1 failed attempt, got %d", outbox.events[0].Attempts)
+	}
+	// Still backing off, so nothing to do
+	if n := relay.relayBatch(context.Background()); n != 0 {
+		t.Fatalf("event retried before its backoff elapsed")
+	}
+
+	outbox.next[1] = time.Now()
+	if n := relay.relayBatch(context.Background()); n != 1 {
+		t.Fatalf("expected the retry to go through")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		30: outboxMaxBackoff,
+	}
+	for attempts, want := range cases {
+		if got := retryBackoff(attempts); got != want {
+			t.Errorf("retryBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var got Event
+	var eventID string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eventID = r.Header.Get("X-Event-ID")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer receiver.Close()
+
+	ev := &Event{ID: 7, Type: EventAccountCreated, AggregateID: 4, Payload: json.RawMessage(`{"id":4}`)}
+	if err := NewWebhookPublisher(receiver.URL).Publish(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	if eventID != "7" || got.Type != EventAccountCreated || got.AggregateID != 4 {
+		t.Fatalf("receiver got %+v with id %q", got, eventID)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	if err := NewWebhookPublisher(failing.URL).Publish(context.Background(), ev); err == nil {
+		t.Fatal("expected an error on a non-2xx answer")
+	}
+}
+
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewWriterPublisher(&buf)
+
+	p.Publish(context.Background(), &Event{ID: 1, Type: EventAccountCreated, Payload: json.RawMessage(`{}`)})
+	p.Publish(context.Background(), &Event{ID: 2, Type: EventAccountDeleted, Payload: json.RawMessage(`{}`)})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per event, got %q", buf.String())
+	}
+}
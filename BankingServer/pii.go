@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Names are PII, and PostgresStore can keep them encrypted. Each account gets a
+// data key of its own that seals its names with AES-GCM, and the data key is kept
+// wrapped by a master key the KeyManager holds: envelope encryption. Rotating the
+// master key then only means wrapping every data key again, which PIIRotator does
+// in the background, the names themselves stay as they are.
+//
+// The names can't be searched once sealed, so each also gets a blind index, an
+// HMAC of the name lowercased, which finds accounts by whole name. Prefixes no
+// longer match, and accounts can't be sorted by last name.
+//
+// Rows from before encryption was on are read as they are until PIIRotator gets to
+// them. The outbox has nothing to seal, account events carry IDs and no names
+
+// KeyManager holds the master keys. LocalKeyManager reads them from a file, one
+// in front of a KMS would implement the same, and would want to cache the data
+// keys it unwraps: every account read unwraps one
+type KeyManager interface {
+	// CurrentKeyID is the master key WrapKey uses
+	CurrentKeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+	// BlindIndexKey never rotates, every blind index would have to be worked out
+	// again from the names
+	BlindIndexKey() []byte
+}
+
+// The key file is JSON, the keys 32 bytes in base64 each:
+//
+//	{"current": "2026-10", "keys": {"2026-10": "..."}, "blindIndexKey": "..."}
+//
+// Rotating is adding a key, making it current and restarting. The old one goes once
+// PIIRotator has stopped finding accounts to move, skipped ones included
+type localKeyFile struct {
+	Current       string            `json:"current"`
+	Keys          map[string]string `json:"keys"`
+	BlindIndexKey string            `json:"blindIndexKey"`
+}
+
+type LocalKeyManager struct {
+	current    string
+	keys       map[string]cipher.AEAD
+	blindIndex []byte
+}
+
+func LoadLocalKeyManager(path string) (*LocalKeyManager, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file localKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	km := &LocalKeyManager{current: file.Current, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range file.Keys {
+		key, err := decodePIIKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q: %w", path, id, err)
+		}
+		if km.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	if km.keys[km.current] == nil {
+		return nil, fmt.Errorf("%s: the current key %q isn't one of the keys", path, km.current)
+	}
+	if km.blindIndex, err = decodePIIKey(file.BlindIndexKey); err != nil {
+		return nil, fmt.Errorf("%s: blindIndexKey: %w", path, err)
+	}
+
+	return km, nil
+}
+
+func decodePIIKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("keys are 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (km *LocalKeyManager) CurrentKeyID() string {
+	return km.current
+}
+
+func (km *LocalKeyManager) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := sealAEAD(km.keys[km.current], dataKey, []byte(km.current))
+	return km.current, wrapped, err
+}
+
+func (km *LocalKeyManager) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead := km.keys[keyID]
+	if aead == nil {
+		return nil, fmt.Errorf("unknown PII master key %q", keyID)
+	}
+	return openAEAD(aead, wrapped, []byte(keyID))
+}
+
+func (km *LocalKeyManager) BlindIndexKey() []byte {
+	return km.blindIndex
+}
+
+// sealAEAD is AES-GCM with the nonce in front, openAEAD takes it back off
+func sealAEAD(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func openAEAD(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
+
+// sealedNames is an account's names as they're stored
+type sealedNames struct {
+	KeyID string
+	// The data key, wrapped by KeyID
+	DataKey   []byte
+	FirstName []byte
+	LastName  []byte
+}
+
+type piiCipher struct {
+	keys KeyManager
+}
+
+func newPIICipher(keys KeyManager) *piiCipher {
+	return &piiCipher{keys: keys}
+}
+
+// The field each name is sealed as is authenticated with it, so the two can't be swapped
+func (c *piiCipher) seal(ctx context.Context, firstName, lastName string) (*sealedNames, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := new(sealedNames)
+	if sealed.FirstName, err = sealAEAD(aead, []byte(firstName), []byte("firstName")); err != nil {
+		return nil, err
+	}
+	if sealed.LastName, err = sealAEAD(aead, []byte(lastName), []byte("lastName")); err != nil {
+		return nil, err
+	}
+	if sealed.KeyID, sealed.DataKey, err = c.keys.WrapKey(ctx, dataKey); err != nil {
+		return nil, err
+	}
+
+	return sealed, nil
+}
+
+func (c *piiCipher) open(ctx context.Context, sealed *sealedNames) (string, string, error) {
+	dataKey, err := c.keys.UnwrapKey(ctx, sealed.KeyID, sealed.DataKey)
+	if err != nil {
+		return "", "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	firstName, err := openAEAD(aead, sealed.FirstName, []byte("firstName"))
+	if err != nil {
+		return "", "", fmt.Errorf("opening firstName: %w", err)
+	}
+	lastName, err := openAEAD(aead, sealed.LastName, []byte("lastName"))
+	if err != nil {
+		return "", "", fmt.Errorf("opening lastName: %w", err)
+	}
+
+	return string(firstName), string(lastName), nil
+}
+
+// rewrap puts the data key under the current master key. The names don't change
+func (c *piiCipher) rewrap(ctx context.Context, sealed *sealedNames) error {
+	dataKey, err := c.keys.UnwrapKey(ctx, sealed.KeyID, sealed.DataKey)
+	if err != nil {
+		return err
+	}
+	sealed.KeyID, sealed.DataKey, err = c.keys.WrapKey(ctx, dataKey)
+	return err
+}
+
+// blindIndex is the same for names that only differ in case, like the plaintext
+// search was
+func (c *piiCipher) blindIndex(name string) []byte {
+	mac := hmac.New(sha256.New, c.keys.BlindIndexKey())
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(name))))
+	return mac.Sum(nil)
+}
+
+var ErrSortOnEncrypted = errors.New("cannot sort on lastName while names are encrypted")
+
+// nameColumns is what the names are written as: themselves, or sealed along with
+// their blind indexes and nothing in the plaintext columns
+func (st *sqlStore) nameColumns(ctx context.Context, firstName, lastName string) ([]string, []any, error) {
+	if st.pii == nil {
+		return []string{"firstName", "lastName"}, []any{firstName, lastName}, nil
+	}
+
+	sealed, err := st.pii.seal(ctx, firstName, lastName)
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := []string{"firstName", "lastName", "piiKeyID", "piiDataKey", "firstNameEnc", "lastNameEnc", "firstNameIndex", "lastNameIndex"}
+	values := []any{nil, nil, sealed.KeyID, sealed.DataKey, sealed.FirstName, sealed.LastName,
+		st.pii.blindIndex(firstName), st.pii.blindIndex(lastName)}
+
+	return columns, values, nil
+}
+
+const sealedNameColumns = "piiKeyID, piiDataKey, firstNameEnc, lastNameEnc"
+
+// accountColumns are what account reads select, the sealed names included when
+// there are any
+func (st *sqlStore) accountColumns() string {
+	if st.pii == nil {
+		return accountColumns
+	}
+	return accountColumns + ", " + sealedNameColumns
+}
+
+// nameIndex is what name searches compare the blind indexes to, nil while names
+// are plaintext
+func (st *sqlStore) nameIndex() func(string) []byte {
+	if st.pii == nil {
+		return nil
+	}
+	return st.pii.blindIndex
+}
+
+// scanAccountRow is scanAccount, opening the names when they're sealed
+func (st *sqlStore) scanAccountRow(ctx context.Context, row rowScanner) (*Account, error) {
+	if st.pii == nil {
+		return scanAccount(row)
+	}
+
+	var keyID sql.NullString
+	sealed := new(sealedNames)
+	acc, err := scanAccount(row, &keyID, &sealed.DataKey, &sealed.FirstName, &sealed.LastName)
+	if err != nil || !keyID.Valid {
+		// Not sealed yet, PIIRotator will get to it
+		return acc, err
+	}
+
+	sealed.KeyID = keyID.String
+	if acc.FirstName, acc.LastName, err = st.pii.open(ctx, sealed); err != nil {
+		return nil, fmt.Errorf("account %d: %w", acc.ID, err)
+	}
+
+	return acc, nil
+}
+
+// EncryptsPII says whether the store keeps names encrypted, and so whether
+// PIIRotator has anything to do
+func (st *PostgresStore) EncryptsPII() bool {
+	return st.pii != nil
+}
+
+func (st *PostgresStore) ReencryptPII(ctx context.Context, afterID, limit int) (*PIIBatch, error) {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.ReencryptPII(ctx, afterID, limit)
+}
+
+// PIIBatch is how a ReencryptPII batch went
+type PIIBatch struct {
+	// Accounts the batch looked at, fewer than the limit when there are no more
+	Scanned int
+	Moved   int
+	// The last account looked at, the next batch starts after it
+	LastID int
+	// Accounts whose data key wouldn't unwrap, a key missing from the key file say.
+	// They're left as they are, and tried again on the next run
+	Failed map[int]error
+}
+
+// ReencryptPII moves up to limit accounts after afterID onto the current master
+// key, sealing the names of those that were still plaintext. Accounts another run
+// has locked are left to it
+func (st *sqlStore) ReencryptPII(ctx context.Context, afterID, limit int) (*PIIBatch, error) {
+	if st.pii == nil {
+		return &PIIBatch{LastID: afterID}, nil
+	}
+
+	current := st.pii.keys.CurrentKeyID()
+	var batch *PIIBatch
+	err := st.atomically(ctx, func(tx *sqlStore) error {
+		batch = &PIIBatch{LastID: afterID}
+		rows, err := tx.q.QueryContext(ctx, `SELECT id, firstName, lastName, `+sealedNameColumns+`
+			FROM Account
+			WHERE (piiKeyID IS NULL OR piiKeyID <> $1) AND id > $2
+			ORDER BY id
+			LIMIT $3 `+st.dialect.lockRows, current, afterID, limit)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id                  int
+			firstName, lastName sql.NullString
+			keyID               sql.NullString
+			sealed              sealedNames
+		}
+		var selected []*row
+		for rows.Next() {
+			r := new(row)
+			err := rows.Scan(&r.id, &r.firstName, &r.lastName, &r.keyID, &r.sealed.DataKey, &r.sealed.FirstName, &r.sealed.LastName)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			selected = append(selected, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range selected {
+			batch.Scanned++
+			batch.LastID = r.id
+			if r.keyID.Valid {
+				r.sealed.KeyID = r.keyID.String
+				// One account's key being gone is no reason to hold up all the others
+				if err := st.pii.rewrap(ctx, &r.sealed); err != nil {
+					if batch.Failed == nil {
+						batch.Failed = make(map[int]error)
+					}
+					batch.Failed[r.id] = err
+					continue
+				}
+				_, err = tx.q.ExecContext(ctx, "UPDATE Account SET piiKeyID = $1, piiDataKey = $2 WHERE id = $3",
+					r.sealed.KeyID, r.sealed.DataKey, r.id)
+			} else {
+				err = tx.updateNames(ctx, r.id, r.firstName.String, r.lastName.String)
+			}
+			if err != nil {
+				return err
+			}
+			batch.Moved++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// The rotator only needs this from the store
+type PIIRotationStore interface {
+	ReencryptPII(ctx context.Context, afterID, limit int) (*PIIBatch, error)
+}
+
+const (
+	piiRotationInterval  = time.Minute
+	piiRotationBatchSize = 100
+)
+
+// PIIRotator keeps moving accounts onto the current master key, a batch at a time
+// so no transaction holds many rows for long. Once they're all there, each run is
+// a query that finds nothing
+type PIIRotator struct {
+	store     PIIRotationStore
+	interval  time.Duration
+	batchSize int
+	logger    *slog.Logger
+	quitch    chan struct{}
+}
+
+func NewPIIRotator(store PIIRotationStore, logger *slog.Logger) *PIIRotator {
+	return &PIIRotator{
+		store:     store,
+		interval:  piiRotationInterval,
+		batchSize: piiRotationBatchSize,
+		logger:    logger,
+		quitch:    make(chan struct{}),
+	}
+}
+
+func (r *PIIRotator) Start() {
+	go r.loop()
+}
+
+func (r *PIIRotator) Stop() {
+	close(r.quitch)
+}
+
+// Same main loop as the OutboxRelay's
+func (r *PIIRotator) loop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	go func() {
+		<-r.quitch
+		cancel()
+	}()
+
+	r.rotate(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			r.rotate(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rotate runs batches until one comes back short, and returns how many accounts moved
+func (r *PIIRotator) rotate(ctx context.Context) int {
+	total, afterID := 0, 0
+	for ctx.Err() == nil {
+		batch, err := r.store.ReencryptPII(ctx, afterID, r.batchSize)
+		if err != nil {
+			r.logger.Error("could not re-encrypt PII", "moved", total, "after_account_id", afterID, "err", err)
+			break
+		}
+		total += batch.Moved
+		for id, err := range batch.Failed {
+			r.logger.Warn("could not move an account onto the current PII key, skipping it", "account_id", id, "err", err)
+		}
+		if batch.Scanned < r.batchSize {
+			break
+		}
+		afterID = batch.LastID
+	}
+	if total > 0 {
+		r.logger.Info("moved accounts onto the current PII key", "accounts", total)
+	}
+
+	return total
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePIIKeyFile(t *testing.T, current string, ids ...string) string {
+	t.Helper()
+	file := localKeyFile{Current: current, Keys: map[string]string{}, BlindIndexKey: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))}
+	for i, id := range ids {
+		file.Keys[id] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, 32))
+	}
+	data, _ := json.Marshal(file)
+	path := filepath.Join(t.TempDir(), "pii.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadPIIKeys(t *testing.T, current string, ids ...string) *LocalKeyManager {
+	t.Helper()
+	km, err := LoadLocalKeyManager(writePIIKeyFile(t, current, ids...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func TestLoadLocalKeyManager(t *testing.T) {
+	if _, err := LoadLocalKeyManager(writePIIKeyFile(t, "2026-11", "2026-10")); err == nil {
+		t.Fatal("expected a current key that isn't there to be refused")
+	}
+
+	path := filepath.Join(t.TempDir(), "pii.json")
+	os.WriteFile(path, []byte(`{"current": "a", "keys": {"a": "c2hvcnQ="}}`), 0o600)
+	if _, err := LoadLocalKeyManager(path); err == nil {
+		t.Fatal("expected a short key to be refused")
+	}
+}
+
+func TestPIICipher(t *testing.T) {
+	ctx := context.Background()
+	c := newPIICipher(loadPIIKeys(t, "2026-10", "2026-10"))
+
+	sealed, err := c.seal(ctx, "Ada", "Lovelace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.FirstName, []byte("Ada")) || sealed.KeyID != "2026-10" {
+		t.Fatalf("unexpected sealed names %+v", sealed)
+	}
+	if first, last, err := c.open(ctx, sealed); err != nil || first != "Ada" || last != "Lovelace" {
+		t.Fatalf("unexpected names %q %q, %v", first, last, err)
+	}
+
+	// Each name only opens as the field it was sealed as
+	swapped := *sealed
+	swapped.FirstName, swapped.LastName = sealed.LastName, sealed.FirstName
+	if _, _, err := c.open(ctx, &swapped); err == nil {
+		t.Fatal("expected swapped names not to open")
+	}
+
+	if !bytes.Equal(c.blindIndex(" ada"), c.blindIndex("ADA")) || bytes.Equal(c.blindIndex("Ada"), c.blindIndex("Alan")) {
+		t.Fatal("expected the blind index to ignore case and nothing else")
+	}
+}
+
+func TestPIIRewrap(t *testing.T) {
+	ctx := context.Background()
+	path := writePIIKeyFile(t, "2026-10", "2026-10")
+	old, _ := LoadLocalKeyManager(path)
+	sealed, err := newPIICipher(old).seal(ctx, "Ada", "Lovelace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is added and made current, the old one stays until nothing needs it
+	rotated := newPIICipher(loadPIIKeys(t, "2026-11", "2026-10", "2026-11"))
+	names := sealed.FirstName
+	if err := rotated.rewrap(ctx, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if sealed.KeyID != "2026-11" || !bytes.Equal(sealed.FirstName, names) {
+		t.Fatalf("unexpected sealed names %+v", sealed)
+	}
+	if first, _, err := rotated.open(ctx, sealed); err != nil || first != "Ada" {
+		t.Fatalf("unexpected name %q, %v", first, err)
+	}
+	if _, _, err := newPIICipher(old).open(ctx, sealed); err == nil {
+		t.Fatal("expected the old key alone not to open it")
+	}
+}
+
+func TestBuildAccountQueryWithBlindIndex(t *testing.T) {
+	c := newPIICipher(loadPIIKeys(t, "2026-10", "2026-10"))
+	q := &AccountQuery{Name: "Ada", Limit: 10, Sort: AccountSort{Field: "id"}}
+
+	query, args, err := buildAccountPageQuery("id", q, c.blindIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "firstNameIndex = $1 OR lastNameIndex = $1") || strings.Contains(query, "LIKE") {
+		t.Fatalf("unexpected query %s", query)
+	}
+	if !bytes.Equal(args[0].([]byte), c.blindIndex("ada")) {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
+
+// fakePIIRotationStore has accounts 1 to total, those up to moved already moved
+type fakePIIRotationStore struct {
+	total, moved, calls int
+}
+
+func (s *fakePIIRotationStore) ReencryptPII(ctx context.Context, afterID, limit int) (*PIIBatch, error) {
+	s.calls++
+	start := max(afterID, s.moved)
+	n := min(limit, s.total-start)
+	s.moved = start + n
+	return &PIIBatch{Scanned: n, Moved: n, LastID: start + n}, nil
+}
+
+func TestPIIRotatorRunsBatchesUntilShort(t *testing.T) {
+	store := &fakePIIRotationStore{total: 25}
+	r := NewPIIRotator(store, slog.Default())
+	r.batchSize = 10
+
+	if moved := r.rotate(context.Background()); moved != 25 || store.calls != 3 {
+		t.Fatalf("expected 25 accounts in 3 batches, got %d in %d", moved, store.calls)
+	}
+	if moved := r.rotate(context.Background()); moved != 0 || store.calls != 4 {
+		t.Fatalf("expected nothing left, got %d", moved)
+	}
+}
+
+// The sealing is all in the queries PostgresStore shares with SQLiteStore, so an
+// in-memory SQLite with the sealed name columns tries it out without a Postgres
+func newSQLitePIIStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+	ctx := context.Background()
+	sqlite, err := NewSQLiteStore(":memory:", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.db.Close() })
+	if err := sqlite.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"piiKeyID TEXT", "piiDataKey BLOB", "firstNameEnc BLOB", "lastNameEnc BLOB", "firstNameIndex BLOB", "lastNameIndex BLOB"} {
+		if _, err := sqlite.db.ExecContext(ctx, "ALTER TABLE Account ADD COLUMN "+column); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sqlite
+}
+
+func TestSQLStorePII(t *testing.T) {
+	ctx := context.Background()
+	sqlite := newSQLitePIIStore(t)
+
+	// From before names were encrypted
+	alanID, err := sqlite.CreateAccount(ctx, NewAccount("Alan", "Turing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := sqlite.sqlStore
+	store.pii = newPIICipher(loadPIIKeys(t, "2026-10", "2026-10"))
+	adaID, err := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstName sql.NullString
+	var sealed []byte
+	store.db.QueryRowContext(ctx, "SELECT firstName, firstNameEnc FROM Account WHERE id = ?", adaID).Scan(&firstName, &sealed)
+	if firstName.Valid || len(sealed) == 0 || bytes.Contains(sealed, []byte("Ada")) {
+		t.Fatalf("expected only the sealed name, got %q and %x", firstName.String, sealed)
+	}
+	if acc, err := store.GetAccountByID(ctx, adaID); err != nil || acc.FirstName != "Ada" || acc.LastName != "Lovelace" {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+	if acc, err := store.GetAccountByID(ctx, alanID); err != nil || acc.LastName != "Turing" {
+		t.Fatalf("expected the plaintext account to still read, got %+v, %v", acc, err)
+	}
+
+	for _, name := range []string{"lovelace", "Turing"} {
+		page, err := store.GetAccounts(ctx, &AccountQuery{Name: name, Limit: 10, Sort: AccountSort{Field: "id"}})
+		if err != nil || len(page.Accounts) != 1 {
+			t.Fatalf("expected %s to be found, got %+v, %v", name, page, err)
+		}
+	}
+	_, err = store.GetAccounts(ctx, &AccountQuery{Limit: 10, Sort: AccountSort{Field: "lastName"}})
+	if !errors.Is(err, ErrSortOnEncrypted) {
+		t.Fatalf("expected the lastName sort to be refused, got %v", err)
+	}
+
+	// A rename seals the plaintext account's names too
+	if err := store.UpdateAccount(ctx, &Account{ID: alanID, FirstName: "Alan", LastName: "Kay"}); err != nil {
+		t.Fatal(err)
+	}
+	var lastName sql.NullString
+	store.db.QueryRowContext(ctx, "SELECT lastName FROM Account WHERE id = ?", alanID).Scan(&lastName)
+	if lastName.Valid {
+		t.Fatalf("expected no plaintext name, got %q", lastName.String)
+	}
+	if acc, err := store.GetAccountByID(ctx, alanID); err != nil || acc.LastName != "Kay" {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+}
+
+// An account under a key that's gone from the key file holds up no one after it
+func TestPIIRotationSkipsAccountsThatWontUnwrap(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLitePIIStore(t).sqlStore
+
+	store.pii = newPIICipher(loadPIIKeys(t, "lost", "lost"))
+	lostID, err := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.pii = newPIICipher(loadPIIKeys(t, "2026-10", "2026-10"))
+	for _, name := range []string{"Alan", "Grace"} {
+		if _, err := store.CreateAccount(ctx, NewAccount(name, "Hopper")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "lost" is gone from the new key file
+	store.pii = newPIICipher(loadPIIKeys(t, "2026-11", "2026-10", "2026-11"))
+	r := NewPIIRotator(store, slog.Default())
+	r.batchSize = 1
+	if moved := r.rotate(ctx); moved != 2 {
+		t.Fatalf("expected the 2 accounts after the lost one moved, got %d", moved)
+	}
+
+	rows, err := store.db.QueryContext(ctx, "SELECT id, piiKeyID FROM Account ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var keyID string
+		rows.Scan(&id, &keyID)
+		want := "2026-11"
+		if id == lostID {
+			want = "lost"
+		}
+		if keyID != want {
+			t.Fatalf("account %d: expected key %q, got %q", id, want, keyID)
+		}
+	}
+	if acc, err := store.GetAccountByID(ctx, 3); err != nil || acc.FirstName != "Grace" {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+}
+
+// Against a real database, like the postgres storage backend
+func TestPostgresPII(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set")
+	}
+	ctx := context.Background()
+	path := writePIIKeyFile(t, "2026-10", "2026-10")
+
+	open := func(keys KeyManager) *PostgresStore {
+		cfg := DefaultPostgresConfig()
+		cfg.ConnStr = dsn
+		cfg.KeyManager = keys
+		store, err := NewPostgresStore(cfg, slog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.db.Close() })
+		return store
+	}
+
+	plain := open(nil)
+	if err := plain.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.db.ExecContext(ctx, "TRUNCATE Account, Outbox RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	// From before names were encrypted
+	alanID, err := plain.CreateAccount(ctx, NewAccount("Alan", "Turing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := LoadLocalKeyManager(path)
+	store := open(keys)
+	adaID, err := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstName sql.NullString
+	store.db.QueryRowContext(ctx, "SELECT firstName FROM Account WHERE id = $1", adaID).Scan(&firstName)
+	if firstName.Valid {
+		t.Fatalf("expected no plaintext name, got %q", firstName.String)
+	}
+	if acc, err := store.GetAccountByID(ctx, adaID); err != nil || acc.FirstName != "Ada" {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+
+	// Both the sealed and the plaintext account are found by their whole name
+	for _, name := range []string{"lovelace", "Turing"} {
+		page, err := store.GetAccounts(ctx, &AccountQuery{Name: name, Limit: 10, Sort: AccountSort{Field: "id"}})
+		if err != nil || len(page.Accounts) != 1 {
+			t.Fatalf("expected %s to be found, got %+v, %v", name, page, err)
+		}
+	}
+	_, err = store.GetAccounts(ctx, &AccountQuery{Limit: 10, Sort: AccountSort{Field: "lastName"}})
+	if !errors.Is(err, ErrSortOnEncrypted) {
+		t.Fatalf("expected the lastName sort to be refused, got %v", err)
+	}
+
+	// After a rotation both end up on the new key
+	rotated := open(loadPIIKeys(t, "2026-11", "2026-10", "2026-11"))
+	if batch, err := rotated.ReencryptPII(ctx, 0, 10); err != nil || batch.Moved != 2 {
+		t.Fatalf("expected 2 accounts moved, got %+v, %v", batch, err)
+	}
+	var keyID string
+	rotated.db.QueryRowContext(ctx, "SELECT piiKeyID FROM Account WHERE id = $1", alanID).Scan(&keyID)
+	if keyID != "2026-11" {
+		t.Fatalf("unexpected key %q", keyID)
+	}
+	if acc, err := rotated.GetAccountByID(ctx, alanID); err != nil || acc.LastName != "Turing" {
+		t.Fatalf("unexpected account %+v, %v", acc, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// PostgresConfig is how NewPostgresStore connects, and how big its pools get
+type PostgresConfig struct {
+	ConnStr string
+	// Connection strings of the read replicas, if any
+	Replicas []string
+
+	// Applied to every pool, the primary's and each replica's
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// How long to keep trying at startup before giving up on the primary
+	ConnectTimeout time.Duration
+
+	// Holds the keys names are encrypted with, nil keeps them in plaintext. See pii.go
+	KeyManager KeyManager
+}
+
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		ConnStr: "user=postgres dbname=postgres password=bankingserver sslmode=disable",
+		// Postgres allows 100 connections by default, leave room for everyone else
+		MaxOpenConns: 25,
+		MaxIdleConns: 25,
+		// Connections get recycled now and then, so a failover or a load balancer
+		// change is picked up without a restart
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+		ConnectTimeout:  time.Minute,
+	}
+}
+
+// PostgresConfigFromEnv is DefaultPostgresConfig, overridden by whichever of the
+// POSTGRES_* env variables are set. Durations are written like "30s" or "5m"
+func PostgresConfigFromEnv() (PostgresConfig, error) {
+	cfg := DefaultPostgresConfig()
+	if s := os.Getenv("POSTGRES_CONN_STR"); s != "" {
+		cfg.ConnStr = s
+	}
+	// Replicas are connection strings separated by semicolons
+	if s := os.Getenv("POSTGRES_REPLICAS"); s != "" {
+		cfg.Replicas = strings.Split(s, ";")
+	}
+
+	var err error
+	if cfg.MaxOpenConns, err = envInt("POSTGRES_MAX_OPEN_CONNS", cfg.MaxOpenConns); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxIdleConns, err = envInt("POSTGRES_MAX_IDLE_CONNS", cfg.MaxIdleConns); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnMaxLifetime, err = envDuration("POSTGRES_CONN_MAX_LIFETIME", cfg.ConnMaxLifetime); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnMaxIdleTime, err = envDuration("POSTGRES_CONN_MAX_IDLE_TIME", cfg.ConnMaxIdleTime); err != nil {
+		return cfg, err
+	}
+	if cfg.ConnectTimeout, err = envDuration("POSTGRES_CONNECT_TIMEOUT", cfg.ConnectTimeout); err != nil {
+		return cfg, err
+	}
+	if path := os.Getenv("PII_KEYFILE"); path != "" {
+		if cfg.KeyManager, err = LoadLocalKeyManager(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg PostgresConfig) openPool(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Zero means no limit to database/sql, which is what we mean too
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	return db, nil
+}
+
+const (
+	connectInitialBackoff = 500 * time.Millisecond
+	connectMaxBackoff     = 10 * time.Second
+	connectPingTimeout    = 5 * time.Second
+)
+
+// waitForDB pings db until it answers or timeout runs out, backing off in between.
+// Containers and DBs rarely come up in the order you'd like
+func waitForDB(db *sql.DB, timeout time.Duration, logger *slog.Logger) error {
+	deadline := time.Now().Add(timeout)
+	backoff := connectInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), connectPingTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("DB still unreachable after %d attempts: %w", attempt, err)
+		}
+		logger.Warn("DB unreachable, retrying", "attempt", attempt, "backoff", backoff.String(), "err", err)
+		time.Sleep(backoff)
+
+		backoff = min(backoff*2, connectMaxBackoff)
+	}
+}
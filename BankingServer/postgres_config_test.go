@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestPostgresConfigFromEnv(t *testing.T) {
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "50")
+	t.Setenv("POSTGRES_CONN_MAX_LIFETIME", "1h")
+	t.Setenv("POSTGRES_REPLICAS", "host=replica1;host=replica2")
+
+	cfg, err := PostgresConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxOpenConns != 50 || cfg.ConnMaxLifetime != time.Hour || len(cfg.Replicas) != 2 {
+		t.Fatalf("env not applied: %+v", cfg)
+	}
+	if cfg.MaxIdleConns != DefaultPostgresConfig().MaxIdleConns {
+		t.Fatal("unset variables should keep their default")
+	}
+
+	t.Setenv("POSTGRES_MAX_IDLE_CONNS", "-1")
+	if _, err := PostgresConfigFromEnv(); err == nil {
+		t.Fatal("expected a negative pool size to be rejected")
+	}
+}
+
+func TestWaitForDBGivesUp(t *testing.T) {
+	store, err := NewSQLiteStore(":memory:", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForDB(store.db, time.Second, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.db.Close()
+	start := time.Now()
+	if err := waitForDB(store.db, 2*connectInitialBackoff, slog.Default()); err == nil {
+		t.Fatal("expected a closed DB to never come up")
+	}
+	if elapsed := time.Since(start); elapsed > 3*connectInitialBackoff {
+		t.Fatalf("kept trying past the timeout: %v", elapsed)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccountQuery describes one page of GET /account.
+// Pagination is keyset-based: the cursor holds the sort value and ID of the last row
+// of the previous page, so pages stay stable while accounts come and go.
+type AccountQuery struct {
+	Name        string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	MinBalance  *int64
+	MaxBalance  *int64
+	Sort        AccountSort
+	Limit       int
+	Cursor      *AccountCursor
+}
+
+type AccountPage struct {
+	Accounts   []*Account
+	Total      int
+	NextCursor string
+}
+
+type AccountSort struct {
+	Field string
+	Desc  bool
+}
+
+type AccountCursor struct {
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+const (
+	defaultAccountPageSize = 50
+	maxAccountPageSize     = 500
+)
+
+// The only columns a client can sort on, mapped to what the DB calls them.
+// Never put anything from the request in the SQL that didn't come from here
+var accountSortColumns = map[string]string{
+	"id":        "id",
+	"createdAt": "createdAt",
+	"balance":   "balance",
+	"lastName":  "lastName",
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func DefaultAccountQuery() *AccountQuery {
+	return &AccountQuery{
+		Sort:  AccountSort{Field: "id"},
+		Limit: defaultAccountPageSize,
+	}
+}
+
+// ParseAccountQuery reads the query string of GET /account
+func ParseAccountQuery(values url.Values) (*AccountQuery, error) {
+	q := DefaultAccountQuery()
+	q.Name = strings.TrimSpace(values.Get("name"))
+
+	if l := values.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxAccountPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxAccountPageSize)
+		}
+		q.Limit = limit
+	}
+
+	if s := values.Get("sort"); s != "" {
+		sort := AccountSort{Field: strings.TrimPrefix(s, "-"), Desc: strings.HasPrefix(s, "-")}
+		if _, ok := accountSortColumns[sort.Field]; !ok {
+			return nil, fmt.Errorf("cannot sort on %q", sort.Field)
+		}
+		q.Sort = sort
+	}
+
+	var err error
+	if q.CreatedFrom, err = parseTimeParam(values, "createdFrom"); err != nil {
+		return nil, err
+	}
+	if q.CreatedTo, err = parseTimeParam(values, "createdTo"); err != nil {
+		return nil, err
+	}
+	if q.MinBalance, err = parseInt64Param(values, "minBalance"); err != nil {
+		return nil, err
+	}
+	if q.MaxBalance, err = parseInt64Param(values, "maxBalance"); err != nil {
+		return nil, err
+	}
+
+	if c := values.Get("cursor"); c != "" {
+		if q.Cursor, err = decodeCursor(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func parseTimeParam(values url.Values, name string) (*time.Time, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+func parseInt64Param(values url.Values, name string) (*int64, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an integer", name)
+	}
+	return &n, nil
+}
+
+func encodeCursor(c *AccountCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*AccountCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := new(AccountCursor)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// cursorFor is the cursor pointing right after acc, in the given sort order
+func cursorFor(acc *Account, sort AccountSort) *AccountCursor {
+	c := &AccountCursor{ID: acc.ID}
+	switch sort.Field {
+	case "createdAt":
+		c.Value = acc.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "balance":
+		c.Value = strconv.FormatInt(acc.Balance, 10)
+	case "lastName":
+		c.Value = acc.LastName
+	}
+	return c
+}
+
+// cursorValue turns the cursor back into something the DB can compare the sort column to
+func cursorValue(c *AccountCursor, sort AccountSort) (any, error) {
+	switch sort.Field {
+	case "createdAt":
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return t, nil
+	case "balance":
+		n, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return n, nil
+	case "lastName":
+		return c.Value, nil
+	}
+	return c.ID, nil
+}
+
+// accountQueryBuilder collects conditions and their arguments, numbering placeholders
+// as it goes so values never end up inside the SQL itself
+type accountQueryBuilder struct {
+	conds []string
+	args  []any
+	// The blind index of a name, nil while names are plaintext
+	nameIndex func(string) []byte
+}
+
+func (b *accountQueryBuilder) arg(v any) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *accountQueryBuilder) where() string {
+	if len(b.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(b.conds, " AND ")
+}
+
+// filters adds the conditions shared by the page and the total count
+func (b *accountQueryBuilder) filters(q *AccountQuery) {
+	if q.Name != "" && b.nameIndex != nil {
+		// Sealed names only match whole, through their blind index. Rows that are still
+		// plaintext are compared the same way, or the results would depend on which
+		// rows the re-encryption got to
+		index, name := b.arg(b.nameIndex(q.Name)), b.arg(strings.ToLower(q.Name))
+		b.conds = append(b.conds, fmt.Sprintf("(firstNameIndex = %s OR lastNameIndex = %s OR lower(firstName) = %s OR lower(lastName) = %s)",
+			index, index, name, name))
+	} else if q.Name != "" {
+		// Prefix match, so the lower(...) text_pattern_ops indexes can be used
+		pattern := b.arg(escapeLike(strings.ToLower(q.Name)) + "%")
+		b.conds = append(b.conds, fmt.Sprintf(`(lower(firstName) LIKE %s ESCAPE '\' OR lower(lastName) LIKE %s ESCAPE '\')`, pattern, pattern))
+	}
+	if q.CreatedFrom != nil {
+		b.conds = append(b.conds, "createdAt >= "+b.arg(*q.CreatedFrom))
+	}
+	if q.CreatedTo != nil {
+		b.conds = append(b.conds, "createdAt < "+b.arg(*q.CreatedTo))
+	}
+	if q.MinBalance != nil {
+		b.conds = append(b.conds, "balance >= "+b.arg(*q.MinBalance))
+	}
+	if q.MaxBalance != nil {
+		b.conds = append(b.conds, "balance <= "+b.arg(*q.MaxBalance))
+	}
+}
+
+// buildAccountCountQuery and buildAccountPageQuery return SQL selecting from Account.
+// nameIndex is the store's blind index, nil when names are plaintext
+func buildAccountCountQuery(q *AccountQuery, nameIndex func(string) []byte) (string, []any) {
+	b := &accountQueryBuilder{nameIndex: nameIndex}
+	b.filters(q)
+	return "SELECT COUNT(*) FROM Account" + b.where(), b.args
+}
+
+func buildAccountPageQuery(columns string, q *AccountQuery, nameIndex func(string) []byte) (string, []any, error) {
+	b := &accountQueryBuilder{nameIndex: nameIndex}
+	b.filters(q)
+
+	column := accountSortColumns[q.Sort.Field]
+	if column == "" {
+		return "", nil, fmt.Errorf("cannot sort on %q", q.Sort.Field)
+	}
+	dir, cmp := "ASC", ">"
+	if q.Sort.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if q.Cursor != nil {
+		v, err := cursorValue(q.Cursor, q.Sort)
+		if err != nil {
+			return "", nil, err
+		}
+		if column == "id" {
+			b.conds = append(b.conds, fmt.Sprintf("id %s %s", cmp, b.arg(q.Cursor.ID)))
+		} else {
+			// The ID breaks ties, otherwise rows sharing a value could be skipped or repeated
+			b.conds = append(b.conds, fmt.Sprintf("(%s, id) %s (%s, %s)", column, cmp, b.arg(v), b.arg(q.Cursor.ID)))
+		}
+	}
+
+	order := fmt.Sprintf(" ORDER BY %s %s", column, dir)
+	if column != "id" {
+		order += ", id " + dir
+	}
+
+	// One extra row tells us whether there's a next page
+	query := fmt.Sprintf("SELECT %s FROM Account%s%s LIMIT %s", columns, b.where(), order, b.arg(q.Limit+1))
+	return query, b.args, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
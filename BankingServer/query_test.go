@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccountQuery(t *testing.T) {
+	values := url.Values{
+		"name":        {" Ada "},
+		"limit":       {"10"},
+		"sort":        {"-balance"},
+		"createdFrom": {"2024-01-01T00:00:00Z"},
+		"minBalance":  {"100"},
+	}
+
+	q, err := ParseAccountQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Name != "Ada" || q.Limit != 10 || q.Sort.Field != "balance" || !q.Sort.Desc {
+		t.Fatalf("unexpected query %+v", q)
+	}
+	if q.CreatedFrom == nil || !q.CreatedFrom.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected createdFrom %v", q.CreatedFrom)
+	}
+	if q.MinBalance == nil || *q.MinBalance != 100 || q.MaxBalance != nil {
+		t.Fatal("balance bounds not parsed")
+	}
+}
+
+func TestParseAccountQueryRejects(t *testing.T) {
+	bad := []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"100000"}},
+		{"sort": {"password"}},
+		{"sort": {"id; DROP TABLE Account"}},
+		{"createdTo": {"yesterday"}},
+		{"maxBalance": {"lots"}},
+		{"cursor": {"%%%"}},
+	}
+	for _, values := range bad {
+		if _, err := ParseAccountQuery(values); err == nil {
+			t.Errorf("expected %v to be rejected", values)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	acc := &Account{ID: 42, Balance: 300, LastName: "Lovelace", CreatedAt: time.Now()}
+
+	for _, field := range []string{"id", "balance", "lastName", "createdAt"} {
+		sort := AccountSort{Field: field}
+		c, err := decodeCursor(encodeCursor(cursorFor(acc, sort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID != 42 {
+			t.Fatalf("cursor lost the ID for %s", field)
+		}
+		if _, err := cursorValue(c, sort); err != nil {
+			t.Fatalf("cursor value for %s: %v", field, err)
+		}
+	}
+}
+
+func TestBuildAccountPageQuery(t *testing.T) {
+	min := int64(10)
+	q := DefaultAccountQuery()
+	q.Name = "o'brien%"
+	q.MinBalance = &min
+	q.Sort = AccountSort{Field: "balance", Desc: true}
+	q.Limit = 20
+	q.Cursor = &AccountCursor{Value: "500", ID: 7}
+
+	query, args, err := buildAccountPageQuery("id", q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `SELECT id FROM Account WHERE (lower(firstName) LIKE $1 ESCAPE '\' OR lower(lastName) LIKE $1 ESCAPE '\') AND balance >= $2` +
+		" AND (balance, id) < ($3, $4) ORDER BY balance DESC, id DESC LIMIT $5"
+	if query != want {
+		t.Fatalf("got  %s\nwant %s", query, want)
+	}
+	if len(args) != 5 || args[0] != `o'brien\%%` || args[2] != int64(500) || args[3] != 7 || args[4] != 21 {
+		t.Fatalf("unexpected args %#v", args)
+	}
+	if strings.Contains(query, "brien") {
+		t.Fatal("a filter value ended up in the SQL")
+	}
+
+	count, countArgs := buildAccountCountQuery(q, nil)
+	if !strings.HasPrefix(count, "SELECT COUNT(*) FROM Account WHERE") || len(countArgs) != 2 {
+		t.Fatalf("count query shouldn't depend on the cursor: %s %v", count, countArgs)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimit is a token bucket: it holds up to Burst requests, and refills at Rate
+// requests per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute is a limit of n requests a minute, all of which may come at once
+func PerMinute(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 60, Burst: n}
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// How long until the next request is allowed, when this one wasn't
+	RetryAfter time.Duration
+	// How long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitBackend is where the buckets live. In memory is fine for one server,
+// several of them need to share theirs somewhere, Redis or the like
+type RateLimitBackend interface {
+	// Take takes a token from the bucket under key, if there's one to take
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// Limits for the routes that need them, by method and route template.
+// Everything else gets defaultRateLimit
+var defaultRouteLimits = map[string]RateLimit{
+	// Creating accounts is cheap for a client and not for us
+	"POST /v1/account":  PerMinute(5),
+	"POST /v1/transfer": PerMinute(30),
+	// Every request to these checks a token, which is what a brute force would go for
+	"GET /v1/account/{id}":          PerMinute(60),
+	"POST /v1/account/{id}/deposit": PerMinute(30),
+	// A million codes, and one of them always right
+	"POST /v1/account/{id}/totp/verify": PerMinute(5),
+}
+
+var defaultRateLimit = RateLimit{Rate: 10, Burst: 20}
+
+// RateLimiter limits requests per route, by client IP and, for requests carrying a
+// valid token, by account too. The account limit is what keeps a client from
+// getting around the IP one by spreading out over many addresses
+type RateLimiter struct {
+	backend      RateLimitBackend
+	routeLimits  map[string]RateLimit
+	defaultLimit RateLimit
+}
+
+func NewRateLimiter(backend RateLimitBackend, routeLimits map[string]RateLimit, defaultLimit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		backend:      backend,
+		routeLimits:  routeLimits,
+		defaultLimit: defaultLimit,
+	}
+}
+
+// limitFor is the limit of the route r matched, and its name
+func (rl *RateLimiter) limitFor(r *http.Request) (string, RateLimit) {
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+	name := r.Method + " " + route
+
+	if limit, ok := rl.routeLimits[name]; ok {
+		return name, limit
+	}
+	return name, rl.defaultLimit
+}
+
+// Middleware is meant for router.Use, so routes are matched by the time it runs
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, limit := rl.limitFor(r)
+
+		keys := []string{route + "|ip:" + clientIP(r)}
+		if sub, ok := tokenSubject(r); ok {
+			keys = append(keys, fmt.Sprintf("%s|sub:%d", route, sub))
+		}
+		if key := callerFrom(r.Context()).APIKey; key != nil {
+			keys = append(keys, route+"|key:"+key.ID)
+		}
+
+		// What the client gets told about is whichever bucket is closest to empty
+		var tightest *RateLimitResult
+		for _, key := range keys {
+			res, err := rl.backend.Take(r.Context(), key, limit)
+			if err != nil {
+				// The limiter being down is no reason for the API to be
+				requestLogger(r.Context()).Warn("rate limiter unavailable, letting the request through", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if tightest == nil || !res.Allowed || (tightest.Allowed && res.Remaining < tightest.Remaining) {
+				tightest = &res
+			}
+			if !res.Allowed {
+				break
+			}
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+
+		if !tightest.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+			WriteJSON(w, http.StatusTooManyRequests, apiError{ErrorMsg: "rate limit exceeded"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitBackend keeps the buckets in this process
+type MemoryRateLimitBackend struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// Full buckets are the same as no bucket, they're swept out once in a while
+const rateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimitBackend() *MemoryRateLimitBackend {
+	return &MemoryRateLimitBackend{
+		buckets:   make(map[string]*tokenBucket),
+		now:       time.Now,
+		lastSweep: time.Now(),
+	}
+}
+
+func (b *MemoryRateLimitBackend) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Sub(b.lastSweep) >= rateLimitSweepInterval {
+		b.sweep(now)
+	}
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.limit = limit
+	bucket.refill(now)
+
+	res := RateLimitResult{Allowed: bucket.tokens >= 1}
+	if res.Allowed {
+		bucket.tokens--
+	} else {
+		res.RetryAfter = secondsToDuration((1 - bucket.tokens) / limit.Rate)
+	}
+	res.Remaining = int(bucket.tokens)
+	res.Reset = secondsToDuration((float64(limit.Burst) - bucket.tokens) / limit.Rate)
+
+	return res, nil
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens = t.tokensAt(now)
+	t.last = now
+}
+
+func (t *tokenBucket) tokensAt(now time.Time) float64 {
+	elapsed := now.Sub(t.last).Seconds()
+	return math.Min(float64(t.limit.Burst), t.tokens+elapsed*t.limit.Rate)
+}
+
+// sweep drops the buckets that have been left alone long enough to be full again
+func (b *MemoryRateLimitBackend) sweep(now time.Time) {
+	for key, bucket := range b.buckets {
+		if bucket.tokensAt(now) >= float64(bucket.limit.Burst) {
+			delete(b.buckets, key)
+		}
+	}
+	b.lastSweep = now
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
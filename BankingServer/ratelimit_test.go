@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMemoryRateLimitBackend(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryRateLimitBackend()
+	now := time.Now()
+	backend.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := backend.Take(ctx, "key", limit)
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("expected to be allowed with %d left, got %+v", i, res)
+		}
+	}
+
+	res, _ := backend.Take(ctx, "key", limit)
+	if res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("expected to be limited for a second, got %+v", res)
+	}
+	if other, _ := backend.Take(ctx, "other", limit); !other.Allowed {
+		t.Fatal("buckets aren't separate")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if res, _ := backend.Take(ctx, "key", limit); !res.Allowed {
+		t.Fatal("bucket didn't refill")
+	}
+
+	// Untouched long enough, the buckets are full again and can go
+	now = now.Add(rateLimitSweepInterval)
+	backend.Take(ctx, "key", limit)
+	if len(backend.buckets) != 1 {
+		t.Fatalf("expected full buckets to be swept, %d left", len(backend.buckets))
+	}
+}
+
+func newRateLimitedRouter(limiter *RateLimiter) *mux.Router {
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/account", ok).Methods("POST")
+	router.HandleFunc("/account/{id}", ok).Methods("GET")
+	router.Use(limiter.Middleware)
+
+	return router
+}
+
+func TestRateLimiterByRouteAndIP(t *testing.T) {
+	limiter := NewRateLimiter(NewMemoryRateLimitBackend(), map[string]RateLimit{
+		"POST /account": PerMinute(2),
+	}, RateLimit{Rate: 10, Burst: 10})
+	router := newRateLimitedRouter(limiter)
+
+	send := func(method, target, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := send("POST", "/account", "192.0.2.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d limited too early: %d", i, rec.Code)
+		}
+	}
+	rec := send("POST", "/account", "192.0.2.1:1001")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "30" || rec.Header().Get("X-RateLimit-Limit") != "2" ||
+		rec.Header().Get("X-RateLimit-Remaining") != "0" || rec.Header().Get("X-RateLimit-Reset") != "60" {
+		t.Fatalf("unexpected headers %v", rec.Header())
+	}
+
+	// Other clients and other routes have buckets of their own
+	if rec := send("POST", "/account", "192.0.2.2:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("another IP was limited: %d", rec.Code)
+	}
+	rec = send("GET", "/account/1", "192.0.2.1:1000")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "10" {
+		t.Fatalf("another route was limited: %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestRateLimiterBySubject(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	token, err := createJWT(NewAccount("Ada", "Lovelace"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := NewRateLimiter(NewMemoryRateLimitBackend(), nil, RateLimit{Rate: 1, Burst: 3})
+	router := newRateLimitedRouter(limiter)
+
+	// A new address for every request doesn't get around the account's bucket
+	var codes []int
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/account/7", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1000", i+1)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+
+	if codes[2] != http.StatusOK || codes[3] != http.StatusTooManyRequests {
+		t.Fatalf("expected the 4th request to be limited, got %v", codes)
+	}
+}
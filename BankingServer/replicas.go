@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reads go to replicas and writes to the primary. Replicas lag behind though, so a
+// client that just wrote something reads from the primary for a while afterwards,
+// or it might not see its own write. Which client a request is from is put in its
+// context by the API, see WithReadSession.
+
+const (
+	// How long a client's reads stay on the primary after it wrote
+	defaultStickyWindow  = 5 * time.Second
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+)
+
+type (
+	readSessionKey struct{}
+	readPrimaryKey struct{}
+)
+
+// WithReadSession tags ctx with who's asking, so their reads can follow their writes
+func WithReadSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, readSessionKey{}, session)
+}
+
+// ReadFromPrimary sends the reads made with ctx to the primary, for callers that
+// hold on to what they read and can't have it lag behind
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey{}, true)
+}
+
+func readSession(ctx context.Context) string {
+	session, _ := ctx.Value(readSessionKey{}).(string)
+	return session
+}
+
+type replica struct {
+	store   *sqlStore
+	healthy atomic.Bool
+}
+
+// replicaSet picks where each read goes and keeps an eye on the replicas
+type replicaSet struct {
+	primary  *sqlStore
+	replicas []*replica
+	// Round robin over the healthy replicas
+	next atomic.Uint64
+
+	window time.Duration
+	now    func() time.Time
+	mu     sync.Mutex
+	// Sessions reading from the primary, and until when
+	sticky map[string]time.Time
+
+	quitch chan struct{}
+	logger *slog.Logger
+}
+
+func newReplicaSet(primary *sqlStore, replicas []*sqlStore, logger *slog.Logger) *replicaSet {
+	rs := &replicaSet{
+		logger:  logger,
+		primary: primary,
+		window:  defaultStickyWindow,
+		now:     time.Now,
+		sticky:  make(map[string]time.Time),
+		quitch:  make(chan struct{}),
+	}
+	for _, store := range replicas {
+		r := &replica{store: store}
+		// Innocent until proven guilty, the first check comes soon enough
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+
+	return rs
+}
+
+func (rs *replicaSet) Start() {
+	if len(rs.replicas) > 0 {
+		go rs.loop()
+	}
+}
+
+func (rs *replicaSet) Stop() {
+	close(rs.quitch)
+}
+
+func (rs *replicaSet) loop() {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rs.checkReplicas()
+			rs.forgetSessions()
+		case <-rs.quitch:
+			return
+		}
+	}
+}
+
+func (rs *replicaSet) checkReplicas() {
+	for i, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err := r.store.db.PingContext(ctx)
+		cancel()
+
+		healthy := err == nil
+		if r.healthy.Swap(healthy) != healthy {
+			if healthy {
+				rs.logger.Info("replica is back", "replica", i)
+			} else {
+				rs.logger.Warn("replica is down", "replica", i, "err", err)
+			}
+		}
+	}
+}
+
+// forgetSessions drops the sessions whose window is over, so the map doesn't grow forever
+func (rs *replicaSet) forgetSessions() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := rs.now()
+	for session, until := range rs.sticky {
+		if !now.Before(until) {
+			delete(rs.sticky, session)
+		}
+	}
+}
+
+// wrote keeps the session on the primary for the next little while
+func (rs *replicaSet) wrote(ctx context.Context) {
+	session := readSession(ctx)
+	if session == "" || len(rs.replicas) == 0 {
+		return
+	}
+
+	rs.mu.Lock()
+	rs.sticky[session] = rs.now().Add(rs.window)
+	rs.mu.Unlock()
+}
+
+func (rs *replicaSet) isSticky(ctx context.Context) bool {
+	session := readSession(ctx)
+	if session == "" {
+		return false
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	until, ok := rs.sticky[session]
+	return ok && rs.now().Before(until)
+}
+
+// reader is the replica this read should go to, nil meaning the primary
+func (rs *replicaSet) reader(ctx context.Context) *replica {
+	if primary, _ := ctx.Value(readPrimaryKey{}).(bool); primary {
+		return nil
+	}
+	if len(rs.replicas) == 0 || rs.isSticky(ctx) {
+		return nil
+	}
+
+	start := rs.next.Add(1)
+	for i := range rs.replicas {
+		r := rs.replicas[(start+uint64(i))%uint64(len(rs.replicas))]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+
+	// Every replica is down, the primary can take it
+	return nil
+}
+
+// read runs fn on a replica if it can, on the primary otherwise. A replica that
+// can't be reached is taken out until the health check says it's back, and the
+// read is tried again on the primary
+func (rs *replicaSet) read(ctx context.Context, fn func(*sqlStore) error) error {
+	r := rs.reader(ctx)
+	if r == nil {
+		return fn(rs.primary)
+	}
+
+	err := fn(r.store)
+	if err != nil && isStoreUnavailable(err) && ctx.Err() == nil {
+		r.healthy.Store(false)
+		requestLogger(ctx).Warn("replica read failed, falling back to the primary", "err", err)
+		return fn(rs.primary)
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Separate in-memory SQLite databases stand in for the primary and the replicas.
+// Nothing replicates between them, which makes it easy to tell who served a read
+func newTestSQLStore(t *testing.T) *sqlStore {
+	t.Helper()
+	store, err := NewSQLiteStore(":memory:", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	if err := store.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return store.sqlStore
+}
+
+// readsPrimary tells whether a read found an account that only exists on the primary
+func readsPrimary(t *testing.T, rs *replicaSet, ctx context.Context, id int) bool {
+	t.Helper()
+	err := rs.read(ctx, func(s *sqlStore) error {
+		_, err := s.GetAccountByID(ctx, id)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		t.Fatal(err)
+	}
+
+	return err == nil
+}
+
+func TestReplicaSetReadYourWrites(t *testing.T) {
+	primary := newTestSQLStore(t)
+	rs := newReplicaSet(primary, []*sqlStore{newTestSQLStore(t), newTestSQLStore(t)}, slog.Default())
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+
+	id, err := primary.CreateAccount(context.Background(), NewAccount("Ada", "Lovelace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ada := WithReadSession(context.Background(), "account:1")
+	grace := WithReadSession(context.Background(), "account:2")
+	if readsPrimary(t, rs, ada, id) {
+		t.Fatal("read went to the primary without a write")
+	}
+
+	rs.wrote(ada)
+	if !readsPrimary(t, rs, ada, id) {
+		t.Fatal("read went to a replica right after a write")
+	}
+	if readsPrimary(t, rs, grace, id) {
+		t.Fatal("someone else's write moved this session to the primary")
+	}
+
+	if !readsPrimary(t, rs, ReadFromPrimary(grace), id) {
+		t.Fatal("read asked for the primary but went to a replica")
+	}
+
+	now = now.Add(rs.window)
+	if readsPrimary(t, rs, ada, id) {
+		t.Fatal("session stayed on the primary after its window")
+	}
+	rs.forgetSessions()
+	if len(rs.sticky) != 0 {
+		t.Fatal("expired session wasn't forgotten")
+	}
+}
+
+func TestReplicaSetFailover(t *testing.T) {
+	primary := newTestSQLStore(t)
+	down := newTestSQLStore(t)
+	rs := newReplicaSet(primary, []*sqlStore{down}, slog.Default())
+	id, _ := primary.CreateAccount(context.Background(), NewAccount("Ada", "Lovelace"))
+
+	// The failed read is retried on the primary, and the replica taken out
+	ctx := context.Background()
+	var found bool
+	err := rs.read(ctx, func(s *sqlStore) error {
+		if s == down {
+			return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		_, err := s.GetAccountByID(ctx, id)
+		found = err == nil
+		return err
+	})
+	if err != nil || !found {
+		t.Fatalf("read wasn't retried on the primary: %v", err)
+	}
+	if rs.replicas[0].healthy.Load() {
+		t.Fatal("unreachable replica still marked healthy")
+	}
+	if rs.reader(context.Background()) != nil {
+		t.Fatal("read sent to an unhealthy replica")
+	}
+
+	// The health check sees it too, and would bring it back if it answered again
+	down.db.Close()
+	rs.replicas[0].healthy.Store(true)
+	rs.checkReplicas()
+	if rs.replicas[0].healthy.Load() {
+		t.Fatal("health check missed the replica being down")
+	}
+}
+
+func TestWithReadSession(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	token, err := createJWT(NewAccount("Ada", "Lovelace"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var session string
+	handler := withReadSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session = readSession(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if session != "addr:192.0.2.1" {
+		t.Fatalf("unexpected anonymous session %q", session)
+	}
+
+	req.Header.Set("Authorization", token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if session != "account:7" {
+		t.Fatalf("unexpected session %q", session)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/charm-113c/bankingserver/client"
+)
+
+// The client package against the real server
+func newSDKServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	t.Setenv("JWT_TOKEN", "test-secret")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := NewMemoryStore()
+	s := newAPIServer("", store, nil, store, store, store, nil, logger, nil)
+	router := s.routes()
+	router.Use(s.limiter.Middleware)
+
+	server := httptest.NewServer(withRequestLogging(logger, router))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Deposits take one of these
+func newAdminClient(serverURL string) *client.Client {
+	token, _ := createAdminJWT("ops", time.Hour)
+	return client.New(serverURL, client.WithToken(token), client.WithBackoff(time.Millisecond))
+}
+
+// steppedUp is the account's token as verifying a TOTP code just now steps it up,
+// which transfers and closing the account take
+func steppedUp(id int) string {
+	token, _ := createStepUpJWT(id, time.Now())
+	return token
+}
+
+func TestClientSDK(t *testing.T) {
+	ctx := context.Background()
+	server := newSDKServer(t)
+	c := client.New(server.URL, client.WithBackoff(time.Millisecond))
+
+	adaToken, err := c.CreateAccount(ctx, "Ada", "Lovelace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alanToken, err := c.CreateAccount(ctx, "Alan", "Turing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ada, err := c.Login(ctx, adaToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ada.FirstName != "Ada" || c.AccountID() != ada.ID {
+		t.Fatalf("logged in as %+v", ada)
+	}
+	if _, err := c.Login(ctx, "not-a-token"); err == nil {
+		t.Fatal("expected a bad token to be refused")
+	}
+
+	if err := c.Deposit(ctx, ada.ID, 100); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected an owner's deposit to be refused, got %v", err)
+	}
+	if err := newAdminClient(server.URL).Deposit(ctx, ada.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	alan := client.New(server.URL)
+	alanAcc, err := alan.Login(ctx, alanToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Transfer(ctx, ada.ID, alanAcc.ID, 40); !errors.Is(err, client.ErrStepUpRequired) {
+		t.Fatalf("expected a step-up to be required, got %v", err)
+	}
+	if _, err := c.Login(ctx, steppedUp(ada.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Transfer(ctx, ada.ID, alanAcc.ID, 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Transfer(ctx, ada.ID, alanAcc.ID, 1000); !errors.Is(err, client.ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+
+	got, err := c.GetAccount(ctx, ada.ID)
+	if err != nil || got.Balance != 60 {
+		t.Fatalf("expected 60 left, got %+v, %v", got, err)
+	}
+	// Ada's token doesn't open Alan's account
+	if _, err := c.GetAccount(ctx, alanAcc.ID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+
+	page, err := c.ListAccounts(ctx, client.ListOptions{Limit: 1, Sort: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Accounts) != 1 || page.Accounts[0].ID != ada.ID || page.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	page, err = c.ListAccounts(ctx, client.ListOptions{Limit: 1, Sort: "id", Cursor: page.NextCursor})
+	if err != nil || len(page.Accounts) != 1 || page.Accounts[0].ID != alanAcc.ID || page.NextCursor != "" {
+		t.Fatalf("unexpected second page %+v, %v", page, err)
+	}
+
+	alan.Login(ctx, steppedUp(alanAcc.ID))
+	if err := alan.DeleteAccount(ctx, alanAcc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alan.GetAccount(ctx, alanAcc.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected the account gone, got %v", err)
+	}
+}
+
+func TestClientSDKRetriedTransferHappensOnce(t *testing.T) {
+	ctx := context.Background()
+	server := newSDKServer(t)
+	c := client.New(server.URL)
+
+	adaToken, _ := c.CreateAccount(ctx, "Ada", "Lovelace")
+	alanToken, _ := c.CreateAccount(ctx, "Alan", "Turing")
+	alan, _ := client.New(server.URL).Login(ctx, alanToken)
+	ada, err := c.Login(ctx, adaToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Login(ctx, steppedUp(ada.ID))
+	newAdminClient(server.URL).Deposit(ctx, ada.ID, 100)
+
+	// A caller that never heard back and sends the transfer again
+	retry := client.WithIdempotencyKey(ctx, "transfer-1")
+	for i := 0; i < 3; i++ {
+		if err := c.Transfer(retry, ada.ID, alan.ID, 30); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, _ := c.GetAccount(ctx, ada.ID)
+	if got.Balance != 70 {
+		t.Fatalf("expected one transfer, balance is %d", got.Balance)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// The services are where the rules live: what a valid request is, who may do what,
+// and which events a change comes with. The REST handlers, the gRPC service and
+// bankctl are only ways in, they parse, call a service, and format what comes back.
+// Storage is left with keeping the data, and no opinion about it
+
+// Caller is who a service call is made for. Whichever transport took the request
+// puts it in the context, from the token it came with
+type Caller struct {
+	// The account the token is for, 0 for none
+	AccountID int
+	Admin     bool
+	// When the token was stepped up with a TOTP code, zero if it never was
+	StepUpAt time.Time
+	// The key the call came with, when it came with one rather than a token
+	APIKey *APIKey
+}
+
+type callerKey struct{}
+
+func WithCaller(ctx context.Context, caller Caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func callerFrom(ctx context.Context) Caller {
+	caller, _ := ctx.Value(callerKey{}).(Caller)
+	return caller
+}
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// invalidRequestError is a request that makes no sense, whichever way it came in
+type invalidRequestError struct {
+	msg string
+}
+
+func (e *invalidRequestError) Error() string {
+	return e.msg
+}
+
+func invalidRequest(msg string) error {
+	return &invalidRequestError{msg: msg}
+}
+
+// authorizeAccount lets through the account's owner, and admins
+func authorizeAccount(ctx context.Context, id int) error {
+	caller := callerFrom(ctx)
+	if caller.Admin || (caller.AccountID != 0 && caller.AccountID == id) {
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// authorizeAccountFor is authorizeAccount, and also lets through an API key that
+// has perm on the account. Anything a key may do goes through here, the rest is
+// only ever the owner's
+func authorizeAccountFor(ctx context.Context, id int, perm APIKeyPermission) error {
+	if key := callerFrom(ctx).APIKey; key != nil {
+		if key.Allows(id, perm) {
+			return nil
+		}
+		return ErrPermissionDenied
+	}
+	return authorizeAccount(ctx, id)
+}
+
+func authorizeAdmin(ctx context.Context) error {
+	if !callerFrom(ctx).Admin {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+type AccountService struct {
+	store      Storage
+	statements StatementStore
+}
+
+func NewAccountService(store Storage, statements StatementStore) *AccountService {
+	return &AccountService{store: store, statements: statements}
+}
+
+// How many account numbers Open draws before giving up on finding a free one
+const accountNumberAttempts = 5
+
+// Open creates an account, and the token that goes with it. Anyone can open one
+func (s *AccountService) Open(ctx context.Context, firstName, lastName string) (*Account, string, error) {
+	firstName, lastName = strings.TrimSpace(firstName), strings.TrimSpace(lastName)
+	if firstName == "" || lastName == "" {
+		return nil, "", invalidRequest("first and last name are required")
+	}
+
+	account := NewAccount(firstName, lastName)
+	var err error
+	// Account numbers are random, so one can be taken already. Another try is
+	// another number
+	for attempt := 0; attempt < accountNumberAttempts; attempt++ {
+		if attempt > 0 {
+			account.AccNumber = newAccountNumber()
+		}
+		err = s.store.WithTx(ctx, func(tx Storage) error {
+			id, err := tx.CreateAccount(ctx, account)
+			if err != nil {
+				return err
+			}
+			account.ID = id
+
+			return tx.RecordEvent(ctx, EventAccountCreated, id, AccountCreatedPayload{
+				ID:     id,
+				Number: account.AccNumber,
+				Status: account.Status,
+			})
+		})
+		if !errors.Is(err, ErrDuplicateAccountNumber) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := createJWT(account, account.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return account, token, nil
+}
+
+func (s *AccountService) Get(ctx context.Context, id int) (*Account, error) {
+	if err := authorizeAccountFor(ctx, id, APIKeyRead); err != nil {
+		return nil, err
+	}
+
+	return s.store.GetAccountByID(ctx, id)
+}
+
+// List is open to anyone, like GET /account always was
+func (s *AccountService) List(ctx context.Context, query *AccountQuery) (*AccountPage, error) {
+	page, err := s.store.GetAccounts(ctx, query)
+	if errors.Is(err, ErrInvalidCursor) || errors.Is(err, ErrSortOnEncrypted) {
+		return nil, invalidRequest(err.Error())
+	}
+
+	return page, err
+}
+
+// Close deletes the account. Closing one that's already gone isn't an error, but
+// it isn't an event either
+func (s *AccountService) Close(ctx context.Context, id int) error {
+	if err := authorizeAccount(ctx, id); err != nil {
+		return err
+	}
+
+	return s.store.WithTx(ctx, func(tx Storage) error {
+		_, err := tx.GetAccountByID(ctx, id)
+		if errors.Is(err, ErrAccountNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.DeleteAccount(ctx, id); err != nil {
+			return err
+		}
+		return tx.RecordEvent(ctx, EventAccountDeleted, id, AccountDeletedPayload{ID: id})
+	})
+}
+
+// SetStatus freezes or unfreezes an account, which only admins get to do
+func (s *AccountService) SetStatus(ctx context.Context, id int, status AccountStatus) (*Account, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if status != AccountActive && status != AccountFrozen {
+		return nil, invalidRequest("unknown account status")
+	}
+
+	var account *Account
+	err := s.store.WithTx(ctx, func(tx Storage) (err error) {
+		if err = tx.SetAccountStatus(ctx, id, status); err != nil {
+			return err
+		}
+		if err = tx.RecordEvent(ctx, EventAccountStatusChanged, id, AccountStatusChangedPayload{ID: id, Status: status}); err != nil {
+			return err
+		}
+		account, err = tx.GetAccountByID(ctx, id)
+		return err
+	})
+
+	return account, err
+}
+
+func (s *AccountService) Statement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	if err := authorizeAccountFor(ctx, id, APIKeyRead); err != nil {
+		return nil, err
+	}
+
+	return BuildStatement(ctx, s.statements, id, from, to)
+}
+
+// TransferService is everything that moves money
+type TransferService struct {
+	store Storage
+}
+
+func NewTransferService(store Storage) *TransferService {
+	return &TransferService{store: store}
+}
+
+// Transfer takes the sender's say-so, an admin's, or that of a key that may
+// transfer from the sender
+func (s *TransferService) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	if amount <= 0 {
+		return invalidRequest("amount must be positive")
+	}
+	if fromID == toID {
+		return invalidRequest("cannot transfer to the same account")
+	}
+	if err := authorizeAccountFor(ctx, fromID, APIKeyTransfer); err != nil {
+		return err
+	}
+
+	return s.store.WithTx(ctx, func(tx Storage) error {
+		if err := tx.Transfer(ctx, fromID, toID, amount); err != nil {
+			return err
+		}
+
+		// Still in the transaction, so these are the balances the transfer left
+		from, err := tx.GetAccountByID(ctx, fromID)
+		if err != nil {
+			return err
+		}
+		to, err := tx.GetAccountByID(ctx, toID)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordEvent(ctx, EventTransferCompleted, fromID, TransferCompletedPayload{
+			FromAccount: fromID,
+			ToAccount:   toID,
+			Amount:      amount,
+			FromBalance: from.Balance,
+			ToBalance:   to.Balance,
+		})
+	})
+}
+
+func (s *TransferService) Deposit(ctx context.Context, id int, amount int64) error {
+	if amount <= 0 {
+		return invalidRequest("amount must be positive")
+	}
+	// Deposits are money coming in from outside, which only an admin can vouch for.
+	// An owner crediting their own account would be making money
+	if err := authorizeAdmin(ctx); err != nil {
+		return err
+	}
+
+	return s.store.WithTx(ctx, func(tx Storage) error {
+		if err := tx.Deposit(ctx, id, amount); err != nil {
+			return err
+		}
+
+		acc, err := tx.GetAccountByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return tx.RecordEvent(ctx, EventDepositCompleted, id, DepositCompletedPayload{
+			AccountID: id,
+			Amount:    amount,
+			Balance:   acc.Balance,
+		})
+	})
+}
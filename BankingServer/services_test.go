@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func pendingEvents(t *testing.T, store *MemoryStore) []*Event {
+	t.Helper()
+	events, err := store.FetchPendingEvents(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func TestAccountService(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	ctx := context.Background()
+	store := NewMemoryStore()
+	accounts := NewAccountService(store, store)
+
+	if _, _, err := accounts.Open(ctx, " ", "Lovelace"); !errors.As(err, new(*invalidRequestError)) {
+		t.Fatalf("expected names to be required, got %v", err)
+	}
+	ada, token, err := accounts.Open(ctx, "Ada", "Lovelace")
+	if err != nil || ada.ID != 1 || token == "" {
+		t.Fatalf("unexpected account %+v, %v", ada, err)
+	}
+	events := pendingEvents(t, store)
+	if len(events) != 1 || events[0].Type != EventAccountCreated {
+		t.Fatalf("expected the account's event, got %+v", events)
+	}
+	if strings.Contains(string(events[0].Payload), "Lovelace") {
+		t.Fatalf("expected no names in the event, got %s", events[0].Payload)
+	}
+
+	owner := WithCaller(ctx, Caller{AccountID: ada.ID})
+	stranger := WithCaller(ctx, Caller{AccountID: 2})
+	admin := WithCaller(ctx, Caller{Admin: true})
+
+	if _, err := accounts.Get(owner, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []context.Context{ctx, stranger} {
+		if _, err := accounts.Get(c, ada.ID); !errors.Is(err, ErrPermissionDenied) {
+			t.Fatalf("expected permission denied, got %v", err)
+		}
+	}
+
+	// Freezing is for admins, not even the owner gets to
+	if _, err := accounts.SetStatus(owner, ada.ID, AccountFrozen); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	frozen, err := accounts.SetStatus(admin, ada.ID, AccountFrozen)
+	if err != nil || frozen.Status != AccountFrozen {
+		t.Fatalf("unexpected account %+v, %v", frozen, err)
+	}
+
+	if err := accounts.Close(owner, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Already gone, which is fine, but nothing happened
+	if err := accounts.Close(owner, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+	events = pendingEvents(t, store)
+	if len(events) != 3 || events[1].Type != EventAccountStatusChanged || events[2].Type != EventAccountDeleted {
+		t.Fatalf("unexpected events %+v", events)
+	}
+}
+
+func TestAccountServiceRetriesTakenAccountNumbers(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	numbers, random := []int64{7, 7, 7, 8}, newAccountNumber
+	t.Cleanup(func() { newAccountNumber = random })
+	newAccountNumber = func() int64 {
+		n := numbers[0]
+		numbers = numbers[1:]
+		return n
+	}
+	ctx := context.Background()
+	accounts := NewAccountService(NewMemoryStore(), nil)
+
+	accounts.Open(ctx, "Ada", "Lovelace")
+	alan, _, err := accounts.Open(ctx, "Alan", "Turing")
+	if err != nil || alan.AccNumber != 8 {
+		t.Fatalf("expected the next free number, got %+v, %v", alan, err)
+	}
+}
+
+func TestTransferService(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	ctx := context.Background()
+	store := NewMemoryStore()
+	accounts := NewAccountService(store, store)
+	transfers := NewTransferService(store)
+
+	ada, _, _ := accounts.Open(ctx, "Ada", "Lovelace")
+	alan, _, _ := accounts.Open(ctx, "Alan", "Turing")
+	owner := WithCaller(ctx, Caller{AccountID: ada.ID})
+	admin := WithCaller(ctx, Caller{Admin: true})
+
+	if err := transfers.Deposit(admin, ada.ID, 0); !errors.As(err, new(*invalidRequestError)) {
+		t.Fatalf("expected the amount refused, got %v", err)
+	}
+	// Money from nowhere, if owners could
+	if err := transfers.Deposit(owner, ada.ID, 100); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	if err := transfers.Deposit(admin, ada.ID, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ctx      context.Context
+		from, to int
+		amount   int64
+		want     error
+	}{
+		{owner, ada.ID, alan.ID, -5, nil},
+		{owner, ada.ID, ada.ID, 5, nil},
+		{owner, alan.ID, ada.ID, 5, ErrPermissionDenied},
+		{ctx, ada.ID, alan.ID, 5, ErrPermissionDenied},
+		{owner, ada.ID, alan.ID, 500, ErrInsufficientFunds},
+		{owner, ada.ID, 99, 5, ErrAccountNotFound},
+	}
+	for _, c := range cases {
+		err := transfers.Transfer(c.ctx, c.from, c.to, c.amount)
+		if c.want == nil && !errors.As(err, new(*invalidRequestError)) || c.want != nil && !errors.Is(err, c.want) {
+			t.Errorf("transfer of %d from %d to %d: expected %v, got %v", c.amount, c.from, c.to, c.want, err)
+		}
+	}
+	// Two accounts and a deposit, the failed transfers didn't get as far as an event
+	before := len(pendingEvents(t, store))
+	if before != 3 {
+		t.Fatalf("expected 3 events, got %d", before)
+	}
+
+	if err := transfers.Transfer(owner, ada.ID, alan.ID, 30); err != nil {
+		t.Fatal(err)
+	}
+	events := pendingEvents(t, store)
+	if len(events) != before+1 {
+		t.Fatalf("expected one more event, got %d more", len(events)-before)
+	}
+	var payload TransferCompletedPayload
+	json.Unmarshal(events[len(events)-1].Payload, &payload)
+	if payload.Amount != 30 || payload.FromBalance != 70 || payload.ToBalance != 30 {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+
+	// Admins move anyone's money
+	if err := transfers.Transfer(WithCaller(ctx, Caller{Admin: true}), alan.ID, ada.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+}
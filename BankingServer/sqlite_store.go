@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	sqlite "github.com/glebarez/go-sqlite"
+)
+
+// SQLiteStore is the same store on a single file, for demos and single-node deployments.
+// All the queries are shared with PostgresStore, only the schema and a few driver
+// quirks are SQLite's own.
+type SQLiteStore struct {
+	*sqlStore
+}
+
+var sqliteDialect = &sqlDialect{
+	name:            "sqlite",
+	retryable:       isSQLiteRetryable,
+	uniqueViolation: isSQLiteUniqueViolation,
+	wrap: func(q queryer) queryer {
+		return sqliteQueryer{q}
+	},
+}
+
+// NewSQLiteStore opens (or creates) the database at path. ":memory:" works too,
+// and is what the tests use
+func NewSQLiteStore(path string, logger *slog.Logger) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only ever has one writer. A single connection queues everyone up
+	// instead of having them fail with SQLITE_BUSY, and it's also the only way
+	// for an in-memory database to be the same database for everyone
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	logger.Info("SQLite DB is online", "path", path)
+
+	return &SQLiteStore{
+		sqlStore: newSQLStore(db, sqliteDialect),
+	}, nil
+}
+
+// Same tables as Postgres, in SQLite's words.
+// AUTOINCREMENT keeps IDs from ever being reused, like SERIAL
+func (st *SQLiteStore) Init(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS Account (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		firstName VARCHAR(50),
+		lastName VARCHAR(50),
+		accNumber INTEGER NOT NULL UNIQUE,
+		balance INTEGER,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		createdAt TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS account_createdat_idx ON Account (createdAt, id);
+	CREATE INDEX IF NOT EXISTS account_balance_idx ON Account (balance, id);
+	CREATE INDEX IF NOT EXISTS account_lastname_idx ON Account (lastName, id);
+
+	CREATE TABLE IF NOT EXISTS Outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		eventType VARCHAR(50) NOT NULL,
+		aggregateID INTEGER NOT NULL,
+		payload BLOB NOT NULL,
+		createdAt TIMESTAMP NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		nextAttemptAt TIMESTAMP NOT NULL,
+		publishedAt TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS outbox_pending_idx ON Outbox (nextAttemptAt, id) WHERE publishedAt IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_createdat_idx ON Outbox (createdAt, id);
+
+	CREATE TABLE IF NOT EXISTS Webhook (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		accountID INTEGER NOT NULL REFERENCES Account (id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		createdAt TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS WebhookDelivery (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhookID INTEGER NOT NULL REFERENCES Webhook (id) ON DELETE CASCADE,
+		accountID INTEGER NOT NULL,
+		eventID INTEGER NOT NULL,
+		payload BLOB NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		lastStatusCode INTEGER NOT NULL DEFAULT 0,
+		lastError TEXT NOT NULL DEFAULT '',
+		nextAttemptAt TIMESTAMP NOT NULL,
+		createdAt TIMESTAMP NOT NULL,
+		deliveredAt TIMESTAMP,
+		UNIQUE (webhookID, eventID)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON WebhookDelivery (nextAttemptAt, id) WHERE status = 'pending';
+
+	CREATE TABLE IF NOT EXISTS TOTP (
+		accountID INTEGER PRIMARY KEY REFERENCES Account (id) ON DELETE CASCADE,
+		secret BLOB NOT NULL,
+		confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+		lastCounter INTEGER NOT NULL DEFAULT 0,
+		createdAt TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS APIKey (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		accountIDs TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		createdAt TIMESTAMP NOT NULL,
+		expiresAt TIMESTAMP NOT NULL,
+		lastUsedAt TIMESTAMP,
+		revokedAt TIMESTAMP
+	)`
+
+	if _, err := st.q.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// Databases from before accounts could be frozen. SQLite has no ADD COLUMN IF NOT EXISTS
+	var hasStatus bool
+	err := st.q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pragma_table_info('Account') WHERE name = 'status')").Scan(&hasStatus)
+	if err != nil || hasStatus {
+		return err
+	}
+	_, err = st.q.ExecContext(ctx, "ALTER TABLE Account ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'active'")
+	return err
+}
+
+// SQLITE_BUSY and SQLITE_LOCKED: someone else held the lock for longer than busy_timeout
+func isSQLiteRetryable(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	// Extended result codes keep the primary code in the low byte
+	code := sqliteErr.Code() & 0xff
+	return code == 5 || code == 6
+}
+
+// SQLITE_CONSTRAINT_UNIQUE and SQLITE_CONSTRAINT_PRIMARYKEY
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	code := sqliteErr.Code()
+	return code == 2067 || code == 1555
+}
+
+// SQLite has no timestamp type, timestamps are text and compared as text.
+// The driver writes them with as many fractional digits as they happen to need,
+// which doesn't sort, so every time goes in with a fixed width instead
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+type sqliteQueryer struct {
+	q queryer
+}
+
+func (s sqliteQueryer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.q.ExecContext(ctx, query, sqliteArgs(args)...)
+}
+
+func (s sqliteQueryer) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return s.q.QueryContext(ctx, query, sqliteArgs(args)...)
+}
+
+func (s sqliteQueryer) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return s.q.QueryRowContext(ctx, query, sqliteArgs(args)...)
+}
+
+func sqliteArgs(args []any) []any {
+	converted := make([]any, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			converted[i] = v.UTC().Format(sqliteTimeFormat)
+		case *time.Time:
+			if v != nil {
+				converted[i] = v.UTC().Format(sqliteTimeFormat)
+			}
+		default:
+			converted[i] = arg
+		}
+	}
+
+	return converted
+}
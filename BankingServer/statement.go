@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Statements are read off the outbox: every movement of money is an event there,
+// committed with the movement itself, and the events are kept once published.
+// It's the one complete record of what happened to an account
+type StatementStore interface {
+	// GetAccountActivity is what happened to the account in [from, to), oldest first
+	GetAccountActivity(ctx context.Context, accountID int, from, to time.Time) ([]*ActivityEvent, error)
+}
+
+type Statement struct {
+	AccountID int       `json:"accountId"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	// Only known when something happened in the period, each entry carries the balance after it
+	OpeningBalance *int64           `json:"openingBalance,omitempty"`
+	ClosingBalance *int64           `json:"closingBalance,omitempty"`
+	Credits        int64            `json:"credits"`
+	Debits         int64            `json:"debits"`
+	Entries        []*ActivityEvent `json:"entries"`
+}
+
+// A statement reads every event in its period, so the period is kept to a year
+const maxStatementPeriod = 366 * 24 * time.Hour
+
+// The event types that move money, the only ones a statement cares about
+var statementEventTypes = []EventType{EventTransferCompleted, EventDepositCompleted}
+
+func BuildStatement(ctx context.Context, store StatementStore, accountID int, from, to time.Time) (*Statement, error) {
+	entries, err := store.GetAccountActivity(ctx, accountID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Statement{AccountID: accountID, From: from, To: to, Entries: entries}
+	if st.Entries == nil {
+		st.Entries = []*ActivityEvent{}
+	}
+	for _, e := range entries {
+		if e.Amount >= 0 {
+			st.Credits += e.Amount
+		} else {
+			st.Debits -= e.Amount
+		}
+	}
+	if len(entries) > 0 {
+		opening := entries[0].Balance - entries[0].Amount
+		closing := entries[len(entries)-1].Balance
+		st.OpeningBalance, st.ClosingBalance = &opening, &closing
+	}
+
+	return st, nil
+}
+
+// As CSV a statement is its entries, the totals are easily summed back up
+func (st Statement) csvRows() any {
+	return st.Entries
+}
+
+// ParseStatementPeriod reads from and to, RFC 3339 both. The default is the
+// current month so far
+func ParseStatementPeriod(values url.Values, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+
+	var err error
+	if v := values.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("from must be an RFC 3339 timestamp")
+		}
+	}
+	if v := values.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("to must be an RFC 3339 timestamp")
+		}
+	}
+	from, to = from.UTC(), to.UTC()
+
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > maxStatementPeriod {
+		return from, to, fmt.Errorf("a statement covers a year at most")
+	}
+
+	return from, to, nil
+}
+
+// accountActivity picks the account's side out of the events
+func accountActivity(events []*Event, accountID int) ([]*ActivityEvent, error) {
+	var entries []*ActivityEvent
+	for _, ev := range events {
+		activity, err := activityFromEvent(ev)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range activity {
+			if a.AccountID == accountID {
+				entries = append(entries, a)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// Transfers are filed under the sender, so the receiver's side can't be found by
+// aggregateID. The period is what keeps this from reading the whole outbox
+func (st *sqlStore) GetAccountActivity(ctx context.Context, accountID int, from, to time.Time) ([]*ActivityEvent, error) {
+	rows, err := st.q.QueryContext(ctx, `SELECT id, eventType, aggregateID, payload, createdAt
+		FROM Outbox
+		WHERE eventType IN ($1, $2) AND createdAt >= $3 AND createdAt < $4
+		ORDER BY id`, statementEventTypes[0], statementEventTypes[1], from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		ev := new(Event)
+		var payload []byte
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.AggregateID, &payload, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		ev.Payload = payload
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accountActivity(events, accountID)
+}
+
+func (st *MemoryStore) GetAccountActivity(ctx context.Context, accountID int, from, to time.Time) ([]*ActivityEvent, error) {
+	var events []*Event
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		for _, list := range [][]*Event{tx.state.published, tx.state.outbox} {
+			for _, ev := range list {
+				if slices.Contains(statementEventTypes, ev.Type) && !ev.CreatedAt.Before(from) && ev.CreatedAt.Before(to) {
+					events = append(events, ev)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Published and pending events interleave
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return accountActivity(events, accountID)
+}
@@ -1,58 +1,247 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// Every method takes the caller's context, so a client hanging up or a deadline
+// running out cancels the query instead of leaving it to run for nobody
 type Storage interface {
-	CreateAccount(*Account) (int, error)
-	DeleteAccount(int) error
-	UpdateAccount(*Account) error
-	GetAccountByID(int) (*Account, error)
-	GetAccounts() ([]*Account, error)
+	CreateAccount(context.Context, *Account) (int, error)
+	DeleteAccount(context.Context, int) error
+	UpdateAccount(context.Context, *Account) error
+	GetAccountByID(context.Context, int) (*Account, error)
+	GetAccounts(context.Context, *AccountQuery) (*AccountPage, error)
+	Transfer(ctx context.Context, fromID, toID int, amount int64) error
+	Deposit(ctx context.Context, id int, amount int64) error
+	// SetAccountStatus freezes or unfreezes an account
+	SetAccountStatus(ctx context.Context, id int, status AccountStatus) error
+	// RecordEvent writes an event to the outbox. The services call it in the same WithTx
+	// as the change the event is about, so one never commits without the other
+	RecordEvent(ctx context.Context, eventType EventType, aggregateID int, payload any) error
+	// WithTx runs fn against a Storage bound to a single transaction: everything fn does
+	// commits together when it returns nil, and nothing does otherwise. Calling WithTx on
+	// that Storage again joins the same transaction
+	WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error
 }
 
-type PostgresStore struct {
+var (
+	// Wrapped with the ID that wasn't found, so check it with errors.Is
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// Also wrapped with the ID, money doesn't move in or out of a frozen account
+	ErrAccountFrozen = errors.New("account is frozen")
+	// Account numbers are unique, whichever backend is enforcing it
+	ErrDuplicateAccountNumber = errors.New("account number already in use")
+)
+
+func accountNotFound(id int) error {
+	return fmt.Errorf("account %d: %w", id, ErrAccountNotFound)
+}
+
+func accountFrozen(id int) error {
+	return fmt.Errorf("account %d: %w", id, ErrAccountFrozen)
+}
+
+// Both *sql.DB and *sql.Tx, so the same queries run in or out of a transaction
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlStore is everything that's plain SQL, shared by every database/sql backend.
+// The backends only bring their driver, their schema and their dialect
+type sqlStore struct {
 	db *sql.DB
+	// What queries go through: db, unless this store was handed out by WithTx
+	q       queryer
+	tx      *sql.Tx
+	dialect *sqlDialect
+	// Seals the names, nil keeps them in plaintext. Only Postgres sets it, see pii.go
+	pii *piiCipher
+}
+
+// What sets one database apart from another, as far as the shared queries care
+type sqlDialect struct {
+	// As OpenTelemetry calls it, for the spans
+	name string
+	// Errors meaning the transaction lost a race and can simply be run again
+	retryable func(error) bool
+	// Errors meaning a UNIQUE constraint was violated
+	uniqueViolation func(error) bool
+	// Lets a backend adapt query arguments before they reach its driver, may be nil
+	wrap func(queryer) queryer
+	// What a SELECT ends with to lock its rows, skipping those already locked. SQLite
+	// has no such thing, nor any need for it with its single writer
+	lockRows string
+}
+
+func newSQLStore(db *sql.DB, dialect *sqlDialect) *sqlStore {
+	return &sqlStore{db: db, q: dialect.queryer(db, nil), dialect: dialect}
+}
+
+// queryer is what queries on q go through: the backend's own wrapper, and a span each.
+// Queries in a transaction go under its span
+func (d *sqlDialect) queryer(q queryer, txSpan *Span) queryer {
+	if d.wrap != nil {
+		q = d.wrap(q)
+	}
+	return tracedQueryer{q: q, system: d.name, tx: txSpan}
+}
+
+var postgresDialect = &sqlDialect{
+	name:            "postgresql",
+	retryable:       isPostgresRetryable,
+	uniqueViolation: isPostgresUniqueViolation,
+	lockRows:        "FOR UPDATE SKIP LOCKED",
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
+type PostgresStore struct {
+	*sqlStore
+	// Where reads go, only ever the primary unless replicas were given
+	replicas *replicaSet
+}
+
+// NewPostgresStore connects to the primary, waiting for it for as long as
+// cfg.ConnectTimeout allows. Replicas that aren't there yet simply start out taken out
+func NewPostgresStore(cfg PostgresConfig, logger *slog.Logger) (*PostgresStore, error) {
 	// Right now we're using database/sql, but you may want to abstract this,
 	// If things go well, maintainability will be key, and GORM is a far better choice
 	// for that, despite the performance trade-off.
-	connStr := "user=postgres dbname=postgres password=bankingserver sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+	db, err := cfg.openPool(cfg.ConnStr)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = db.Ping(); err != nil {
+	if err = waitForDB(db, cfg.ConnectTimeout, logger); err != nil {
+		db.Close()
 		return nil, err
 	}
-	log.Println("DB is online")
+	logger.Info("DB is online", "replicas", len(cfg.Replicas))
+
+	st := &PostgresStore{sqlStore: newSQLStore(db, postgresDialect)}
+	if cfg.KeyManager != nil {
+		st.pii = newPIICipher(cfg.KeyManager)
+	}
 
-	return &PostgresStore{
-		db: db,
-	}, nil
+	var replicas []*sqlStore
+	for _, replicaConnStr := range cfg.Replicas {
+		replicaDB, err := cfg.openPool(replicaConnStr)
+		if err != nil {
+			return nil, err
+		}
+		replica := newSQLStore(replicaDB, postgresDialect)
+		replica.pii = st.pii
+		replicas = append(replicas, replica)
+	}
+
+	st.replicas = newReplicaSet(st.sqlStore, replicas, logger)
+	st.replicas.checkReplicas()
+	st.replicas.Start()
+
+	return st, nil
+}
+
+// Reads that can do with a replica. Everything else stays on the primary
+
+func (st *PostgresStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	var acc *Account
+	err := st.replicas.read(ctx, func(s *sqlStore) (err error) {
+		acc, err = s.GetAccountByID(ctx, id)
+		return err
+	})
+
+	return acc, err
 }
 
-func (st *PostgresStore) CreateAccount(acc *Account) (int, error) {
-	query := `INSERT INTO Account
-		(firstName, lastName, accNumber, balance, createdAt)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING id`
+func (st *PostgresStore) GetAccounts(ctx context.Context, q *AccountQuery) (*AccountPage, error) {
+	var page *AccountPage
+	err := st.replicas.read(ctx, func(s *sqlStore) (err error) {
+		page, err = s.GetAccounts(ctx, q)
+		return err
+	})
+
+	return page, err
+}
+
+// Writes keep their session reading from the primary, see replicaSet
+
+func (st *PostgresStore) CreateAccount(ctx context.Context, acc *Account) (int, error) {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.CreateAccount(ctx, acc)
+}
+
+func (st *PostgresStore) DeleteAccount(ctx context.Context, id int) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.DeleteAccount(ctx, id)
+}
+
+func (st *PostgresStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.UpdateAccount(ctx, acc)
+}
+
+func (st *PostgresStore) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.Transfer(ctx, fromID, toID, amount)
+}
+
+func (st *PostgresStore) Deposit(ctx context.Context, id int, amount int64) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.Deposit(ctx, id, amount)
+}
+
+func (st *PostgresStore) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.SetAccountStatus(ctx, id, status)
+}
+
+func (st *PostgresStore) RecordEvent(ctx context.Context, eventType EventType, aggregateID int, payload any) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.RecordEvent(ctx, eventType, aggregateID, payload)
+}
+
+// Reads inside the transaction go to it, and so to the primary, without any help
+func (st *PostgresStore) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	defer st.replicas.wrote(ctx)
+	return st.sqlStore.WithTx(ctx, fn, opts...)
+}
+
+func (st *sqlStore) CreateAccount(ctx context.Context, acc *Account) (int, error) {
+	status := acc.Status
+	if status == "" {
+		status = AccountActive
+	}
+
+	// The names are written as nameColumns has them
+	columns, values, err := st.nameColumns(ctx, acc.FirstName, acc.LastName)
+	if err != nil {
+		return -1, err
+	}
+	columns = append(columns, "accNumber", "balance", "status", "createdAt")
+	values = append(values, acc.AccNumber, acc.Balance, status, acc.CreatedAt)
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO Account (%s) VALUES (%s) RETURNING id",
+		strings.Join(columns, ", "), strings.Join(placeholders, ", "))
 
 	var id int
-	err := st.db.QueryRow(query,
-		acc.FirstName,
-		acc.LastName,
-		acc.AccNumber,
-		acc.Balance,
-		acc.CreatedAt).Scan(&id)
+	err = st.q.QueryRowContext(ctx, query, values...).Scan(&id)
+	if err != nil && st.dialect.uniqueViolation(err) {
+		return -1, ErrDuplicateAccountNumber
+	}
 	if err != nil {
 		return -1, err
 	}
@@ -60,78 +249,571 @@ func (st *PostgresStore) CreateAccount(acc *Account) (int, error) {
 	return id, nil
 }
 
-func (st *PostgresStore) GetAccounts() ([]*Account, error) {
-	rows, err := st.db.Query("SELECT * FROM Account")
+func (st *sqlStore) GetAccounts(ctx context.Context, q *AccountQuery) (*AccountPage, error) {
+	page := new(AccountPage)
+
+	if st.pii != nil && q.Sort.Field == "lastName" {
+		return nil, ErrSortOnEncrypted
+	}
+
+	countQuery, countArgs := buildAccountCountQuery(q, st.nameIndex())
+	if err := st.q.QueryRowContext(ctx, countQuery, countArgs...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	query, args, err := buildAccountPageQuery(st.accountColumns(), q, st.nameIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	if page.Accounts, err = st.queryAccounts(ctx, query, args...); err != nil {
+		return nil, err
+	}
+
+	if len(page.Accounts) > q.Limit {
+		page.Accounts = page.Accounts[:q.Limit]
+		page.NextCursor = encodeCursor(cursorFor(page.Accounts[q.Limit-1], q.Sort))
+	}
+
+	return page, nil
+}
+
+// Every read of Account goes through these columns and scanAccount, in this order.
+// Adding a column to the table then means adding it here, and nothing else breaks
+const accountColumns = "id, firstName, lastName, accNumber, balance, status, createdAt"
+
+// Both *sql.Row and *sql.Rows, so one mapper serves single and multi-row reads
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// extra is scanned into after the account's own columns
+func scanAccount(row rowScanner, extra ...any) (*Account, error) {
+	// The columns are nullable, and a NULL can't be scanned into a string or an int
+	var (
+		acc                 = new(Account)
+		firstName, lastName sql.NullString
+		balance             sql.NullInt64
+		status              sql.NullString
+		createdAt           sql.NullTime
+	)
+	dest := []any{&acc.ID, &firstName, &lastName, &acc.AccNumber, &balance, &status, &createdAt}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	acc.FirstName = firstName.String
+	acc.LastName = lastName.String
+	acc.Balance = balance.Int64
+	acc.Status = AccountStatus(status.String)
+	if !status.Valid {
+		acc.Status = AccountActive
+	}
+	acc.CreatedAt = createdAt.Time
+
+	return acc, nil
+}
+
+func (st *sqlStore) queryAccounts(ctx context.Context, query string, args ...any) ([]*Account, error) {
+	rows, err := st.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var accounts []*Account
-
 	for rows.Next() {
-		acc := new(Account)
-		acc, err = scanIntoAccount(rows)	
+		acc, err := st.scanAccountRow(ctx, rows)
 		if err != nil {
 			return nil, err
 		}
-
 		accounts = append(accounts, acc)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
 	return accounts, nil
 }
 
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
-	acc := new(Account)
-	err := rows.Scan(&acc.ID, &acc.FirstName, &acc.LastName, &acc.AccNumber, &acc.Balance, &acc.CreatedAt)
-	if err != nil { return nil, err }
-
-	return acc, nil
+// queryAccount returns sql.ErrNoRows as is, callers know best what was missing
+func (st *sqlStore) queryAccount(ctx context.Context, query string, args ...any) (*Account, error) {
+	return st.scanAccountRow(ctx, st.q.QueryRowContext(ctx, query, args...))
 }
 
-func (st *PostgresStore) GetAccountByID(id int) (*Account, error) {
-	rows, err := st.db.Query("SELECT * FROM Account WHERE id = $1", id)
-	if err != nil { return nil, err }
-	defer rows.Close()
-
-	for rows.Next() { 
-		return scanIntoAccount(rows)
+func (st *sqlStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	acc, err := st.queryAccount(ctx, "SELECT "+st.accountColumns()+" FROM Account WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, accountNotFound(id)
 	}
-	if err := rows.Err(); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
-	return nil, fmt.Errorf("account %d not found", id)
+	return acc, nil
 }
 
-func (st *PostgresStore) DeleteAccount(id int) error {
+func (st *sqlStore) DeleteAccount(ctx context.Context, id int) error {
 	// So we should consider soft deletions too, huh
-	_, err := st.db.Exec("DELETE FROM Account WHERE id = $1", id)
+	// Deleting nothing isn't an error
+	_, err := st.q.ExecContext(ctx, "DELETE FROM Account WHERE id = $1", id)
 	return err
 }
 
-func (st *PostgresStore) UpdateAccount(acc *Account) error {
+func (st *sqlStore) Transfer(ctx context.Context, fromID, toID int, amount int64) error {
+	return st.atomically(ctx, func(tx *sqlStore) error {
+		// The balance check and the debit are one statement, so two concurrent transfers
+		// can't both spend the same money
+		res, err := tx.q.ExecContext(ctx, `UPDATE Account SET balance = balance - $1
+			WHERE id = $2 AND balance >= $1 AND status = $3`, amount, fromID, AccountActive)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			// Either the money isn't there, or the account isn't, or it's frozen
+			if err := tx.whyNotUpdated(ctx, fromID); err != nil {
+				return err
+			}
+			return ErrInsufficientFunds
+		}
+
+		res, err = tx.q.ExecContext(ctx, "UPDATE Account SET balance = balance + $1 WHERE id = $2 AND status = $3",
+			amount, toID, AccountActive)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return tx.whyNotUpdated(ctx, toID)
+		}
+
+		return nil
+	})
+}
+
+// UpdateAccount changes the owner's name. Balances only move through transfers and deposits
+func (st *sqlStore) UpdateAccount(ctx context.Context, acc *Account) error {
+	return st.updateNames(ctx, acc.ID, acc.FirstName, acc.LastName)
+}
+
+func (st *sqlStore) updateNames(ctx context.Context, id int, firstName, lastName string) error {
+	columns, values, err := st.nameColumns(ctx, firstName, lastName)
+	if err != nil {
+		return err
+	}
+	set := make([]string, len(columns))
+	for i, column := range columns {
+		set[i] = fmt.Sprintf("%s = $%d", column, i+1)
+	}
+	values = append(values, id)
+	query := fmt.Sprintf("UPDATE Account SET %s WHERE id = $%d", strings.Join(set, ", "), len(values))
+
+	res, err := st.q.ExecContext(ctx, query, values...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return accountNotFound(id)
+	}
+
+	return nil
+}
+
+func (st *sqlStore) Deposit(ctx context.Context, id int, amount int64) error {
+	res, err := st.q.ExecContext(ctx, "UPDATE Account SET balance = balance + $1 WHERE id = $2 AND status = $3",
+		amount, id, AccountActive)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return st.whyNotUpdated(ctx, id)
+	}
+
+	return nil
+}
+
+func (st *sqlStore) SetAccountStatus(ctx context.Context, id int, status AccountStatus) error {
+	res, err := st.q.ExecContext(ctx, "UPDATE Account SET status = $1 WHERE id = $2", status, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return accountNotFound(id)
+	}
+
+	return nil
+}
+
+func (st *sqlStore) RecordEvent(ctx context.Context, eventType EventType, aggregateID int, payload any) error {
+	return insertEvent(ctx, st.q, eventType, aggregateID, payload)
+}
+
+// whyNotUpdated explains an UPDATE of an active account that matched nothing: the
+// account is missing or frozen. nil means neither, the rest of the WHERE is to blame
+func (st *sqlStore) whyNotUpdated(ctx context.Context, id int) error {
+	var status sql.NullString
+	err := st.q.QueryRowContext(ctx, "SELECT status FROM Account WHERE id = $1", id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return accountNotFound(id)
+	}
+	if err != nil {
+		return err
+	}
+	if status.Valid && AccountStatus(status.String) != AccountActive {
+		return accountFrozen(id)
+	}
+
 	return nil
 }
 
+func (st *sqlStore) WithTx(ctx context.Context, fn func(Storage) error, opts ...TxOption) error {
+	return st.atomically(ctx, func(tx *sqlStore) error { return fn(tx) }, opts...)
+}
+
+// atomically is WithTx for our own methods, which need the concrete store
+func (st *sqlStore) atomically(ctx context.Context, fn func(*sqlStore) error, opts ...TxOption) error {
+	// Already in a transaction: join it, the outermost caller decides when to commit
+	if st.tx != nil {
+		return fn(st)
+	}
+
+	// Retries show up as the transaction's queries running again under the same span.
+	// Our callers' closures hold on to their own ctx, so the queries can't find this
+	// span in it, which is why the transaction's queryer is handed it directly
+	ctx, span := startChildSpan(ctx, "db.transaction")
+	defer span.Finish()
+	span.SetAttr("db.system", st.dialect.name)
+
+	cfg := newTxConfig(opts)
+	attempts := 0
+	err := retryTx(ctx, cfg, st.dialect.retryable, func() error {
+		attempts++
+		tx, err := st.db.BeginTx(ctx, &sql.TxOptions{Isolation: cfg.isolation})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		txStore := &sqlStore{db: st.db, q: st.dialect.queryer(tx, span), tx: tx, dialect: st.dialect, pii: st.pii}
+		if err := fn(txStore); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	})
+	span.SetAttr("db.transaction.attempts", attempts)
+	span.RecordError(err)
+
+	return err
+}
+
+// Serialization failures and deadlocks say nothing about the transaction itself,
+// only that it lost a race; running it again is the documented answer
+func isPostgresRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == "40001" || pqErr.Code == "40P01"
+}
+
+func isPostgresUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 // This is the same pattern to initialize things (here the DB). In our case it's rather unnecssary, but if additional operations are necessary this will help keep things clean
-func (st *PostgresStore) Init() error {
-	return st.createAccountTable()
+func (st *PostgresStore) Init(ctx context.Context) error {
+	if err := st.createAccountTable(ctx); err != nil {
+		return err
+	}
+	if err := st.createOutboxTable(ctx); err != nil {
+		return err
+	}
+	if err := st.createWebhookTables(ctx); err != nil {
+		return err
+	}
+	if err := st.createTOTPTable(ctx); err != nil {
+		return err
+	}
+	return st.createAPIKeyTable(ctx)
 }
-func (st *PostgresStore) createAccountTable() error {
+func (st *PostgresStore) createAccountTable(ctx context.Context) error {
 	query := `CREATE TABLE IF NOT EXISTS Account (
 		id SERIAL PRIMARY KEY,
 		firstName VARCHAR(50),
 		lastName VARCHAR(50),
 		accNumber SERIAL UNIQUE,
 		balance INT,
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
 		createdAt timestamp
-	)`
+	);
+	ALTER TABLE Account ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'active';
+	-- The sealed names and their blind indexes, see pii.go
+	ALTER TABLE Account
+		ADD COLUMN IF NOT EXISTS piiKeyID VARCHAR(64),
+		ADD COLUMN IF NOT EXISTS piiDataKey BYTEA,
+		ADD COLUMN IF NOT EXISTS firstNameEnc BYTEA,
+		ADD COLUMN IF NOT EXISTS lastNameEnc BYTEA,
+		ADD COLUMN IF NOT EXISTS firstNameIndex BYTEA,
+		ADD COLUMN IF NOT EXISTS lastNameIndex BYTEA;
+	CREATE INDEX IF NOT EXISTS account_firstname_index_idx ON Account (firstNameIndex);
+	CREATE INDEX IF NOT EXISTS account_lastname_index_idx ON Account (lastNameIndex);
+	CREATE INDEX IF NOT EXISTS account_createdat_idx ON Account (createdAt, id);
+	CREATE INDEX IF NOT EXISTS account_balance_idx ON Account (balance, id);
+	CREATE INDEX IF NOT EXISTS account_lastname_idx ON Account (lastName, id);
+	CREATE INDEX IF NOT EXISTS account_firstname_prefix_idx ON Account (lower(firstName) text_pattern_ops);
+	CREATE INDEX IF NOT EXISTS account_lastname_prefix_idx ON Account (lower(lastName) text_pattern_ops)`
+
+	_, err := st.q.ExecContext(ctx, query)
+	return err
+}
 
-	_, err := st.db.Exec(query)
+func (st *PostgresStore) createOutboxTable(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS Outbox (
+		id BIGSERIAL PRIMARY KEY,
+		eventType VARCHAR(50) NOT NULL,
+		aggregateID INT NOT NULL,
+		payload JSONB NOT NULL,
+		createdAt timestamp NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		nextAttemptAt timestamp NOT NULL,
+		publishedAt timestamp
+	);
+	CREATE INDEX IF NOT EXISTS outbox_pending_idx ON Outbox (nextAttemptAt, id) WHERE publishedAt IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_createdat_idx ON Outbox (createdAt, id)`
+
+	_, err := st.q.ExecContext(ctx, query)
 	return err
 }
+
+// insertEvent writes an event to the outbox through q, which should be a transaction.
+// The relay picks it up after commit
+func insertEvent(ctx context.Context, q queryer, eventType EventType, aggregateID int, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = q.ExecContext(ctx, `INSERT INTO Outbox
+		(eventType, aggregateID, payload, createdAt, nextAttemptAt)
+		VALUES ($1, $2, $3, $4, $4)`,
+		eventType, aggregateID, body, now)
+	return err
+}
+
+func (st *sqlStore) FetchPendingEvents(ctx context.Context, limit int) ([]*Event, error) {
+	rows, err := st.q.QueryContext(ctx, `SELECT id, eventType, aggregateID, payload, createdAt, attempts
+		FROM Outbox
+		WHERE publishedAt IS NULL AND nextAttemptAt <= $1
+		ORDER BY id
+		LIMIT $2`, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		ev := new(Event)
+		var payload []byte
+		if err := rows.Scan(&ev.ID, &ev.Type, &ev.AggregateID, &payload, &ev.CreatedAt, &ev.Attempts); err != nil {
+			return nil, err
+		}
+		ev.Payload = payload
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (st *sqlStore) MarkEventPublished(ctx context.Context, id int64) error {
+	_, err := st.q.ExecContext(ctx, "UPDATE Outbox SET publishedAt = $1 WHERE id = $2", time.Now().UTC(), id)
+	return err
+}
+
+func (st *sqlStore) MarkEventFailed(ctx context.Context, id int64, attempts int, nextAttemptAt time.Time) error {
+	_, err := st.q.ExecContext(ctx, "UPDATE Outbox SET attempts = $1, nextAttemptAt = $2 WHERE id = $3",
+		attempts, nextAttemptAt.UTC(), id)
+	return err
+}
+
+func (st *PostgresStore) createWebhookTables(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS Webhook (
+		id SERIAL PRIMARY KEY,
+		accountID INT NOT NULL REFERENCES Account (id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		createdAt timestamp NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS WebhookDelivery (
+		id BIGSERIAL PRIMARY KEY,
+		webhookID INT NOT NULL REFERENCES Webhook (id) ON DELETE CASCADE,
+		accountID INT NOT NULL,
+		eventID BIGINT NOT NULL,
+		payload JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		lastStatusCode INT NOT NULL DEFAULT 0,
+		lastError TEXT NOT NULL DEFAULT '',
+		nextAttemptAt timestamp NOT NULL,
+		createdAt timestamp NOT NULL,
+		deliveredAt timestamp,
+		UNIQUE (webhookID, eventID)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_delivery_due_idx ON WebhookDelivery (nextAttemptAt, id) WHERE status = 'pending'`
+
+	_, err := st.q.ExecContext(ctx, query)
+	return err
+}
+
+func (st *sqlStore) CreateWebhook(ctx context.Context, hook *Webhook) (int, error) {
+	var id int
+	err := st.q.QueryRowContext(ctx, `INSERT INTO Webhook (accountID, url, secret, createdAt)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		hook.AccountID, hook.URL, hook.Secret, hook.CreatedAt).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+func (st *sqlStore) GetWebhooks(ctx context.Context, accountID int) ([]*Webhook, error) {
+	rows, err := st.q.QueryContext(ctx, `SELECT id, accountID, url, createdAt
+		FROM Webhook WHERE accountID = $1 ORDER BY id`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []*Webhook
+	for rows.Next() {
+		hook := new(Webhook)
+		if err := rows.Scan(&hook.ID, &hook.AccountID, &hook.URL, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+func (st *sqlStore) DeleteWebhook(ctx context.Context, accountID, webhookID int) error {
+	res, err := st.q.ExecContext(ctx, "DELETE FROM Webhook WHERE id = $1 AND accountID = $2", webhookID, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+func (st *sqlStore) EnqueueWebhookDeliveries(ctx context.Context, accountID int, eventID int64, payload []byte) error {
+	now := time.Now().UTC()
+	_, err := st.q.ExecContext(ctx, `INSERT INTO WebhookDelivery
+		(webhookID, accountID, eventID, payload, status, nextAttemptAt, createdAt)
+		SELECT id, accountID, $1, $2, $3, $4, $4 FROM Webhook WHERE accountID = $5
+		ON CONFLICT (webhookID, eventID) DO NOTHING`,
+		eventID, payload, DeliveryPending, now, accountID)
+	return err
+}
+
+func (st *sqlStore) FetchDueDeliveries(ctx context.Context, limit int) ([]*WebhookDelivery, error) {
+	rows, err := st.q.QueryContext(ctx, `SELECT d.id, d.webhookID, d.accountID, d.eventID, d.payload, d.status,
+			d.attempts, d.lastStatusCode, d.lastError, d.nextAttemptAt, d.createdAt, d.deliveredAt,
+			w.url, w.secret
+		FROM WebhookDelivery d JOIN Webhook w ON w.id = d.webhookID
+		WHERE d.status = $1 AND d.nextAttemptAt <= $2
+		ORDER BY d.id
+		LIMIT $3`, DeliveryPending, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d := new(WebhookDelivery)
+		if err := scanIntoDelivery(rows, d, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (st *sqlStore) UpdateDelivery(ctx context.Context, d *WebhookDelivery) error {
+	_, err := st.q.ExecContext(ctx, `UPDATE WebhookDelivery SET
+		status = $1, attempts = $2, lastStatusCode = $3, lastError = $4, nextAttemptAt = $5, deliveredAt = $6
+		WHERE id = $7`,
+		d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.NextAttemptAt.UTC(), d.DeliveredAt, d.ID)
+	return err
+}
+
+func (st *sqlStore) GetDeliveries(ctx context.Context, accountID, limit int) ([]*WebhookDelivery, error) {
+	rows, err := st.q.QueryContext(ctx, `SELECT id, webhookID, accountID, eventID, payload, status,
+			attempts, lastStatusCode, lastError, nextAttemptAt, createdAt, deliveredAt
+		FROM WebhookDelivery
+		WHERE accountID = $1
+		ORDER BY id DESC
+		LIMIT $2`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d := new(WebhookDelivery)
+		if err := scanIntoDelivery(rows, d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// extra is scanned after the delivery's own columns, for queries that join more in
+func scanIntoDelivery(rows *sql.Rows, d *WebhookDelivery, extra ...any) error {
+	var payload []byte
+	dest := append([]any{&d.ID, &d.WebhookID, &d.AccountID, &d.EventID, &payload, &d.Status,
+		&d.Attempts, &d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	d.Payload = payload
+
+	return nil
+}
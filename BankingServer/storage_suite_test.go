@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every backend gets the same tests, so they can't drift apart.
+// A factory hands out a fresh, empty store for each test
+type storageFactory func(t *testing.T) Storage
+
+// Postgres runs when POSTGRES_TEST_DSN points at a database the tests may wipe,
+// "make test-postgres" starts one in Docker
+func storageBackends() map[string]storageFactory {
+	backends := map[string]storageFactory{
+		"memory": func(t *testing.T) Storage {
+			return NewMemoryStore()
+		},
+		// The cache must keep the contract of whatever it's in front of
+		"cached": func(t *testing.T) Storage {
+			return NewCachedStore(NewMemoryStore(), 100, time.Minute)
+		},
+		"sqlite": func(t *testing.T) Storage {
+			store, err := NewSQLiteStore(":memory:", slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.db.Close() })
+			if err := store.Init(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+
+	if dsn := os.Getenv("POSTGRES_TEST_DSN"); dsn != "" {
+		backends["postgres"] = func(t *testing.T) Storage {
+			cfg := DefaultPostgresConfig()
+			cfg.ConnStr = dsn
+			store, err := NewPostgresStore(cfg, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.db.Close() })
+
+			ctx := context.Background()
+			if err := store.Init(ctx); err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.db.ExecContext(ctx, "TRUNCATE Account, Outbox, Webhook, WebhookDelivery, APIKey RESTART IDENTITY CASCADE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}
+	}
+
+	return backends
+}
+
+func TestStorage(t *testing.T) {
+	for name, newStorage := range storageBackends() {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, newStorage)
+		})
+	}
+}
+
+func testStorage(t *testing.T, newStorage storageFactory) {
+	t.Run("CreateAndGet", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+
+		acc := NewAccount("Ada", "Lovelace")
+		id, err := store.CreateAccount(ctx, acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetAccountByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != id || got.FirstName != "Ada" || got.LastName != "Lovelace" || got.AccNumber != acc.AccNumber {
+			t.Fatalf("unexpected account %+v", got)
+		}
+		// Timestamps come back as they went in, give or take the DB's precision
+		if got.CreatedAt.Sub(acc.CreatedAt).Abs() > time.Microsecond {
+			t.Fatalf("createdAt changed from %v to %v", acc.CreatedAt, got.CreatedAt)
+		}
+	})
+
+	t.Run("TransferAndDeposit", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		from, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+		to, _ := store.CreateAccount(ctx, NewAccount("Grace", "Hopper"))
+
+		if err := store.Transfer(ctx, from, to, 10); !errors.Is(err, ErrInsufficientFunds) {
+			t.Fatalf("expected insufficient funds, got %v", err)
+		}
+		if err := store.Deposit(ctx, from, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Transfer(ctx, from, to, 30); err != nil {
+			t.Fatal(err)
+		}
+
+		fromAcc, _ := store.GetAccountByID(ctx, from)
+		toAcc, _ := store.GetAccountByID(ctx, to)
+		if fromAcc.Balance != 70 || toAcc.Balance != 30 {
+			t.Fatalf("unexpected balances %d and %d", fromAcc.Balance, toAcc.Balance)
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		for i, name := range []string{"Ada", "Alan", "Grace", "Barbara", "Anita"} {
+			acc := NewAccount(name, "Test")
+			acc.AccNumber = int64(i + 1)
+			id, _ := store.CreateAccount(ctx, acc)
+			store.Deposit(ctx, id, int64(i*10+10))
+		}
+
+		q := DefaultAccountQuery()
+		q.Name = "a"
+		q.Sort = AccountSort{Field: "balance", Desc: true}
+		q.Limit = 2
+
+		var names []string
+		for {
+			page, err := store.GetAccounts(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != 3 {
+				t.Fatalf("expected 3 matches in total, got %d", page.Total)
+			}
+			for _, acc := range page.Accounts {
+				names = append(names, acc.FirstName)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			if q.Cursor, err = decodeCursor(page.NextCursor); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(names) != 3 || names[0] != "Anita" || names[1] != "Alan" || names[2] != "Ada" {
+			t.Fatalf("unexpected order %v", names)
+		}
+	})
+
+	t.Run("WithTxRollsBack", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		id, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+
+		failed := errors.New("rolled back")
+		err := store.WithTx(ctx, func(tx Storage) error {
+			if err := tx.Deposit(ctx, id, 100); err != nil {
+				return err
+			}
+			return failed
+		})
+		if !errors.Is(err, failed) {
+			t.Fatalf("expected the callback's error, got %v", err)
+		}
+
+		acc, _ := store.GetAccountByID(ctx, id)
+		if acc.Balance != 0 {
+			t.Fatalf("deposit survived the rollback: balance %d", acc.Balance)
+		}
+	})
+
+	t.Run("UpdateAndDelete", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		id, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+		store.Deposit(ctx, id, 50)
+
+		// Only the name changes, whatever else the caller sends
+		err := store.UpdateAccount(ctx, &Account{ID: id, FirstName: "Augusta", LastName: "King", Balance: 1_000_000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		acc, _ := store.GetAccountByID(ctx, id)
+		if acc.FirstName != "Augusta" || acc.LastName != "King" || acc.Balance != 50 {
+			t.Fatalf("unexpected account after update %+v", acc)
+		}
+
+		if err := store.DeleteAccount(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetAccountByID(ctx, id); !errors.Is(err, ErrAccountNotFound) {
+			t.Fatalf("expected the account to be gone, got %v", err)
+		}
+		page, err := store.GetAccounts(ctx, DefaultAccountQuery())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 0 || len(page.Accounts) != 0 {
+			t.Fatalf("deleted account still listed: %+v", page)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		id, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+		store.Deposit(ctx, id, 50)
+		missing := id + 1000
+
+		if _, err := store.GetAccountByID(ctx, missing); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("GetAccountByID: expected not found, got %v", err)
+		}
+		if err := store.UpdateAccount(ctx, &Account{ID: missing, FirstName: "Nobody"}); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("UpdateAccount: expected not found, got %v", err)
+		}
+		if err := store.Deposit(ctx, missing, 10); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("Deposit: expected not found, got %v", err)
+		}
+		if err := store.Transfer(ctx, missing, id, 10); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("Transfer from: expected not found, got %v", err)
+		}
+		if err := store.Transfer(ctx, id, missing, 10); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("Transfer to: expected not found, got %v", err)
+		}
+		// Deleting what isn't there is fine, DELETE is idempotent
+		if err := store.DeleteAccount(ctx, missing); err != nil {
+			t.Errorf("DeleteAccount: expected no error, got %v", err)
+		}
+
+		// A failed transfer leaves the sender's money where it was
+		acc, _ := store.GetAccountByID(ctx, id)
+		if acc.Balance != 50 {
+			t.Errorf("balance moved to nowhere: %d", acc.Balance)
+		}
+	})
+
+	t.Run("UniqueAccountNumber", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+
+		first := NewAccount("Ada", "Lovelace")
+		if _, err := store.CreateAccount(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		second := NewAccount("Grace", "Hopper")
+		second.AccNumber = first.AccNumber
+		if _, err := store.CreateAccount(ctx, second); !errors.Is(err, ErrDuplicateAccountNumber) {
+			t.Fatalf("expected a duplicate account number, got %v", err)
+		}
+
+		page, _ := store.GetAccounts(ctx, DefaultAccountQuery())
+		if page.Total != 1 {
+			t.Fatalf("the duplicate was created anyway: %d accounts", page.Total)
+		}
+	})
+
+	t.Run("ConcurrentCreates", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+
+		const n = 20
+		ids := make(chan int, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				acc := NewAccount("Ada", "Lovelace")
+				acc.AccNumber = int64(i + 1)
+				id, err := store.CreateAccount(ctx, acc)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids <- id
+			}(i)
+		}
+		wg.Wait()
+		close(ids)
+
+		seen := make(map[int]bool)
+		for id := range ids {
+			if seen[id] {
+				t.Fatalf("ID %d handed out twice", id)
+			}
+			seen[id] = true
+		}
+		if len(seen) != n {
+			t.Fatalf("expected %d accounts, got %d", n, len(seen))
+		}
+	})
+
+	t.Run("ConcurrentTransfers", func(t *testing.T) {
+		ctx := context.Background()
+		store := newStorage(t)
+		a, _ := store.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+		b, _ := store.CreateAccount(ctx, NewAccount("Grace", "Hopper"))
+		store.Deposit(ctx, a, 100)
+		store.Deposit(ctx, b, 100)
+
+		// Back and forth at the same time, which is how deadlocks and lost updates happen.
+		// Every transfer either goes through whole or is refused for lack of funds
+		const n = 50
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				from, to := a, b
+				if i%2 == 1 {
+					from, to = b, a
+				}
+				if err := store.Transfer(ctx, from, to, 15); err != nil && !errors.Is(err, ErrInsufficientFunds) {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		accA, _ := store.GetAccountByID(ctx, a)
+		accB, _ := store.GetAccountByID(ctx, b)
+		if accA.Balance+accB.Balance != 200 {
+			t.Fatalf("money appeared or vanished: %d + %d", accA.Balance, accB.Balance)
+		}
+		if accA.Balance < 0 || accB.Balance < 0 {
+			t.Fatalf("overdrawn: %d and %d", accA.Balance, accB.Balance)
+		}
+	})
+}
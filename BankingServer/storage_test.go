@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Stands in for *sql.Row, handing out fixed values the way database/sql would convert them
+type fakeRow []any
+
+func (r fakeRow) Scan(dest ...any) error {
+	if len(dest) != len(r) {
+		return errors.New("column count mismatch")
+	}
+	for i, d := range dest {
+		if scanner, ok := d.(sql.Scanner); ok {
+			if err := scanner.Scan(r[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		switch d := d.(type) {
+		case *int:
+			*d = r[i].(int)
+		case *int64:
+			*d = r[i].(int64)
+		default:
+			return errors.New("unsupported destination")
+		}
+	}
+	return nil
+}
+
+func TestScanAccount(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	acc, err := scanAccount(fakeRow{3, "Ada", "Lovelace", int64(1234), int64(50), "frozen", created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.ID != 3 || acc.FirstName != "Ada" || acc.LastName != "Lovelace" ||
+		acc.AccNumber != 1234 || acc.Balance != 50 || acc.Status != AccountFrozen || !acc.CreatedAt.Equal(created) {
+		t.Fatalf("unexpected account %+v", acc)
+	}
+}
+
+func TestScanAccountToleratesNulls(t *testing.T) {
+	acc, err := scanAccount(fakeRow{3, nil, nil, int64(1234), nil, nil, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.FirstName != "" || acc.Balance != 0 || !acc.CreatedAt.IsZero() {
+		t.Fatalf("NULLs should map to zero values, got %+v", acc)
+	}
+	if acc.Status != AccountActive {
+		t.Fatalf("accounts from before statuses are active, got %q", acc.Status)
+	}
+}
+
+func TestAccountNotFoundIsDistinguishable(t *testing.T) {
+	err := accountNotFound(9)
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Fatal("expected the sentinel to be wrapped")
+	}
+	if err.Error() != "account 9: account not found" {
+		t.Fatalf("unexpected message %q", err)
+	}
+}
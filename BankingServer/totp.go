@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// TOTP (RFC 6238) is the second factor. Moving an account's money or closing it
+// takes a token that was stepped up with a code in the last stepUpMaxAge, so an
+// account can't do either until it has TOTP. The owner sets it up with their
+// account token, and only they ever see the secret. Once it's confirmed, changing
+// it takes a step-up, and an admin resetting it when the phone is lost. The
+// secrets are sealed with TOTP_ENCRYPTION_KEY, 32 bytes in base64, before they're
+// stored
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// Codes from a period either side still count, phones' clocks drift
+	totpSkew     = 1
+	totpIssuer   = "BankingServer"
+	stepUpMaxAge = 5 * time.Minute
+)
+
+type TOTPEnrollment struct {
+	AccountID int
+	// Sealed, see sealTOTPSecret
+	Secret []byte
+	// Set by the first code that checks out, until then TOTP isn't on
+	Confirmed bool
+	// The period of the last code accepted, so no code works twice
+	LastCounter int64
+	CreatedAt   time.Time
+}
+
+type TOTPStore interface {
+	// SaveTOTP creates the account's enrollment, or replaces it
+	SaveTOTP(context.Context, *TOTPEnrollment) error
+	GetTOTP(ctx context.Context, accountID int) (*TOTPEnrollment, error)
+	// UseTOTPCounter confirms the enrollment and records counter as used, unless it,
+	// or a later one, already was. Checked and set at once, two requests with the
+	// same code can't both get through
+	UseTOTPCounter(ctx context.Context, accountID int, counter int64) (bool, error)
+	// DeleteTOTP removes the account's enrollment, if it had one
+	DeleteTOTP(ctx context.Context, accountID int) error
+}
+
+var (
+	ErrTOTPNotEnrolled = errors.New("TOTP isn't set up for this account")
+	ErrStepUpRequired  = errors.New("step-up required: verify a TOTP code first")
+)
+
+// TOTPSetup is what the account owner puts in their authenticator app, usually by
+// scanning URI as a QR code
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+type TOTPVerifyResponse struct {
+	// The account's token, with a step-up good for stepUpMaxAge
+	Token string `json:"token"`
+}
+
+type TOTPService struct {
+	store TOTPStore
+	now   func() time.Time
+}
+
+func NewTOTPService(store TOTPStore) *TOTPService {
+	return &TOTPService{store: store, now: time.Now}
+}
+
+// Enroll gives the account a new secret. Only the owner enrolls, admins never see
+// the secret. The account token does until a code has confirmed it, after that
+// swapping the secret for another takes a token stepped up by the current one
+func (s *TOTPService) Enroll(ctx context.Context, accountID int) (*TOTPSetup, error) {
+	caller := callerFrom(ctx)
+	if caller.Admin || caller.APIKey != nil || caller.AccountID != accountID {
+		return nil, ErrPermissionDenied
+	}
+
+	existing, err := s.store.GetTOTP(ctx, accountID)
+	if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+		return nil, err
+	}
+	if err == nil && existing.Confirmed && !s.steppedUp(caller) {
+		return nil, ErrStepUpRequired
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	sealed, err := sealTOTPSecret(accountID, secret)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store.SaveTOTP(ctx, &TOTPEnrollment{AccountID: accountID, Secret: sealed, CreatedAt: s.now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   fmt.Sprintf("/%s:account %d", totpIssuer, accountID),
+		RawQuery: url.Values{
+			"secret":    {encoded},
+			"issuer":    {totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {strconv.Itoa(totpDigits)},
+			"period":    {strconv.Itoa(int(totpPeriod.Seconds()))},
+		}.Encode(),
+	}
+
+	return &TOTPSetup{Secret: encoded, URI: uri.String()}, nil
+}
+
+// Verify checks a code from the account's authenticator, which confirms the
+// enrollment the first time, and returns the account's token stepped up. Only
+// the owner has the authenticator, so only the owner's token gets that far
+func (s *TOTPService) Verify(ctx context.Context, accountID int, code string) (string, error) {
+	if callerFrom(ctx).AccountID != accountID {
+		return "", ErrPermissionDenied
+	}
+
+	enrollment, err := s.store.GetTOTP(ctx, accountID)
+	if errors.Is(err, ErrTOTPNotEnrolled) {
+		return "", invalidRequest(err.Error())
+	}
+	if err != nil {
+		return "", err
+	}
+	secret, err := openTOTPSecret(accountID, enrollment.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	counter, ok := matchTOTP(secret, code, s.now())
+	if !ok || counter <= enrollment.LastCounter {
+		return "", invalidRequest("wrong or already used code")
+	}
+	if ok, err = s.store.UseTOTPCounter(ctx, accountID, counter); err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", invalidRequest("wrong or already used code")
+	}
+
+	return createStepUpJWT(accountID, s.now())
+}
+
+// Reset takes TOTP off the account, for when its owner lost the authenticator.
+// Admins only, and the owner then enrolls again with their account token
+func (s *TOTPService) Reset(ctx context.Context, accountID int) error {
+	if err := authorizeAdmin(ctx); err != nil {
+		return err
+	}
+	return s.store.DeleteTOTP(ctx, accountID)
+}
+
+// RequireStepUp is what the routes that move money or close accounts check first.
+// It's only about how sure we are the caller is the account's owner, whether
+// they may do it at all is still up to the services. Admins never step up, their
+// tokens come from bankctl and are short-lived already. Nor do API keys, they're
+// scoped to what they may do and have no authenticator to step up with
+func (s *TOTPService) RequireStepUp(ctx context.Context) error {
+	caller := callerFrom(ctx)
+	if caller.Admin || caller.APIKey != nil || caller.AccountID == 0 {
+		return nil
+	}
+	if !s.steppedUp(caller) {
+		return ErrStepUpRequired
+	}
+	return nil
+}
+
+func (s *TOTPService) steppedUp(caller Caller) bool {
+	return !caller.StepUpAt.IsZero() && s.now().Sub(caller.StepUpAt) < stepUpMaxAge
+}
+
+// createStepUpJWT is the account's token plus when it was stepped up. It lasts
+// as long as a new account token would: past stepUpMaxAge it's worth just as
+// much, and getting it took the second factor
+func createStepUpJWT(accountID int, at time.Time) (string, error) {
+	return signJWT(&jwt.MapClaims{
+		"sub":      accountID,
+		"stepUpAt": at.Unix(),
+		"iat":      at.Unix(),
+		"exp":      at.Add(accountTokenTTL).Unix(),
+	})
+}
+
+// totpCode is the code for the period counter falls in, as HOTP (RFC 4226) has it
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP finds the period code is for, within totpSkew of now
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func totpAEAD() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("TOTP_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("TOTP_ENCRYPTION_KEY has to be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts the secret with AES-GCM, the nonce in front. The account
+// ID is authenticated with it, so a sealed secret copied to another account's row
+// doesn't open
+func sealTOTPSecret(accountID int, secret []byte) ([]byte, error) {
+	aead, err := totpAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, secret, []byte(strconv.Itoa(accountID))), nil
+}
+
+func openTOTPSecret(accountID int, sealed []byte) ([]byte, error) {
+	aead, err := totpAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed TOTP secret is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(accountID)))
+}
+
+func (st *PostgresStore) createTOTPTable(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS TOTP (
+		accountID INT PRIMARY KEY REFERENCES Account (id) ON DELETE CASCADE,
+		secret BYTEA NOT NULL,
+		confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+		lastCounter BIGINT NOT NULL DEFAULT 0,
+		createdAt timestamp NOT NULL
+	)`
+
+	_, err := st.q.ExecContext(ctx, query)
+	return err
+}
+
+func (st *sqlStore) SaveTOTP(ctx context.Context, e *TOTPEnrollment) error {
+	_, err := st.q.ExecContext(ctx, `INSERT INTO TOTP (accountID, secret, confirmed, lastCounter, createdAt)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (accountID) DO UPDATE
+		SET secret = excluded.secret, confirmed = excluded.confirmed, lastCounter = excluded.lastCounter, createdAt = excluded.createdAt`,
+		e.AccountID, e.Secret, e.Confirmed, e.LastCounter, e.CreatedAt)
+	return err
+}
+
+func (st *sqlStore) GetTOTP(ctx context.Context, accountID int) (*TOTPEnrollment, error) {
+	e := &TOTPEnrollment{AccountID: accountID}
+	err := st.q.QueryRowContext(ctx, "SELECT secret, confirmed, lastCounter, createdAt FROM TOTP WHERE accountID = $1", accountID).
+		Scan(&e.Secret, &e.Confirmed, &e.LastCounter, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (st *sqlStore) UseTOTPCounter(ctx context.Context, accountID int, counter int64) (bool, error) {
+	res, err := st.q.ExecContext(ctx, "UPDATE TOTP SET lastCounter = $1, confirmed = TRUE WHERE accountID = $2 AND lastCounter < $1",
+		counter, accountID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n == 1, err
+}
+
+func (st *sqlStore) DeleteTOTP(ctx context.Context, accountID int) error {
+	_, err := st.q.ExecContext(ctx, "DELETE FROM TOTP WHERE accountID = $1", accountID)
+	return err
+}
+
+func (st *MemoryStore) SaveTOTP(ctx context.Context, e *TOTPEnrollment) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		if _, ok := tx.state.accounts[e.AccountID]; !ok {
+			return ErrAccountNotFound
+		}
+		saved := *e
+		tx.state.totp[e.AccountID] = &saved
+		return nil
+	})
+}
+
+func (st *MemoryStore) GetTOTP(ctx context.Context, accountID int) (*TOTPEnrollment, error) {
+	var e TOTPEnrollment
+	err := st.read(ctx, func(tx *MemoryStore) error {
+		saved, ok := tx.state.totp[accountID]
+		if !ok {
+			return ErrTOTPNotEnrolled
+		}
+		e = *saved
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (st *MemoryStore) UseTOTPCounter(ctx context.Context, accountID int, counter int64) (bool, error) {
+	used := false
+	err := st.do(ctx, func(tx *MemoryStore) error {
+		saved, ok := tx.state.totp[accountID]
+		if ok && saved.LastCounter < counter {
+			saved.LastCounter, saved.Confirmed = counter, true
+			used = true
+		}
+		return nil
+	})
+
+	return used, err
+}
+
+func (st *MemoryStore) DeleteTOTP(ctx context.Context, accountID int) error {
+	return st.do(ctx, func(tx *MemoryStore) error {
+		delete(tx.state.totp, accountID)
+		return nil
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/charm-113c/bankingserver/client"
+)
+
+func setTOTPKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("TOTP_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+}
+
+// The SHA1 vector of RFC 6238, appendix B, which has 8 digits where we keep 6
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	if code := totpCode(secret, 59/30); code != "287082" {
+		t.Fatalf("expected 287082, got %s", code)
+	}
+
+	now := time.Unix(59, 0)
+	if counter, ok := matchTOTP(secret, "287082", now.Add(totpPeriod)); !ok || counter != 1 {
+		t.Fatal("expected a code from the period before to count")
+	}
+	if _, ok := matchTOTP(secret, "287082", now.Add(2*totpPeriod)); ok {
+		t.Fatal("expected a code from two periods before not to")
+	}
+}
+
+func TestTOTPSecretIsBoundToTheAccount(t *testing.T) {
+	setTOTPKey(t)
+	sealed, err := sealTOTPSecret(1, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := openTOTPSecret(1, sealed); err != nil || string(secret) != "secret" {
+		t.Fatalf("unexpected secret %q, %v", secret, err)
+	}
+	if _, err := openTOTPSecret(2, sealed); err == nil {
+		t.Fatal("expected another account's secret not to open")
+	}
+}
+
+func TestTOTPStores(t *testing.T) {
+	for name, newStorage := range storageBackends() {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			store, ok := storage.(TOTPStore)
+			if !ok {
+				t.Skip("not a TOTPStore")
+			}
+			ctx := context.Background()
+			id, err := storage.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.GetTOTP(ctx, id); !errors.Is(err, ErrTOTPNotEnrolled) {
+				t.Fatalf("expected not enrolled, got %v", err)
+			}
+			err = store.SaveTOTP(ctx, &TOTPEnrollment{AccountID: id, Secret: []byte{1}, CreatedAt: time.Now().UTC()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := store.UseTOTPCounter(ctx, id, 10); !ok || err != nil {
+				t.Fatalf("expected the counter to be used, got %v, %v", ok, err)
+			}
+			if ok, _ := store.UseTOTPCounter(ctx, id, 10); ok {
+				t.Fatal("expected the same counter to be refused")
+			}
+			got, err := store.GetTOTP(ctx, id)
+			if err != nil || !got.Confirmed || got.LastCounter != 10 || got.Secret[0] != 1 {
+				t.Fatalf("unexpected enrollment %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestTOTPStepUp(t *testing.T) {
+	setTOTPKey(t)
+	ctx := context.Background()
+	server := newSDKServer(t)
+	admin := newAdminClient(server.URL)
+
+	c := client.New(server.URL, client.WithBackoff(time.Millisecond))
+	adaToken, _ := c.CreateAccount(ctx, "Ada", "Lovelace")
+	alanToken, _ := c.CreateAccount(ctx, "Alan", "Turing")
+	ada, err := c.Login(ctx, adaToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alan, _ := client.New(server.URL).Login(ctx, alanToken)
+	admin.Deposit(ctx, ada.ID, 100)
+
+	// Without TOTP there's no stepping up, so no transfers. The owner sets it up,
+	// admins never get to see the secret
+	if err := c.Transfer(ctx, ada.ID, alan.ID, 10); !errors.Is(err, client.ErrStepUpRequired) {
+		t.Fatalf("expected a step-up to be required, got %v", err)
+	}
+	if _, err := admin.EnrollTOTP(ctx, ada.ID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected an admin not to enroll, got %v", err)
+	}
+	setup, err := c.EnrollTOTP(ctx, ada.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(setup.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(secret, time.Now().Unix()/int64(totpPeriod.Seconds()))
+	if err := c.StepUp(ctx, "000000"); !errors.Is(err, client.ErrInvalidRequest) && code != "000000" {
+		t.Fatalf("expected a wrong code to be refused, got %v", err)
+	}
+
+	plain := client.New(server.URL)
+	plain.Login(ctx, adaToken)
+	if err := c.StepUp(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Transfer(ctx, ada.ID, alan.ID, 10); !errors.Is(err, client.ErrStepUpRequired) {
+		t.Fatalf("expected a step-up to be required, got %v", err)
+	}
+	if err := c.Transfer(ctx, ada.ID, alan.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nor can the code step up a second token
+	if err := plain.StepUp(ctx, code); !errors.Is(err, client.ErrInvalidRequest) {
+		t.Fatalf("expected a used code to be refused, got %v", err)
+	}
+	// Once confirmed, only a stepped up token swaps it
+	if _, err := plain.EnrollTOTP(ctx, ada.ID); !errors.Is(err, client.ErrStepUpRequired) {
+		t.Fatalf("expected a step-up to be required, got %v", err)
+	}
+	if _, err := c.EnrollTOTP(ctx, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ResetTOTP(ctx, ada.ID); !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected only admins to reset, got %v", err)
+	}
+	if err := admin.ResetTOTP(ctx, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StepUp(ctx, code); !errors.Is(err, client.ErrInvalidRequest) {
+		t.Fatalf("expected nothing to step up with, got %v", err)
+	}
+	// After which the plain token enrolls again
+	if _, err := plain.EnrollTOTP(ctx, ada.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStepUpTokensExpire(t *testing.T) {
+	t.Setenv("JWT_TOKEN", "test-secret")
+	token, err := createStepUpJWT(1, time.Now().Add(-accountTokenTTL-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateJWT(token); err == nil {
+		t.Fatal("expected an expired step-up token to be refused")
+	}
+}
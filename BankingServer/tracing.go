@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing, the OpenTelemetry way minus the dependency: a trace is a tree of spans,
+// one per request at the root and one per query under it. Trace context comes in
+// and goes out in W3C traceparent headers, so our spans join whatever trace the
+// caller started. Finished spans go to a SpanExporter.
+// A nil *Tracer traces nothing, and a nil *Span ignores everything, so code can
+// trace unconditionally
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+func (id SpanID) MarshalText() ([]byte, error)  { return []byte(id.String()), nil }
+
+// SpanContext is what crosses process boundaries
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+const traceparentHeader = "traceparent"
+
+// parseTraceparent reads a W3C traceparent header: version-traceid-spanid-flags
+func parseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four parts, later versions may add some
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	// All zeroes is how the spec spells "invalid"
+	if sc.TraceID == (TraceID{}) || sc.SpanID == (SpanID{}) {
+		return SpanContext{}, false
+	}
+
+	return sc, true
+}
+
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Span is one timed operation. Attributes follow the OpenTelemetry names where there's one
+type Span struct {
+	Name       string         `json:"name"`
+	TraceID    TraceID        `json:"traceId"`
+	SpanID     SpanID         `json:"spanId"`
+	ParentID   *SpanID        `json:"parentId,omitempty"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	DurationMs float64        `json:"durationMs"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+
+	sampled bool
+	tracer  *Tracer
+	mu      sync.Mutex
+	ended   bool
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Sampled: s.sampled}
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Name = name
+}
+
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter, if it's sampled. Only the first call counts
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.DurationMs = float64(s.End.Sub(s.Start).Microseconds()) / 1000
+	s.mu.Unlock()
+
+	if s.sampled {
+		s.tracer.export(s)
+	}
+}
+
+// SpanExporter is where finished spans go. Exporting happens as spans finish,
+// so it had better be quick
+type SpanExporter interface {
+	ExportSpan(*Span) error
+}
+
+type Tracer struct {
+	service  string
+	exporter SpanExporter
+	// The share of new traces that are recorded, between 0 and 1. Traces started
+	// by a caller follow the caller's choice
+	sampleRatio float64
+	// When export errors were last reported
+	lastError time.Time
+	mu        sync.Mutex
+}
+
+func NewTracer(service string, exporter SpanExporter, sampleRatio float64) *Tracer {
+	return &Tracer{
+		service:     service,
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+	}
+}
+
+type (
+	spanKey       struct{}
+	remoteSpanKey struct{}
+)
+
+// SpanFromContext is the span in progress, nil when there's none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// withRemoteSpanContext makes a span from another process the parent of the next one started
+func withRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanKey{}, sc)
+}
+
+// Start starts a span, a child of the one in ctx if there's one. The caller has to Finish it
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]any{"service.name": t.service},
+		tracer:     t,
+	}
+	rand.Read(span.SpanID[:])
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentID = &parent.SpanID
+		span.sampled = parent.sampled
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(SpanContext); ok {
+		span.TraceID = remote.TraceID
+		span.ParentID = &remote.SpanID
+		span.sampled = remote.Sampled
+	} else {
+		rand.Read(span.TraceID[:])
+		span.sampled = t.sample(span.TraceID)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startChildSpan starts a span only when there's a trace to add it to, with whatever
+// tracer that trace belongs to. Nothing's traced out of the blue this way
+func startChildSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name)
+}
+
+// sample decides from the trace ID itself, so the decision is the same wherever it's made
+func (t *Tracer) sample(id TraceID) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	n := uint64(0)
+	for _, b := range id[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n) < t.sampleRatio*math.MaxUint64
+}
+
+func (t *Tracer) export(s *Span) {
+	err := t.exporter.ExportSpan(s)
+	if err == nil {
+		return
+	}
+
+	// One broken exporter shouldn't flood the logs, once a minute will do
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.lastError) > time.Minute {
+		t.lastError = time.Now()
+		slog.Warn("exporting spans failed", "err", err)
+	}
+}
+
+// InjectTraceparent puts the trace ctx is part of in outgoing headers
+func InjectTraceparent(ctx context.Context, h http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set(traceparentHeader, span.Context().Traceparent())
+	}
+}
+
+// WriterExporter writes every span as a line of JSON, for reading with jq or
+// shipping elsewhere later
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterExporter(f), nil
+}
+
+func (e *WriterExporter) ExportSpan(s *Span) error {
+	s.mu.Lock()
+	line, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// newTracer sets up tracing from the env variables: TRACE_EXPORTER is "stdout" or
+// "file" (writing to TRACE_FILE), and tracing is off without it.
+// TRACE_SAMPLE_RATIO is the share of new traces kept, all of them by default
+func newTracer() (*Tracer, error) {
+	var exporter SpanExporter
+	switch kind := os.Getenv("TRACE_EXPORTER"); kind {
+	case "":
+		return nil, nil
+	case "stdout":
+		exporter = NewWriterExporter(os.Stdout)
+	case "file":
+		path := os.Getenv("TRACE_FILE")
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		fileExporter, err := NewFileExporter(path)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	default:
+		return nil, fmt.Errorf("unknown TRACE_EXPORTER %q", kind)
+	}
+
+	ratio := 1.0
+	if s := os.Getenv("TRACE_SAMPLE_RATIO"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("invalid TRACE_SAMPLE_RATIO %q", s)
+		}
+		ratio = r
+	}
+
+	return NewTracer("bankingserver", exporter, ratio), nil
+}
+
+// withTracing starts a span for every request, joining the caller's trace when the
+// request says which. It sits inside withRequestLogging, so the span can be named
+// after the route and the request's logs carry the trace ID
+func withTracing(tracer *Tracer, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = withRemoteSpanContext(ctx, sc)
+		}
+
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method)
+		defer span.Finish()
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+
+		info := requestInfoFrom(ctx)
+		if info != nil {
+			info.Logger = info.Logger.With("trace_id", span.TraceID.String())
+			span.SetAttr("http.request.id", info.ID)
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttr("http.response.status_code", rec.status)
+		if info != nil && info.Route != "" {
+			span.SetName("HTTP " + r.Method + " " + info.Route)
+			span.SetAttr("http.route", info.Route)
+		}
+		if rec.status >= 500 {
+			span.RecordError(fmt.Errorf("status %d", rec.status))
+		}
+	})
+}
+
+// tracedQueryer gives every query a span of its own, under the request's.
+// Reads are timed until the query returns, scanning the rows isn't included
+type tracedQueryer struct {
+	q      queryer
+	system string
+	// The transaction the queries are part of, if any
+	tx *Span
+}
+
+func (t tracedQueryer) start(ctx context.Context, op, query string) (context.Context, *Span) {
+	if t.tx != nil {
+		ctx = context.WithValue(ctx, spanKey{}, t.tx)
+	}
+	ctx, span := startChildSpan(ctx, "db."+op)
+	span.SetAttr("db.system", t.system)
+	span.SetAttr("db.statement", strings.Join(strings.Fields(query), " "))
+	return ctx, span
+}
+
+func (t tracedQueryer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := t.start(ctx, "exec", query)
+	defer span.Finish()
+
+	res, err := t.q.ExecContext(ctx, query, args...)
+	span.RecordError(err)
+	return res, err
+}
+
+func (t tracedQueryer) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := t.start(ctx, "query", query)
+	defer span.Finish()
+
+	rows, err := t.q.QueryContext(ctx, query, args...)
+	span.RecordError(err)
+	return rows, err
+}
+
+func (t tracedQueryer) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := t.start(ctx, "query", query)
+	defer span.Finish()
+
+	row := t.q.QueryRowContext(ctx, query, args...)
+	span.RecordError(row.Err())
+	return row
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// memoryExporter keeps the spans for the test to look at
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpan(s *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+	return nil
+}
+
+func (e *memoryExporter) named(prefix string) []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var spans []*Span
+	for _, s := range e.spans {
+		if strings.HasPrefix(s.Name, prefix) {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestParseTraceparent(t *testing.T) {
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := parseTraceparent(h)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != h {
+		t.Fatalf("round trip gave %s", sc.Traceparent())
+	}
+
+	bad := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, h := range bad {
+		if _, ok := parseTraceparent(h); ok {
+			t.Errorf("expected %q to be rejected", h)
+		}
+	}
+}
+
+func TestTracingRequestAndQueries(t *testing.T) {
+	ctx := context.Background()
+	sqlite, err := NewSQLiteStore(":memory:", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+	sqlite.Init(ctx)
+	id, _ := sqlite.CreateAccount(ctx, NewAccount("Ada", "Lovelace"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/account/{id}", func(w http.ResponseWriter, r *http.Request) {
+		NewTransferService(sqlite).Deposit(asOperator(r.Context()), id, 10)
+		acc, err := sqlite.GetAccountByID(r.Context(), id)
+		if err != nil {
+			t.Error(err)
+		}
+		WriteJSON(w, http.StatusOK, acc)
+	})
+	router.Use(withRouteInfo)
+
+	exporter := new(memoryExporter)
+	tracer := NewTracer("test", exporter, 1)
+	handler := withRequestLogging(slog.New(slog.NewTextHandler(io.Discard, nil)), withTracing(tracer, router))
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/account/1", nil)
+	req.Header.Set(traceparentHeader, incoming)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	requests := exporter.named("HTTP")
+	if len(requests) != 1 {
+		t.Fatalf("expected a span for the request, got %d", len(requests))
+	}
+	root := requests[0]
+	if root.Name != "HTTP GET /account/{id}" || root.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		root.ParentID == nil || root.ParentID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("request span didn't join the incoming trace: %+v", root)
+	}
+	if root.Attributes["http.response.status_code"] != http.StatusOK || root.Attributes["http.route"] != "/account/{id}" {
+		t.Fatalf("unexpected request attributes %v", root.Attributes)
+	}
+
+	// The deposit is a transaction with its queries under it (the update, reading the
+	// balance back and the event), the read a query of its own
+	txs := exporter.named("db.transaction")
+	if len(txs) != 1 || *txs[0].ParentID != root.SpanID {
+		t.Fatalf("expected one transaction under the request, got %v", txs)
+	}
+	var underTx, underRoot int
+	for _, q := range exporter.named("db.") {
+		if q.TraceID != root.TraceID {
+			t.Fatalf("query span in another trace: %+v", q)
+		}
+		switch *q.ParentID {
+		case txs[0].SpanID:
+			underTx++
+		case root.SpanID:
+			underRoot++
+		}
+	}
+	if underTx != 3 || underRoot != 2 {
+		t.Fatalf("expected 3 queries in the transaction and the transaction and a read under the request, got %d and %d", underTx, underRoot)
+	}
+
+	read := exporter.named("db.query")
+	if stmt, _ := read[len(read)-1].Attributes["db.statement"].(string); !strings.Contains(stmt, "FROM Account WHERE id = $1") {
+		t.Fatalf("unexpected statement %q", stmt)
+	}
+
+	// Nothing runs outside a request without a trace to belong to
+	before := len(exporter.named(""))
+	sqlite.GetAccountByID(ctx, id)
+	if len(exporter.named("")) != before {
+		t.Fatal("query outside any trace was traced")
+	}
+}
+
+func TestTracingPropagation(t *testing.T) {
+	exporter := new(memoryExporter)
+	tracer := NewTracer("test", exporter, 1)
+
+	ctx, span := tracer.Start(context.Background(), "outgoing")
+	h := make(http.Header)
+	InjectTraceparent(ctx, h)
+	sc, ok := parseTraceparent(h.Get(traceparentHeader))
+	if !ok || sc.TraceID != span.TraceID || sc.SpanID != span.SpanID || !sc.Sampled {
+		t.Fatalf("unexpected outgoing traceparent %q", h.Get(traceparentHeader))
+	}
+
+	// A caller that doesn't record its trace gets nothing recorded here either
+	unsampled := withRemoteSpanContext(context.Background(), SpanContext{TraceID: span.TraceID, SpanID: span.SpanID})
+	_, child := tracer.Start(unsampled, "child")
+	child.Finish()
+	span.Finish()
+	if len(exporter.spans) != 1 || exporter.spans[0] != span {
+		t.Fatalf("expected only the sampled span exported, got %d", len(exporter.spans))
+	}
+
+	// Tracing off is a nil tracer, and everything still works
+	var off *Tracer
+	ctx, nothing := off.Start(context.Background(), "nothing")
+	nothing.SetAttr("key", "value")
+	nothing.Finish()
+	InjectTraceparent(ctx, h)
+}
+
+func TestWriterExporter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	tracer := NewTracer("test", NewWriterExporter(buf), 1)
+	_, span := tracer.Start(context.Background(), "work")
+	span.SetAttr("answer", 42)
+	span.Finish()
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["name"] != "work" || got["traceId"] != span.TraceID.String() || got["attributes"].(map[string]any)["answer"] != float64(42) {
+		t.Fatalf("unexpected span line %v", got)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"time"
+)
+
+// TxOption tweaks how Storage.WithTx runs its transaction
+type TxOption func(*txConfig)
+
+type txConfig struct {
+	isolation  sql.IsolationLevel
+	maxRetries int
+}
+
+const defaultTxRetries = 3
+
+func newTxConfig(opts []TxOption) *txConfig {
+	cfg := &txConfig{
+		isolation:  sql.LevelDefault,
+		maxRetries: defaultTxRetries,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// WithIsolation picks the isolation level, the backend's default otherwise
+func WithIsolation(level sql.IsolationLevel) TxOption {
+	return func(cfg *txConfig) {
+		cfg.isolation = level
+	}
+}
+
+// WithMaxRetries caps how many times a transaction that lost a race is run again.
+// Zero means it's tried once and that's it
+func WithMaxRetries(n int) TxOption {
+	return func(cfg *txConfig) {
+		cfg.maxRetries = n
+	}
+}
+
+// retryTx runs attempt until it succeeds, fails for a reason retrying won't fix, or
+// runs out of retries. fn must be safe to run more than once, which a rolled back
+// transaction is
+func retryTx(ctx context.Context, cfg *txConfig, retryable func(error) bool, attempt func() error) error {
+	backoff := 5 * time.Millisecond
+
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= cfg.maxRetries || !retryable(err) {
+			return err
+		}
+
+		// Some jitter, so the two transactions that just collided don't collide again
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestMemoryStoreWithTxRollsBack(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	id, _ := store.CreateAccount(ctx, &Account{FirstName: "Ada", AccNumber: 1})
+	store.Deposit(ctx, id, 100)
+
+	failed := errors.New("audit row rejected")
+	err := store.WithTx(ctx, func(tx Storage) error {
+		if _, err := tx.CreateAccount(ctx, &Account{FirstName: "Grace", AccNumber: 2}); err != nil {
+			return err
+		}
+		if err := tx.Deposit(ctx, id, 50); err != nil {
+			return err
+		}
+		if err := tx.RecordEvent(ctx, EventDepositCompleted, id, DepositCompletedPayload{AccountID: id, Amount: 50}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the callback's error back, got %v", err)
+	}
+
+	page, _ := store.GetAccounts(ctx, DefaultAccountQuery())
+	if page.Total != 1 {
+		t.Fatalf("account created in a failed transaction survived: %d accounts", page.Total)
+	}
+	acc, _ := store.GetAccountByID(ctx, id)
+	if acc.Balance != 100 {
+		t.Fatalf("deposit in a failed transaction survived: balance %d", acc.Balance)
+	}
+	events, _ := store.FetchPendingEvents(ctx, 10)
+	if len(events) != 0 {
+		t.Fatalf("events from a failed transaction survived: %d events", len(events))
+	}
+}
+
+func TestMemoryStoreNestedWithTxJoins(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	err := store.WithTx(ctx, func(tx Storage) error {
+		tx.CreateAccount(ctx, &Account{AccNumber: 1})
+		// Would deadlock if the inner call tried to take the lock again
+		return tx.WithTx(ctx, func(inner Storage) error {
+			_, err := inner.CreateAccount(ctx, &Account{AccNumber: 2})
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page, _ := store.GetAccounts(ctx, DefaultAccountQuery())
+	if page.Total != 2 {
+		t.Fatalf("expected both accounts committed, got %d", page.Total)
+	}
+}
+
+func TestRetryTx(t *testing.T) {
+	conflict := &pq.Error{Code: "40001"}
+	ctx := context.Background()
+
+	attempts := 0
+	err := retryTx(ctx, newTxConfig(nil), isPostgresRetryable, func() error {
+		attempts++
+		if attempts < 3 {
+			return conflict
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("expected success on the third attempt, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	err = retryTx(ctx, newTxConfig([]TxOption{WithMaxRetries(1)}), isPostgresRetryable, func() error {
+		attempts++
+		return conflict
+	})
+	if !errors.Is(err, conflict) || attempts != 2 {
+		t.Fatalf("expected to give up after 2 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	retryTx(ctx, newTxConfig(nil), isPostgresRetryable, func() error {
+		attempts++
+		return ErrInsufficientFunds
+	})
+	if attempts != 1 {
+		t.Fatalf("a business error was retried %d times", attempts)
+	}
+}
+
+func TestIsPostgresRetryable(t *testing.T) {
+	cases := map[error]bool{
+		&pq.Error{Code: "40001"}: true,
+		&pq.Error{Code: "40P01"}: true,
+		&pq.Error{Code: "23505"}: false,
+		errors.New("40001"):      false,
+	}
+	for err, want := range cases {
+		if got := isPostgresRetryable(err); got != want {
+			t.Errorf("isPostgresRetryable(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
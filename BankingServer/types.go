@@ -12,17 +12,38 @@ type CreateAccountRequest struct {
 }
 
 type Account struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"firstName"`
-	LastName  string    `json:"lastName"`
-	AccNumber int64     `json:"number"`
-	Balance   int64     `json:"balance"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID        int           `json:"id"`
+	FirstName string        `json:"firstName"`
+	LastName  string        `json:"lastName"`
+	AccNumber int64         `json:"number"`
+	Balance   int64         `json:"balance"`
+	Status    AccountStatus `json:"status"`
+	CreatedAt time.Time     `json:"createdAt"`
 }
 
+// A frozen account keeps its money where it is: nothing goes in or out until
+// an admin unfreezes it
+type AccountStatus string
+
+const (
+	AccountActive AccountStatus = "active"
+	AccountFrozen AccountStatus = "frozen"
+)
+
 type TransferRequest struct {
-	ToAccount int `json:"toAccount"`
-	Amount    int `json:"amount"`
+	FromAccount int `json:"fromAccount"`
+	ToAccount   int `json:"toAccount"`
+	Amount      int `json:"amount"`
+}
+
+type DepositRequest struct {
+	Amount int64 `json:"amount"`
+}
+
+// newAccountNumber can come up with one that's taken, the store refuses it with
+// ErrDuplicateAccountNumber
+var newAccountNumber = func() int64 {
+	return int64(rand.Intn(1000000))
 }
 
 func NewAccount(firstName, lastName string) *Account {
@@ -30,7 +51,8 @@ func NewAccount(firstName, lastName string) *Account {
 	return &Account{
 		FirstName: firstName,
 		LastName:  lastName,
-		AccNumber: int64(rand.Intn(1000000)),
+		AccNumber: newAccountNumber(),
+		Status:    AccountActive,
 		CreatedAt: time.Now().UTC(),
 	}
 }
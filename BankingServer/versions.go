@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The API lives under a version prefix, /v1 for now. A version that's on its way
+// out keeps being served until its sunset, with every response saying so
+// (RFC 9745's Deprecation, RFC 8594's Sunset, and a Link to what replaces it),
+// then answers 410 Gone
+
+const apiPrefix = "/v1"
+
+type deprecation struct {
+	// The paths the deprecated version is served under
+	prefix string
+	since  time.Time
+	sunset time.Time
+	// Where the same routes live in the version that replaces it
+	successor string
+}
+
+// The routes from before there were versions, which are the v1 routes under another name
+var unversionedAPI = deprecation{
+	prefix:    "",
+	since:     time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+	sunset:    time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+	successor: apiPrefix,
+}
+
+// withDeprecation marks whatever next answers as deprecated, and stops answering
+// at all once the version's sunset has come
+func withDeprecation(d deprecation, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := d.successor + strings.TrimPrefix(r.URL.Path, d.prefix)
+
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.since.Unix()))
+		w.Header().Set("Sunset", d.sunset.UTC().Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+		if !time.Now().Before(d.sunset) {
+			WriteJSON(w, http.StatusGone, apiError{ErrorMsg: "This version of the API is gone, use " + successor})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUnversioned is the router's NotFoundHandler: a path that isn't a route may
+// be one from before /v1, which gets served as the v1 route it now is. Going
+// through the router again means the middleware runs once, for the v1 route
+func handleUnversioned(router *mux.Router) http.Handler {
+	asV1 := withDeprecation(unversionedAPI, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = apiPrefix + r.URL.Path
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = apiPrefix + r.URL.RawPath
+		}
+
+		router.ServeHTTP(w, r2)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		asV1.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhooks let account owners know when money arrives.
+// Unlike the outbox, which tells our other services everything, these only carry
+// what concerns a single account, and are signed so the owner can trust them.
+type Webhook struct {
+	ID        int    `json:"id"`
+	AccountID int    `json:"accountId"`
+	URL       string `json:"url"`
+	// Only ever shown once, when the webhook is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type CreateWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// Dead deliveries ran out of attempts, they're kept for the history but never retried
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int             `json:"webhookId"`
+	AccountID      int             `json:"accountId"`
+	EventID        int64           `json:"eventId"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         DeliveryStatus  `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+
+	// Needed to send it, not to show it
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// What the account owner receives
+type WebhookPayload struct {
+	Type        string    `json:"type"`
+	EventID     int64     `json:"eventId"`
+	AccountID   int       `json:"accountId"`
+	Amount      int64     `json:"amount"`
+	FromAccount int       `json:"fromAccount,omitempty"`
+	OccurredAt  time.Time `json:"occurredAt"`
+}
+
+const (
+	WebhookTransferReceived = "transfer.received"
+	WebhookDepositReceived  = "deposit.received"
+)
+
+type WebhookStore interface {
+	CreateWebhook(context.Context, *Webhook) (int, error)
+	GetWebhooks(ctx context.Context, accountID int) ([]*Webhook, error)
+	DeleteWebhook(ctx context.Context, accountID, webhookID int) error
+	// Enqueuing the same event twice must not create duplicate deliveries
+	EnqueueWebhookDeliveries(ctx context.Context, accountID int, eventID int64, payload []byte) error
+	FetchDueDeliveries(ctx context.Context, limit int) ([]*WebhookDelivery, error)
+	UpdateDelivery(context.Context, *WebhookDelivery) error
+	GetDeliveries(ctx context.Context, accountID, limit int) ([]*WebhookDelivery, error)
+}
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// webhookTargets is what webhooks may be sent to. The deliveries come from inside
+// our network, so anything but a public https URL would let an account owner have
+// us POST wherever they like: the metadata service, the DB, the admin routes on
+// loopback. Tests deliver to httptest servers, which are neither
+var webhookTargets = struct {
+	allowHTTP    bool
+	allowPrivate bool
+}{}
+
+// Not private as net.IP has it, but no more reachable from the internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+func isPublicAddr(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost refuses a host that resolves to anything but public addresses.
+// It can resolve elsewhere by the time we deliver, which is what webhookDialControl
+// is for
+func checkWebhookHost(ctx context.Context, host string) error {
+	if webhookTargets.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("webhook host %q doesn't resolve", host)
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr.IP) {
+			return fmt.Errorf("webhook host %q isn't a public address", host)
+		}
+	}
+	return nil
+}
+
+// webhookDialControl runs on the address about to be connected to, after DNS, so a
+// name that changed what it resolves to since it was checked is still caught
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	if webhookTargets.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddr(ip) {
+		return fmt.Errorf("refusing to deliver a webhook to %s", host)
+	}
+	return nil
+}
+
+func NewWebhook(ctx context.Context, accountID int, rawURL string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && (u.Scheme != "http" || !webhookTargets.allowHTTP)) || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url: %q, it has to be https", rawURL)
+	}
+	if err := checkWebhookHost(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &Webhook{
+		AccountID: accountID,
+		URL:       u.String(),
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// The signature covers the timestamp too, so a captured request can't be replayed later
+// with a fresh timestamp
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature is what receivers are expected to do with our headers
+func VerifyWebhookSignature(secret, timestamp, signature string, body []byte) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	expected := signWebhookPayload(secret, ts, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// WebhookFanout sits behind the outbox relay and turns our domain events into
+// deliveries for the webhooks of the accounts concerned
+type WebhookFanout struct {
+	store WebhookStore
+}
+
+func NewWebhookFanout(store WebhookStore) *WebhookFanout {
+	return &WebhookFanout{store: store}
+}
+
+func (f *WebhookFanout) Publish(ctx context.Context, ev *Event) error {
+	payload := WebhookPayload{EventID: ev.ID, OccurredAt: ev.CreatedAt}
+
+	switch ev.Type {
+	case EventTransferCompleted:
+		transfer := new(TransferCompletedPayload)
+		if err := json.Unmarshal(ev.Payload, transfer); err != nil {
+			return err
+		}
+		payload.Type = WebhookTransferReceived
+		payload.AccountID = transfer.ToAccount
+		payload.FromAccount = transfer.FromAccount
+		payload.Amount = transfer.Amount
+	case EventDepositCompleted:
+		deposit := new(DepositCompletedPayload)
+		if err := json.Unmarshal(ev.Payload, deposit); err != nil {
+			return err
+		}
+		payload.Type = WebhookDepositReceived
+		payload.AccountID = deposit.AccountID
+		payload.Amount = deposit.Amount
+	default:
+		// Nothing an account owner needs to hear about
+		return nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return f.store.EnqueueWebhookDeliveries(ctx, payload.AccountID, ev.ID, body)
+}
+
+const (
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 50
+	webhookMaxAttempts  = 8
+	webhookTimeout      = 10 * time.Second
+)
+
+// WebhookDispatcher sends due deliveries, retrying with exponential backoff until
+// they either succeed or run out of attempts
+type WebhookDispatcher struct {
+	store       WebhookStore
+	client      *http.Client
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	logger      *slog.Logger
+	quitch      chan struct{}
+}
+
+func NewWebhookDispatcher(store WebhookStore, logger *slog.Logger) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:       store,
+		client:      newWebhookClient(),
+		interval:    webhookPollInterval,
+		batchSize:   webhookBatchSize,
+		maxAttempts: webhookMaxAttempts,
+		logger:      logger,
+		quitch:      make(chan struct{}),
+	}
+}
+
+// newWebhookClient goes straight to the receiver: no proxy, which the dial check
+// would see instead of it, and no redirects, which could take the delivery somewhere
+// the URL was never checked against
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (d *WebhookDispatcher) Start() {
+	go d.loop()
+}
+
+func (d *WebhookDispatcher) Stop() {
+	close(d.quitch)
+}
+
+func (d *WebhookDispatcher) loop() {
+	// Stopping cancels whatever batch is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	go func() {
+		<-d.quitch
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.dispatchBatch(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatchBatch attempts every due delivery once and returns how many succeeded
+func (d *WebhookDispatcher) dispatchBatch(ctx context.Context) int {
+	deliveries, err := d.store.FetchDueDeliveries(ctx, d.batchSize)
+	if err != nil {
+		d.logger.Error("could not fetch webhook deliveries", "err", err)
+		return 0
+	}
+
+	delivered := 0
+	for _, delivery := range deliveries {
+		statusCode, err := d.send(ctx, delivery)
+		delivery.Attempts++
+		delivery.LastStatusCode = statusCode
+
+		now := time.Now().UTC()
+		switch {
+		case err == nil:
+			delivery.Status = DeliveryDelivered
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+			delivered++
+		case delivery.Attempts >= d.maxAttempts:
+			delivery.Status = DeliveryDead
+			delivery.LastError = err.Error()
+		default:
+			delivery.LastError = err.Error()
+			delivery.NextAttemptAt = now.Add(retryBackoff(delivery.Attempts))
+		}
+
+		if err := d.store.UpdateDelivery(ctx, delivery); err != nil {
+			d.logger.Error("could not update webhook delivery", "delivery_id", delivery.ID, "event_id", delivery.EventID,
+				"attempts", delivery.Attempts, "status", delivery.Status, "err", err)
+		}
+	}
+
+	return delivered
+}
+
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", strconv.Itoa(delivery.WebhookID))
+	req.Header.Set("X-Delivery-ID", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Signature-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Signature", signWebhookPayload(delivery.Secret, timestamp, delivery.Payload))
+	InjectTraceparent(ctx, req.Header)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver answered with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Only the parts of WebhookStore the dispatcher and the fanout touch do anything
+type fakeWebhookStore struct {
+	mu         sync.Mutex
+	hooks      []*Webhook
+	deliveries []*WebhookDelivery
+}
+
+func (f *fakeWebhookStore) CreateWebhook(_ context.Context, hook *Webhook) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hook.ID = len(f.hooks) + 1
+	f.hooks = append(f.hooks, hook)
+	return hook.ID, nil
+}
+
+func (f *fakeWebhookStore) GetWebhooks(_ context.Context, accountID int) ([]*Webhook, error) {
+	return nil, nil
+}
+
+func (f *fakeWebhookStore) DeleteWebhook(_ context.Context, accountID, webhookID int) error {
+	return nil
+}
+
+func (f *fakeWebhookStore) EnqueueWebhookDeliveries(_ context.Context, accountID int, eventID int64, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, hook := range f.hooks {
+		if hook.AccountID != accountID {
+			continue
+		}
+		duplicate := false
+		for _, d := range f.deliveries {
+			if d.WebhookID == hook.ID && d.EventID == eventID {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			continue
+		}
+		f.deliveries = append(f.deliveries, &WebhookDelivery{
+			ID:        int64(len(f.deliveries) + 1),
+			WebhookID: hook.ID,
+			AccountID: accountID,
+			EventID:   eventID,
+			Payload:   payload,
+			Status:    DeliveryPending,
+			URL:       hook.URL,
+			Secret:    hook.Secret,
+		})
+	}
+	return nil
+}
+
+func (f *fakeWebhookStore) FetchDueDeliveries(_ context.Context, limit int) ([]*WebhookDelivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var due []*WebhookDelivery
+	for _, d := range f.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(time.Now()) {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeWebhookStore) UpdateDelivery(_ context.Context, d *WebhookDelivery) error {
+	return nil
+}
+
+func (f *fakeWebhookStore) GetDeliveries(_ context.Context, accountID, limit int) ([]*WebhookDelivery, error) {
+	return f.deliveries, nil
+}
+
+// Receivers in tests are httptest servers, on plain http and loopback
+func allowTestWebhooks(t *testing.T) {
+	t.Helper()
+	webhookTargets.allowHTTP, webhookTargets.allowPrivate = true, true
+	t.Cleanup(func() { webhookTargets.allowHTTP, webhookTargets.allowPrivate = false, false })
+}
+
+func TestWebhookFanoutAndSignedDelivery(t *testing.T) {
+	allowTestWebhooks(t)
+	var (
+		mu       sync.Mutex
+		received []WebhookPayload
+		secret   string
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyWebhookSignature(secret, r.Header.Get("X-Signature-Timestamp"), r.Header.Get("X-Signature"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	store := &fakeWebhookStore{}
+	hook, err := NewWebhook(context.Background(), 2, receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret = hook.Secret
+	store.CreateWebhook(context.Background(), hook)
+
+	transfer, _ := json.Marshal(TransferCompletedPayload{FromAccount: 1, ToAccount: 2, Amount: 40})
+	ev := &Event{ID: 9, Type: EventTransferCompleted, AggregateID: 1, Payload: transfer}
+
+	fanout := NewWebhookFanout(store)
+	// The relay is at-least-once, so the same event may well come twice
+	fanout.Publish(context.Background(), ev)
+	fanout.Publish(context.Background(), ev)
+	// And the sender's side isn't any of the receiver's business
+	created, _ := json.Marshal(Account{ID: 1})
+	fanout.Publish(context.Background(), &Event{ID: 10, Type: EventAccountCreated, AggregateID: 1, Payload: created})
+
+	if len(store.deliveries) != 1 {
+		t.Fatalf("expected a single delivery, got %d", len(store.deliveries))
+	}
+
+	if n := NewWebhookDispatcher(store, slog.Default()).dispatchBatch(context.Background()); n != 1 {
+		t.Fatalf("expected the delivery to succeed, status %s: %s", store.deliveries[0].Status, store.deliveries[0].LastError)
+	}
+	if len(received) != 1 || received[0].Type != WebhookTransferReceived || received[0].Amount != 40 || received[0].FromAccount != 1 {
+		t.Fatalf("receiver got %+v", received)
+	}
+	if store.deliveries[0].Status != DeliveryDelivered || store.deliveries[0].DeliveredAt == nil {
+		t.Fatalf("delivery not marked as delivered: %+v", store.deliveries[0])
+	}
+}
+
+func TestWebhookDispatcherDeadLetters(t *testing.T) {
+	allowTestWebhooks(t)
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	store := &fakeWebhookStore{}
+	hook, _ := NewWebhook(context.Background(), 5, receiver.URL)
+	store.CreateWebhook(context.Background(), hook)
+	deposit, _ := json.Marshal(DepositCompletedPayload{AccountID: 5, Amount: 10})
+	NewWebhookFanout(store).Publish(context.Background(), &Event{ID: 1, Type: EventDepositCompleted, Payload: deposit})
+
+	dispatcher := NewWebhookDispatcher(store, slog.Default())
+	dispatcher.maxAttempts = 3
+
+	delivery := store.deliveries[0]
+	for i := 1; i <= 3; i++ {
+		dispatcher.dispatchBatch(context.Background())
+		if delivery.Attempts != i || delivery.LastStatusCode != http.StatusInternalServerError {
+			t.Fatalf("attempt %d not recorded: %+v", i, delivery)
+		}
+		if i < 3 && delivery.NextAttemptAt.Before(time.Now()) {
+			t.Fatalf("no backoff after attempt %d", i)
+		}
+		// Skip the wait
+		delivery.NextAttemptAt = time.Now()
+	}
+
+	if delivery.Status != DeliveryDead {
+		t.Fatalf("expected a dead delivery, got %s", delivery.Status)
+	}
+	dispatcher.dispatchBatch(context.Background())
+	if calls != 3 {
+		t.Fatalf("dead delivery was retried: %d calls", calls)
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"amount":1}`)
+	sig := signWebhookPayload("secret", 1700000000, body)
+
+	if !VerifyWebhookSignature("secret", "1700000000", sig, body) {
+		t.Fatal("valid signature rejected")
+	}
+	if VerifyWebhookSignature("secret", "1700000001", sig, body) {
+		t.Fatal("signature accepted with another timestamp")
+	}
+	if VerifyWebhookSignature("other", "1700000000", sig, body) {
+		t.Fatal("signature accepted with another secret")
+	}
+}
+
+func TestNewWebhookRejectsBadURLs(t *testing.T) {
+	bad := []string{
+		"", "ftp://example.com", "not a url", "http://", "http://93.184.215.14/hook",
+		// Where we are, not where the owner is
+		"https://127.0.0.1/hook", "https://localhost:3000/v1/apikey", "https://10.0.0.5/", "https://[::1]/",
+		"https://169.254.169.254/latest/meta-data/", "https://[::ffff:192.168.1.1]/", "https://100.64.0.1/",
+	}
+	for _, u := range bad {
+		if _, err := NewWebhook(context.Background(), 1, u); err == nil {
+			t.Errorf("expected %q to be rejected", u)
+		}
+	}
+	if _, err := NewWebhook(context.Background(), 1, "https://93.184.215.14/hook"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A name checked when the webhook was made can point somewhere else by the time
+// it's delivered to
+func TestWebhookDispatcherRefusesPrivateAddresses(t *testing.T) {
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer receiver.Close()
+
+	store := &fakeWebhookStore{}
+	store.CreateWebhook(context.Background(), &Webhook{AccountID: 5, URL: receiver.URL, Secret: "secret"})
+	deposit, _ := json.Marshal(DepositCompletedPayload{AccountID: 5, Amount: 10})
+	NewWebhookFanout(store).Publish(context.Background(), &Event{ID: 1, Type: EventDepositCompleted, Payload: deposit})
+
+	if n := NewWebhookDispatcher(store, slog.Default()).dispatchBatch(context.Background()); n != 0 || calls != 0 {
+		t.Fatalf("expected nothing delivered to loopback, got %d deliveries", calls)
+	}
+	if !strings.Contains(store.deliveries[0].LastError, "refusing") {
+		t.Fatalf("unexpected error %q", store.deliveries[0].LastError)
+	}
+}